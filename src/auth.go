@@ -0,0 +1,174 @@
+package main
+
+import (
+	"bufio"
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net"
+	"net/rpc"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// Every connection to the daemon starts with the line "APOLLO <token>\n"
+// answered by "OK\n", only then the rpc codec takes over the connection.
+// Starting with "JSONRPC <token>\n" instead selects the JSON-RPC 2.0 codec.
+// The token is checked when the daemon requires authentication, which is the
+// case on tcp unless rpc_auth is off. The unix socket is protected by its
+// permissions instead, so JSON-RPC clients can also skip the handshake there
+// and send their first request right away.
+
+var err_unauthorized = errors.New("connection rejected: invalid token")
+
+const handshake_timeout = 5 * time.Second
+
+func get_token_filepath(config *Config) string {
+	return filepath.Join(filepath.Dir(config.path), "token")
+}
+
+// reads the shared secret, generating it when it does not exist yet.
+func get_token(config *Config) (string, error) {
+	token_filepath := get_token_filepath(config)
+	data, err := os.ReadFile(token_filepath)
+	if err == nil {
+		return strings.TrimSpace(string(data)), nil
+	}
+	if !errors.Is(err, os.ErrNotExist) {
+		return "", err
+	}
+	secret := make([]byte, 32)
+	_, err = rand.Read(secret)
+	if err != nil {
+		return "", err
+	}
+	token := hex.EncodeToString(secret)
+	err = os.WriteFile(token_filepath, []byte(token+"\n"), 0600)
+	if err != nil {
+		return "", err
+	}
+	fmt.Fprintf(os.Stderr, "Apollo: Generated rpc token in %s\n", token_filepath)
+	return token, nil
+}
+
+// the token given by --token or APOLLO_TOKEN, or the local one.
+func get_client_token(config *Config) string {
+	if config.token != "" {
+		return config.token
+	}
+	data, err := os.ReadFile(get_token_filepath(config))
+	if err != nil {
+		return ""
+	}
+	return strings.TrimSpace(string(data))
+}
+
+// reads a single line without buffering past it so the rest of the
+// connection is left to the rpc codec.
+func read_line(conn net.Conn) (string, error) {
+	line := []byte{}
+	b := make([]byte, 1)
+	for len(line) < 256 {
+		_, err := conn.Read(b)
+		if err != nil {
+			return "", err
+		}
+		if b[0] == '\n' {
+			return string(line), nil
+		}
+		line = append(line, b[0])
+	}
+	return "", fmt.Errorf("handshake line too long")
+}
+
+func dial_rpc(config *Config) (*rpc.Client, error) {
+	conn, err := net.Dial(config.RpcNetwork, config.RpcAddr)
+	if err != nil {
+		return nil, err
+	}
+	conn.SetDeadline(time.Now().Add(handshake_timeout))
+	_, err = fmt.Fprintf(conn, "APOLLO %s\n", get_client_token(config))
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	line, err := read_line(conn)
+	if err != nil || line != "OK" {
+		conn.Close()
+		return nil, err_unauthorized
+	}
+	conn.SetDeadline(time.Time{})
+	return rpc.NewClient(conn), nil
+}
+
+// codecs a connection can ask for in the handshake
+const (
+	proto_gob = "APOLLO"
+	proto_jsonrpc = "JSONRPC"
+)
+
+// a connection whose reads go through the buffer filled by the handshake.
+type buffered_conn struct {
+	net.Conn
+	reader *bufio.Reader
+}
+
+func (c *buffered_conn) Read(p []byte) (int, error) {
+	return c.reader.Read(p)
+}
+
+// checks the handshake of a new connection before any method can be called,
+// returns the codec the connection asked for.
+func (d *Daemon) authenticate(conn *buffered_conn) (string, bool) {
+	conn.SetDeadline(time.Now().Add(handshake_timeout))
+	defer conn.SetDeadline(time.Time{})
+	first, err := conn.reader.Peek(1)
+	if err != nil {
+		return "", false
+	}
+	if first[0] == '{' {
+		if d.auth {
+			new_jsonrpc_codec(conn).write_error(nil, jsonrpc_server_error, "unauthorized: handshake required",
+				&RpcError{ Code: code_unauthorized, Message: "handshake required" })
+			return "", false
+		}
+		return proto_jsonrpc, true
+	}
+	line, err := conn.reader.ReadSlice('\n')
+	if err != nil {
+		return "", false
+	}
+	proto, token, _ := strings.Cut(strings.TrimSpace(string(line)), " ")
+	if proto != proto_gob && proto != proto_jsonrpc {
+		fmt.Fprintf(conn, "ERR invalid handshake\n")
+		return "", false
+	}
+	if d.auth && subtle.ConstantTimeCompare([]byte(token), []byte(d.token)) != 1 {
+		logger(log_rpc).Warn("rejected a connection with an invalid token", "remote", conn.RemoteAddr().String())
+		fmt.Fprintf(conn, "ERR unauthorized\n")
+		return "", false
+	}
+	_, err = fmt.Fprintf(conn, "OK\n")
+	return proto, err == nil
+}
+
+// d.conns.Add(1) is called by serve_rpc before the goroutine starts
+func (d *Daemon) serve_conn(conn net.Conn) {
+	defer d.conns.Done()
+	bconn := &buffered_conn{ Conn: conn, reader: bufio.NewReader(conn) }
+	proto, ok := d.authenticate(bconn)
+	if !ok {
+		conn.Close()
+		return
+	}
+	logger(log_rpc).Debug("client connected", "proto", proto)
+	if proto == proto_jsonrpc {
+		d.server.ServeCodec(new_jsonrpc_codec(bconn))
+		return
+	}
+	d.server.ServeConn(bconn)
+}
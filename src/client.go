@@ -1,121 +1,155 @@
 package main
 
 import (
+	"encoding/json"
 	"fmt"
+	"errors"
+	"io"
 	"net/rpc"
+	"os"
+	"path/filepath"
 	"strconv"
+	"syscall"
+	"time"
 )
 
-func handle_daemon(d *Daemon, cmd string, args []any) {
-	client, err := rpc.Dial(d.network, d.config.RpcPort)
+// runs a command of the cli, on the daemon or on the database when it is not
+// running. The replies are printed to w and the error is returned.
+func handle_daemon(w io.Writer, d *Daemon, cmd string, args []any) error {
+	client, err := dial_rpc(d.config)
+	if errors.Is(err, err_unauthorized) {
+		return new_rpc_error(code_unauthorized, "%v", err)
+	}
+	if err != nil && d.config.remote {
+		return new_rpc_error(code_rpc, "cannot reach %s: %v", d.config.RpcAddr, err)
+	}
 	if err != nil {
-		handle_offline(cmd, args, *d.config)
-		return
+		return handle_offline(w, cmd, args, *d.config)
+	}
+	defer client.Close()
+	return run_command(w, client, d.config, cmd, args)
+}
+
+// connects to the daemon for the clients that cannot do without it.
+func dial_daemon(config *Config) (*rpc.Client, error) {
+	client, err := dial_rpc(config)
+	if errors.Is(err, err_unauthorized) {
+		return nil, new_rpc_error(code_unauthorized, "%v", err)
+	}
+	if err != nil && config.remote {
+		return nil, new_rpc_error(code_rpc, "cannot reach %s: %v", config.RpcAddr, err)
 	}
+	if err != nil {
+		return nil, new_rpc_error(code_not_running, "Daemon is not active...")
+	}
+	return client, nil
+}
 
-	var reply string
+// runs a command of the cli on the daemon behind client.
+func run_command(w io.Writer, client *rpc.Client, config *Config, cmd string, args []any) error {
+	var reply any
+	var err error
 	switch cmd {
 	case "sync":
 		dirpath := ""
 		if len(args) > 0 {
 			dirpath = args[0].(string)
 		}
-		err = client.Call("MusicManager.Sync", dirpath, &reply)
+		reply, err = call[SyncReply](client, "MusicManager.Sync", dirpath)
 	case "play":
 		name := ""
 		if len(args) > 0 {
 			name = args[0].(string)
-			db, err := get_db()
+		}
+		// the database of a remote daemon is not on this host
+		if name != "" && !config.remote {
+			db, err := get_db(config.DataDir, config.quiet)
 			if err != nil {
-				fmt.Printf("Apollo: error getting db: %v!\n", err)
-				return
+				return new_rpc_error(code_internal, "error getting db: %v!", err)
 			}
 			defer db.Close()
-			if !exists(db, "playlists", fmt.Sprintf("name = '%s'", name)) {
-				fmt.Printf("Apollo: playlist '%s' does not exist!\n", name)
-				return
+			if !exists(db, "playlists", "name = ?", name) {
+				return new_rpc_error(code_not_found, "playlist '%s' does not exist!", name)
 			}
 		}
-		err = client.Call("MusicManager.Play", name, &reply)
+		reply, err = call[PlayerReply](client, "MusicManager.Play", name)
+	case "status":
+		reply, err = call[Status](client, "MusicManager.Status", "")
 	case "stop":
-		err = client.Call("MusicManager.Stop", "", &reply)
+		reply, err = call[PlayerReply](client, "MusicManager.Stop", "")
 	case "toggle":
-		err = client.Call("MusicManager.Toggle", "", &reply)
+		reply, err = call[PlayerReply](client, "MusicManager.Toggle", "")
 	case "next":
-		err = client.Call("MusicManager.Next", "", &reply)
+		reply, err = call[PlayerReply](client, "MusicManager.Next", "")
 	case "list":
-		err = client.Call("MusicManager.List", "", &reply)
+		reply, err = call[LibraryReply](client, "MusicManager.List", "")
 	case "playlist":
-		err = client.Call("MusicManager.Playlist", "", &reply)
+		reply, err = call[PlaylistReply](client, "MusicManager.Playlist", "")
 	case "prev":
-		err = client.Call("MusicManager.Previous", "", &reply)
+		reply, err = call[PlayerReply](client, "MusicManager.Previous", "")
 	case "clean":
-		err = client.Call("MusicManager.Clean", "", &reply)
+		reply, err = call[CleanReply](client, "MusicManager.Clean", "")
+	case "broken":
+		reply, err = call[BrokenReply](client, "MusicManager.Broken", "")
 	case "vol":
 		value := args[0].(float64)
-		err = client.Call("MusicManager.Volume", value, &reply)
+		reply, err = call[PlayerReply](client, "MusicManager.Volume", value)
 	case "create":
 		name := args[0].(string)
-		err = client.Call("MusicManager.Create", name, &reply)
+		reply, err = call[PlaylistChange](client, "MusicManager.Create", name)
 	case "delete":
 		name := args[0].(string)
-		err = client.Call("MusicManager.Delete", name, &reply)
+		reply, err = call[PlaylistChange](client, "MusicManager.Delete", name)
 	case "playlists":
-		err = client.Call("MusicManager.Playlists", "", &reply)
-	case "remove":
-		ids := []int{}
-		for _, arg := range args {
-			id, err := strconv.Atoi(arg.(string))
-			if err != nil {
-				fmt.Printf("Error Converting: %v ", err)
-				continue
-			}
-			ids = append(ids, id)
+		reply, err = call[PlaylistsReply](client, "MusicManager.Playlists", "")
+	case "add", "remove":
+		method := "MusicManager.Add"
+		if cmd == "remove" {
+			method = "MusicManager.Remove"
 		}
-		if len(ids) > 0 {
-			err = client.Call("MusicManager.Remove", ids, &reply)
-		} else {
-			reply = "Cannot remove to playlist args is empty"
+		var ids []int
+		ids, err = parse_ids(args)
+		if err == nil {
+			reply, err = call[SongsChange](client, method, ids)
 		}
-	case "add":
-		ids := []int{}
-		for _, arg := range args {
-			id, err := strconv.Atoi(arg.(string))
-			if err != nil {
-				fmt.Printf("Error Converting: %v ", err)
-				continue
+	case "logs":
+		return print_logs(w, client, config, args[0].(LogsArgs))
+	case "kill":
+		var reply string
+		if err := client.Call("Daemon.Kill", "", &reply); err != nil {
+			return err
+		}
+		// the pid file goes last, a new daemon can start after it
+		if !config.remote {
+			pid_filepath := filepath.Join(config.RuntimeDir, "apollo.pid")
+			for deadline := time.Now().Add(5 * time.Second); time.Now().Before(deadline); {
+				if _, err := os.Stat(pid_filepath); err != nil {
+					break
+				}
+				time.Sleep(20 * time.Millisecond)
 			}
-			ids = append(ids, id)
 		}
-		if len(ids) > 0 {
-			err = client.Call("MusicManager.Add", ids, &reply)
-		} else {
-			reply = "Cannot add to playlist args is empty"
+		if !config.quiet {
+			fmt.Fprintf(w, "Apollo Daemon killed\n")
 		}
-	case "kill":
-		err = client.Call("Daemon.Kill", "", &reply)
-		fmt.Printf("Apollo Daemon killed\n")
-		return
+		return nil
 	default:
-		fmt.Printf("No Handles implemented for command: %s\n", cmd)
-		return
+		return new_rpc_error(code_internal, "no handles implemented for command: %s", cmd)
 	}
-
 	if err != nil {
-		fmt.Printf("Apollo Error: %v\n", err)
-		return
+		return err
 	}
-	fmt.Printf("Apollo: %s\n", reply)
+	print_reply(w, config, cmd, reply)
+	return nil
 }
 
-func handle_offline(cmd string, args []any,  config Config) {
-	db, err := get_db()
+func handle_offline(w io.Writer, cmd string, args []any,  config Config) error {
+	db, err := get_db(config.DataDir, config.quiet)
 	if err != nil {
-		fmt.Printf("Unable to get the database: %v\n", err)
-		return
+		return new_rpc_error(code_internal, "Unable to get the database: %v", err)
 	}
 	defer db.Close()
-	var reply string
+	var reply any
 	switch cmd {
 	case "sync":
 		// check and set args
@@ -124,25 +158,258 @@ func handle_offline(cmd string, args []any,  config Config) {
 			arg = args[0].(string)
 		}
 		reply, err = sync_musics(db, arg, config.MusicDir)
+		if err != nil {
+			err = new_rpc_error(code_invalid, "%v", err)
+		}
 	case "list":
-		reply = list_musics(db)
+		reply = LibraryReply{ Songs: to_songs(get_all_songs(db)) }
 	case "clean":
 		changes := clean_musics(db)
-		reply = fmt.Sprintf("Cleaned %d item(s) in the database", changes)
+		reply = CleanReply{ Removed: int(changes) }
+	case "broken":
+		var songs []BrokenSong
+		songs, err = list_broken(db)
+		reply = BrokenReply{ Songs: songs }
 	case "create":
 		name := args[0].(string)
-		reply, err = create_playlist(db, name)
+		var created bool
+		created, err = create_playlist(db, name)
+		reply = PlaylistChange{ Name: name, Changed: created }
 	case "delete":
 		name := args[0].(string)
-		reply, err = delete_playlist(db, name)
+		var deleted bool
+		deleted, err = delete_playlist(db, name)
+		reply = PlaylistChange{ Name: name, Changed: deleted }
 	case "playlists":
-		reply, err = list_playlist(db)
+		var playlists []PlaylistSummary
+		playlists, err = list_playlist(db)
+		reply = PlaylistsReply{ Playlists: playlists }
+	case "kill":
+		// a daemon that lost its socket still holds the pid file
+		pid_filepath := filepath.Join(config.RuntimeDir, "apollo.pid")
+		pid := running_pid(pid_filepath)
+		if pid == 0 {
+			check_pid_file(pid_filepath)
+			return new_rpc_error(code_not_running, "Daemon is not active...")
+		}
+		if err := syscall.Kill(pid, syscall.SIGTERM); err != nil {
+			return new_rpc_error(code_internal, "cannot stop the daemon with pid %d: %v", pid, err)
+		}
+		if !config.quiet {
+			fmt.Fprintf(w, "Apollo: Sent SIGTERM to the unreachable daemon with pid %d\n", pid)
+		}
+		return nil
 	default:
-		reply = "Daemon is not active..."
+		err = new_rpc_error(code_not_running, "Daemon is not active...")
 	}
 	if err != nil {
-		fmt.Printf("Error: %v\n", err)
+		return err
+	}
+	print_reply(w, &config, cmd, reply)
+	return nil
+}
+
+func call[T any](client *rpc.Client, method string, args any) (any, error) {
+	var reply T
+	err := client.Call(method, args, &reply)
+	return reply, err
+}
+
+func parse_ids(args []any) ([]int, error) {
+	ids := []int{}
+	for _, arg := range args {
+		id, err := strconv.Atoi(arg.(string))
+		if err != nil {
+			return nil, new_rpc_error(code_invalid, "'%s' is not a song id", arg)
+		}
+		ids = append(ids, id)
+	}
+	if len(ids) == 0 {
+		return nil, new_rpc_error(code_invalid, "no song ids given")
+	}
+	return ids, nil
+}
+
+// prints the reply for humans, or as it is with --json. Nothing is printed
+// with --quiet.
+func print_reply(w io.Writer, config *Config, cmd string, reply any) {
+	if config.quiet {
 		return
 	}
-	fmt.Printf("Apollo: %s\n", reply)
+	if config.json_output {
+		encoder := json.NewEncoder(w)
+		encoder.SetIndent("", "  ")
+		encoder.Encode(reply)
+		return
+	}
+	fmt.Fprintf(w, "Apollo: %s\n", format_reply(cmd, reply))
+}
+
+// prints the error of a command, for the cli to stderr.
+func print_error(w io.Writer, config *Config, err error) {
+	if config.json_output {
+		encoder := json.NewEncoder(w)
+		encoder.SetIndent("", "  ")
+		encoder.Encode(map[string]any{ "error": as_rpc_error(err) })
+		return
+	}
+	fmt.Fprintf(w, "Apollo Error: %s\n", as_rpc_error(err).Message)
+}
+
+// the exit status of the cli after the error, scripts tell the failures
+// apart by it.
+func exit_status(err error) int {
+	if err == nil {
+		return exit_ok
+	}
+	switch as_rpc_error(err).Code {
+	case code_invalid:
+		return exit_invalid
+	case code_not_found, code_empty:
+		return exit_not_found
+	case code_not_running:
+		return exit_not_running
+	case code_rpc, code_unauthorized:
+		return exit_rpc
+	}
+	return exit_failure
+}
+
+func format_reply(cmd string, reply any) string {
+	switch r := reply.(type) {
+	case PlayerReply:
+		return format_player(cmd, r)
+	case Status:
+		return format_status(r)
+	case PlaylistReply:
+		msg := fmt.Sprintf("Playlist: [%d] %s", r.Id, r.Name)
+		if len(r.Songs) == 0 {
+			return msg + "\nNo songs"
+		}
+		for i, song := range r.Songs {
+			msg += fmt.Sprintf("\n%d. %s", i+1, song.Title)
+			if i == r.Current {
+				msg += " <- [Selected]"
+			}
+		}
+		return msg
+	case PlaylistsReply:
+		if len(r.Playlists) == 0 {
+			return "No playlists found"
+		}
+		msg := ""
+		for _, playlist := range r.Playlists {
+			msg += fmt.Sprintf("\n[%d] %s with %d song(s)", playlist.Id, playlist.Name, playlist.Count)
+		}
+		return msg
+	case LibraryReply:
+		if len(r.Songs) == 0 {
+			return "No songs found in database"
+		}
+		msg := "Listing Database Records"
+		for _, song := range r.Songs {
+			msg += fmt.Sprintf("\n%d: %s -> %s", song.Id, song.Title, song.Path)
+		}
+		return msg
+	case SyncReply:
+		if r.Default {
+			return fmt.Sprintf("Syncing database to default directory\nAdded %d song(s)", r.Added)
+		}
+		return fmt.Sprintf("Syncing database to '%s'\nAdded %d song(s)", r.Dir, r.Added)
+	case CleanReply:
+		return fmt.Sprintf("Cleaned %d item(s) in the database", r.Removed)
+	case BrokenReply:
+		if len(r.Songs) == 0 {
+			return "No broken songs"
+		}
+		msg := "Songs that failed to play"
+		for _, song := range r.Songs {
+			msg += fmt.Sprintf("\n%d: %s -> %s (%s)", song.Id, song.Title, song.Path, song.Error)
+		}
+		return msg
+	case PlaylistChange:
+		if cmd == "delete" {
+			if !r.Changed {
+				return fmt.Sprintf("No playlist with '%s' in database!", r.Name)
+			}
+			return fmt.Sprintf("Successfully deleted playlist '%s'!", r.Name)
+		}
+		if !r.Changed {
+			return fmt.Sprintf("Playlist: '%s' already exists", r.Name)
+		}
+		return fmt.Sprintf("Successfully created playlist '%s'!", r.Name)
+	case SongsChange:
+		if cmd == "remove" {
+			if len(r.Ids) == 0 {
+				return "Songs provided are not in the playlist"
+			}
+			return fmt.Sprintf("Deleted %d song(s) from '%s' playlist", len(r.Ids), r.Playlist)
+		}
+		if len(r.Ids) == 0 {
+			return "Songs provided are already in the playlist"
+		}
+		return fmt.Sprintf("Added %d song(s) to '%s' playlist", len(r.Ids), r.Playlist)
+	}
+	return fmt.Sprintf("%v", reply)
+}
+
+func format_player(cmd string, r PlayerReply) string {
+	status := r.Status
+	msg := ""
+	if r.Switched {
+		msg = fmt.Sprintf("Switching playlist to '%s'\n", status.Playlist)
+	}
+	title := ""
+	if status.Song != nil {
+		title = status.Song.Title
+	}
+	switch r.Action {
+	case action_started:
+		return msg + "Playing Song: " + title
+	case action_resumed:
+		if cmd == "toggle" {
+			return "Song Toggled!"
+		}
+		return msg + fmt.Sprintf("Unpausing '%s'", status.Playlist)
+	case action_paused:
+		return "Song Toggled!"
+	case action_already_playing:
+		return msg + "Already Playing song...."
+	case action_stopped:
+		return fmt.Sprintf("Stopping at index: %d", status.Index)
+	case action_seeked:
+		return fmt.Sprintf("Seeked to %.0fs", status.Position)
+	case action_not_playing:
+		if cmd == "stop" {
+			return "Apollo is not playing anything..."
+		}
+		return "No Song Playing..."
+	case action_skipped:
+		if cmd == "prev" {
+			return "Going previous: " + title
+		}
+		return "Going next: " + title
+	case action_selected:
+		if cmd == "prev" {
+			return fmt.Sprintf("Previous with index: %d", status.Index)
+		}
+		return fmt.Sprintf("Next with index: %d", status.Index)
+	case action_volume:
+		return fmt.Sprintf("Volume changed by %g, now %g", r.Change, status.Volume)
+	}
+	return r.Action
+}
+
+func format_status(status Status) string {
+	state := "Stopped"
+	if status.Playing && status.Paused {
+		state = "Paused"
+	} else if status.Playing {
+		state = "Playing"
+	}
+	if status.Song == nil {
+		return fmt.Sprintf("%s: '%s' has no songs", state, status.Playlist)
+	}
+	return fmt.Sprintf("%s: %s [%d/%d] in '%s', volume %g",
+		state, status.Song.Title, status.Index+1, status.Length, status.Playlist, status.Volume)
 }
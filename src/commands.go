@@ -0,0 +1,288 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"strings"
+)
+
+// the commands of the cli, parse_command checks the arguments against it and
+// `apollo help` and the man page are made from it.
+
+type command struct {
+	name string
+	args string
+	summary string
+	// shown by `apollo help CMD` and in the man page
+	description string
+	examples []string
+	// how many arguments the command takes, max_args is -1 for any number
+	min_args int
+	max_args int
+	// left out of the help, for the scripts of the cli
+	hidden bool
+}
+
+var commands = []command{
+	{
+		name: "start", args: "[--foreground] [--resume] [FILEPATH | DIRPATH | TITLE...]",
+		summary: "start the daemon",
+		description: "Starts the daemon in the background. Without arguments it plays the songs of the database, given files, directories or titles it plays them as the \"Unlisted\" playlist. `apollo FILEPATH` is the same as `apollo start FILEPATH`. With --foreground the daemon does not detach and logs to stderr, for systemd and other supervisors. With --resume, or the resume config value, a start without songs restores the playlist, song, position and volume of the last session.",
+		examples: []string{ "apollo start", "apollo ~/Music/album", "apollo \"Lofi Girl - Snowman\"", "apollo start --foreground", "apollo start --resume" },
+		max_args: -1,
+	},
+	{
+		name: "play", args: "[PLAYLIST]",
+		summary: "play the current song or switch to a playlist",
+		description: "Plays the current song of the current playlist, or switches to the given playlist and plays it from the start.",
+		examples: []string{ "apollo play", "apollo play \"road trip\"" },
+		max_args: 1,
+	},
+	{
+		name: "toggle",
+		summary: "pause or resume the current song",
+	},
+	{
+		name: "stop",
+		summary: "stop the current song",
+	},
+	{
+		name: "next",
+		summary: "play the next song of the playlist",
+	},
+	{
+		name: "prev",
+		summary: "play the previous song of the playlist",
+	},
+	{
+		name: "vol", args: "VALUE",
+		summary: "raise or lower the volume",
+		description: "Changes the volume by VALUE steps from where it is, every step of 1 doubles or halves it. The daemon starts at the volume of the files.",
+		examples: []string{ "apollo vol 1", "apollo vol -0.5" },
+		min_args: 1, max_args: 1,
+	},
+	{
+		name: "status",
+		summary: "show the playing song and the playlist",
+	},
+	{
+		name: "list",
+		summary: "list the songs of the database",
+	},
+	{
+		name: "playlist",
+		summary: "list the songs of the current playlist",
+	},
+	{
+		name: "playlists",
+		summary: "list the playlists and their song count",
+	},
+	{
+		name: "create", args: "PLAYLIST",
+		summary: "create a playlist",
+		examples: []string{ "apollo create \"road trip\"" },
+		min_args: 1, max_args: 1,
+	},
+	{
+		name: "delete", args: "PLAYLIST",
+		summary: "delete a playlist",
+		min_args: 1, max_args: 1,
+	},
+	{
+		name: "add", args: "SONG_ID...",
+		summary: "add songs to the current playlist",
+		description: "Adds the songs with the given ids, as shown by `apollo list`, to the current playlist. The database playlist cannot be changed.",
+		examples: []string{ "apollo add 1 4 7" },
+		min_args: 1, max_args: -1,
+	},
+	{
+		name: "remove", args: "SONG_ID...",
+		summary: "remove songs from the current playlist",
+		examples: []string{ "apollo remove 4" },
+		min_args: 1, max_args: -1,
+	},
+	{
+		name: "sync", args: "[DIRPATH]",
+		summary: "add the songs of a directory to the database",
+		description: "Scans the directory, or music_dir without one, and adds the songs that are not in the database yet.",
+		examples: []string{ "apollo sync", "apollo sync ~/Downloads/album" },
+		max_args: 1,
+	},
+	{
+		name: "clean",
+		summary: "remove the songs whose file is gone from the database",
+	},
+	{
+		name: "broken",
+		summary: "list the songs that failed to play",
+		description: "Lists the songs flagged in the database because they could not be opened or decoded, with the error. The daemon skips them while playing, a song is no longer flagged once it plays again and `apollo clean` removes the ones whose file is gone. Nothing is flagged with mark_broken turned off.",
+	},
+	{
+		name: "config", args: "list [--effective]",
+		summary: "show the config",
+		description: "Lists the values of the config file, with --effective the values in use after the environment and the flags, and where each one comes from.",
+		examples: []string{ "apollo config list", "apollo --loop=false config list --effective" },
+		min_args: 1, max_args: 2,
+	},
+	{
+		name: "kill",
+		summary: "stop the daemon",
+	},
+	{
+		name: "logs", args: "[-f] [--level LEVEL]",
+		summary: "show the log of the daemon",
+		description: "Prints the last records the daemon logged, at log_level or above. With -f it keeps printing them as they are logged until the daemon stops, with --level only the records at LEVEL or above: debug, info, warn or error. The full log is apollo.log in the state dir, or stderr with --foreground.",
+		examples: []string{ "apollo logs", "apollo logs -f --level warn", "apollo --json logs" },
+		max_args: 3,
+	},
+	{
+		name: "tui",
+		summary: "control the daemon from a full-screen interface",
+		description: "Shows the current song, the playlist, the library and the playlists of a running daemon. Press ? for the keys.",
+	},
+	{
+		name: "shell",
+		summary: "run commands in an interactive shell",
+		description: "Runs the commands on a single connection to the daemon, with completion, history and the changes of the player printed as they happen. Songs can be given by title to add and remove.",
+	},
+	{
+		name: "service", args: "install",
+		summary: "install the systemd user units of the daemon",
+		description: "Writes apollo.service, running `apollo start --foreground`, and apollo.socket, starting it on the first command, to $XDG_CONFIG_HOME/systemd/user.",
+		examples: []string{ "apollo service install && systemctl --user enable --now apollo.socket" },
+		min_args: 1, max_args: 1,
+	},
+	{
+		name: "completion", args: "bash | zsh | fish",
+		summary: "print the completion script of a shell",
+		description: "Prints a script completing the commands, playlist names, song ids and titles and directories in the shell. Load it from the config of the shell.",
+		examples: []string{
+			"source <(apollo completion bash)  # in ~/.bashrc",
+			"source <(apollo completion zsh)  # in ~/.zshrc",
+			"apollo completion fish > ~/.config/fish/completions/apollo.fish",
+		},
+		min_args: 1, max_args: 1,
+	},
+	{
+		name: "__complete", args: "[WORD...] CURRENT",
+		summary: "print the completions of CURRENT after the words",
+		max_args: -1, hidden: true,
+	},
+	{
+		name: "help", args: "[COMMAND | --man]",
+		summary: "show the help of apollo or of a command",
+		description: "Without arguments lists the commands, given a command shows its usage. --man prints the man page. `apollo COMMAND --help` is the same as `apollo help COMMAND`.",
+		examples: []string{ "apollo help vol", "apollo help --man > apollo.1" },
+		max_args: 1,
+	},
+}
+
+const main_usage = "apollo [FLAGS] [COMMAND | FILEPATH | DIRPATH | TITLE]"
+
+func find_command(name string) *command {
+	for i := range commands {
+		if commands[i].name == name {
+			return &commands[i]
+		}
+	}
+	return nil
+}
+
+func (c *command) usage() string {
+	if c.args == "" {
+		return "apollo " + c.name
+	}
+	return "apollo " + c.name + " " + c.args
+}
+
+// the usage error of a wrong number of arguments, nil when it is right.
+func (c *command) check_args(args []string) error {
+	if len(args) < c.min_args {
+		return new_usage_error(c.usage(), "missing argument to %s", c.name)
+	}
+	if c.max_args >= 0 && len(args) > c.max_args {
+		return new_usage_error(c.usage(), "too many arguments to %s", c.name)
+	}
+	return nil
+}
+
+// the commands named and their summary, aligned in a column.
+func print_commands(w io.Writer, names []string) {
+	for _, name := range names {
+		if c := find_command(name); c != nil {
+			fmt.Fprintf(w, "  %-*s %s\n", help_width, strings.TrimPrefix(c.usage(), "apollo "), c.summary)
+		}
+	}
+}
+
+// wide enough for the longest usage
+const help_width = 36
+
+func print_help(w io.Writer) {
+	fmt.Fprintf(w, "USAGE: %s\n\nCOMMANDS:\n", main_usage)
+	names := []string{}
+	for _, c := range commands {
+		if !c.hidden {
+			names = append(names, c.name)
+		}
+	}
+	print_commands(w, names)
+	fmt.Fprintf(w, "\nRun `apollo help COMMAND` for the usage of a command and `apollo --help` for the flags.\n")
+}
+
+func print_command_help(w io.Writer, c *command) {
+	fmt.Fprintf(w, "USAGE: %s\n\n%s.\n", c.usage(), upper_first(c.summary))
+	if c.description != "" {
+		fmt.Fprintf(w, "\n%s\n", c.description)
+	}
+	if len(c.examples) > 0 {
+		fmt.Fprintf(w, "\nEXAMPLES:\n")
+		for _, example := range c.examples {
+			fmt.Fprintf(w, "  %s\n", example)
+		}
+	}
+}
+
+func upper_first(s string) string {
+	if s == "" {
+		return s
+	}
+	return strings.ToUpper(s[:1]) + s[1:]
+}
+
+// the man page in roff, for `man -l` or to install as apollo.1.
+func print_man(w io.Writer) {
+	fmt.Fprintf(w, ".TH APOLLO 1\n")
+	fmt.Fprintf(w, ".SH NAME\napollo \\- music player that goes in the background and can be controlled remotely\n")
+	fmt.Fprintf(w, ".SH SYNOPSIS\n.B apollo\n[\\fIFLAGS\\fR] [\\fICOMMAND\\fR | \\fIFILEPATH\\fR | \\fIDIRPATH\\fR | \\fITITLE\\fR]\n")
+	fmt.Fprintf(w, ".SH DESCRIPTION\n%s\n", roff_escape("Apollo plays music in a daemon that the other commands control, over a unix socket by default or over tcp with --host. The config file lives in $XDG_CONFIG_HOME/apollo/config.json."))
+	fmt.Fprintf(w, ".SH COMMANDS\n")
+	for _, c := range commands {
+		if c.hidden {
+			continue
+		}
+		fmt.Fprintf(w, ".TP\n.B %s\n%s.\n", roff_escape(strings.TrimPrefix(c.usage(), "apollo ")), roff_escape(upper_first(c.summary)))
+		if c.description != "" {
+			fmt.Fprintf(w, "%s\n", roff_escape(c.description))
+		}
+	}
+	fmt.Fprintf(w, ".SH OPTIONS\n")
+	new_flag_set(&Options{ values: map[string]string{} }).VisitAll(func(f *flag.Flag) {
+		fmt.Fprintf(w, ".TP\n.B %s\n%s\n", roff_escape("--" + f.Name), roff_escape(f.Usage))
+	})
+	fmt.Fprintf(w, ".SH EXAMPLES\n")
+	for _, c := range commands {
+		for _, example := range c.examples {
+			fmt.Fprintf(w, ".nf\n%s\n.fi\n", roff_escape(example))
+		}
+	}
+}
+
+func roff_escape(s string) string {
+	s = strings.NewReplacer(`\`, `\e`, "-", `\-`).Replace(s)
+	if strings.HasPrefix(s, ".") || strings.HasPrefix(s, "'") {
+		s = `\&` + s
+	}
+	return s
+}
@@ -0,0 +1,74 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"strings"
+	"testing"
+)
+
+func TestParseCommand(t *testing.T) {
+	_, config := setup_test_env(t)
+	tests := []struct {
+		argv []string
+		cmd string
+		args int
+		// the message of the usage error, empty when the command is valid
+		err string
+	}{
+		{ argv: []string{ "status" }, cmd: "status" },
+		{ argv: []string{ "status", "now" }, cmd: "status", err: "too many arguments to status" },
+		{ argv: []string{ "vol" }, cmd: "vol", err: "missing argument to vol" },
+		{ argv: []string{ "vol", "-1" }, cmd: "vol", args: 1 },
+		{ argv: []string{ "vol", "loud" }, cmd: "vol", err: "invalid volume value 'loud'" },
+		{ argv: []string{ "create", "road", "trip" }, cmd: "create", err: "too many arguments to create" },
+		{ argv: []string{ "add", "1", "2" }, cmd: "add", args: 2 },
+		{ argv: []string{ "config", "list", "--effective" }, cmd: "config", args: 2 },
+		{ argv: []string{ "config", "set" }, cmd: "config", err: "invalid argument to config" },
+		{ argv: []string{ "vol", "--help" }, cmd: "help", args: 1 },
+		{ argv: []string{ "help", "vol" }, cmd: "help", args: 1 },
+		{ argv: []string{ "help", "volume" }, cmd: "help", err: "unknown command 'volume'" },
+		{ argv: []string{ "start" }, cmd: "start" },
+		{ argv: []string{ "plya" }, cmd: "start", err: "plya is not a valid song argument or command" },
+		{ argv: []string{ "logs", "-f", "--level", "warn" }, cmd: "logs", args: 1 },
+		{ argv: []string{ "logs", "--level", "loud" }, cmd: "logs", err: "invalid log level 'loud'" },
+	}
+	for _, test := range tests {
+		cmd, args, err := parse_command(test.argv, config)
+		var usage *usage_error
+		switch {
+		case test.err == "" && err != nil:
+			t.Errorf("apollo %s: %v", strings.Join(test.argv, " "), err)
+		case test.err != "" && (!errors.As(err, &usage) || usage.message != test.err):
+			t.Errorf("apollo %s: error %v, want %q", strings.Join(test.argv, " "), err, test.err)
+		case cmd != test.cmd || (err == nil && len(args) != test.args):
+			t.Errorf("apollo %s = %s %v, want %s with %d args", strings.Join(test.argv, " "), cmd, args, test.cmd, test.args)
+		}
+	}
+}
+
+func TestHelp(t *testing.T) {
+	var out bytes.Buffer
+	handle_help(&out, nil)
+	for _, c := range commands {
+		if strings.Contains(out.String(), c.summary) == c.hidden {
+			t.Errorf("apollo help: %s listed %v, hidden %v", c.name, !c.hidden, c.hidden)
+		}
+	}
+	out.Reset()
+	handle_help(&out, []any{ "vol" })
+	if help := out.String(); !strings.HasPrefix(help, "USAGE: apollo vol VALUE\n") || !strings.Contains(help, "by VALUE steps") || !strings.Contains(help, "apollo vol -0.5") {
+		t.Errorf("apollo help vol:\n%s", help)
+	}
+	out.Reset()
+	handle_help(&out, []any{ "--man" })
+	man := out.String()
+	if !strings.HasPrefix(man, ".TH APOLLO 1\n") || !strings.Contains(man, `.B \-\-music\-dir`) {
+		t.Errorf("man page:\n%s", man)
+	}
+	for _, line := range strings.Split(man, "\n") {
+		if strings.HasPrefix(line, "'") {
+			t.Errorf("man page line starts with a quote: %q", line)
+		}
+	}
+}
@@ -0,0 +1,214 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// `apollo completion SHELL` prints a script that asks `apollo __complete` for
+// the completions, so the commands, playlists, songs and directories are
+// completed the same in every shell.
+
+const bash_completion = `# bash completion for apollo, generated by ` + "`apollo completion bash`" + `
+_apollo() {
+	local cur=${COMP_WORDS[COMP_CWORD]} candidate IFS=$'\n'
+	local candidates=($(apollo __complete "${COMP_WORDS[@]:1:COMP_CWORD-1}" "$cur" 2>/dev/null))
+	COMPREPLY=()
+	for candidate in "${candidates[@]}"; do
+		COMPREPLY+=("$(printf '%q' "${candidate%%$'\t'*}")")
+	done
+	# directories are completed further
+	if [[ ${#COMPREPLY[@]} -eq 1 && ${COMPREPLY[0]} == */ ]]; then
+		compopt -o nospace
+	fi
+}
+complete -F _apollo apollo
+`
+
+const zsh_completion = `#compdef apollo
+# zsh completion for apollo, generated by ` + "`apollo completion zsh`" + `
+_apollo() {
+	local -a lines candidates descriptions suffix
+	local line
+	lines=("${(@f)$(apollo __complete "${(@)words[2,CURRENT-1]}" "${words[CURRENT]}" 2>/dev/null)}")
+	for line in $lines; do
+		[[ -z $line ]] && continue
+		candidates+=("${line%%$'\t'*}")
+		if [[ $line == *$'\t'* ]]; then
+			descriptions+=("${line%%$'\t'*}  -- ${line#*$'\t'}")
+		else
+			descriptions+=("$line")
+		fi
+	done
+	# directories are completed further
+	if [[ ${#candidates} -eq 1 && ${candidates[1]} == */ ]]; then
+		suffix=(-S '')
+	fi
+	compadd -U -l -d descriptions $suffix -- $candidates
+}
+compdef _apollo apollo
+`
+
+const fish_completion = `# fish completion for apollo, generated by ` + "`apollo completion fish`" + `
+function __apollo_complete
+	set -l words (commandline -opc)
+	set -e words[1]
+	apollo __complete $words (commandline -ct) 2>/dev/null
+end
+complete -c apollo -f -a '(__apollo_complete)'
+`
+
+var completion_scripts = map[string]string{
+	"bash": bash_completion,
+	"zsh": zsh_completion,
+	"fish": fish_completion,
+}
+
+// prints the completions of the last word of `apollo words...`, one per line
+// and followed by a tab and a description when there is one.
+func handle_complete(w io.Writer, words []string) {
+	if len(words) == 0 {
+		words = []string{ "" }
+	}
+	current := unquote_word(words[len(words)-1])
+	words = words[:len(words)-1]
+	for i, word := range words {
+		words[i] = unquote_word(word)
+	}
+	opts := Options{ values: map[string]string{} }
+	flags := new_flag_set(&opts)
+	flags.Init("apollo", flag.ContinueOnError)
+	flags.Usage = func() {}
+	if err := flags.Parse(words); err != nil {
+		return
+	}
+	words = flags.Args()
+	if len(words) == 0 {
+		if strings.HasPrefix(current, "-") {
+			flags.VisitAll(func(f *flag.Flag) {
+				print_candidate(w, current, "--" + f.Name, f.Usage)
+			})
+			return
+		}
+		for _, c := range commands {
+			if !c.hidden {
+				print_candidate(w, current, c.name, c.summary)
+			}
+		}
+		return
+	}
+	c := find_command(words[0])
+	if c == nil || c.hidden || (c.max_args >= 0 && len(words) > c.max_args) {
+		return
+	}
+	// the position of the completed word among the arguments of the command
+	position := len(words)
+	var config *Config
+	if slices.Contains([]string{ "play", "delete", "add", "remove" }, c.name) {
+		config = get_config(opts)
+	}
+	switch c.name {
+	case "play", "delete":
+		db, err := open_db_readonly(config.DataDir)
+		if err != nil {
+			return
+		}
+		defer db.Close()
+		playlists, _ := list_playlist(db)
+		for _, playlist := range playlists {
+			print_candidate(w, current, playlist.Name, fmt.Sprintf("%d songs", playlist.Count))
+		}
+	case "add", "remove":
+		for _, song := range complete_songs(config, c.name) {
+			id := strconv.Itoa(song.Id)
+			if slices.Contains(words[1:], id) {
+				continue
+			}
+			// a title is completed to the id of its song
+			if strings.HasPrefix(strings.ToLower(song.Title), strings.ToLower(current)) {
+				fmt.Fprintf(w, "%s\t%s\n", id, song.Title)
+			} else {
+				print_candidate(w, current, id, song.Title)
+			}
+		}
+	case "sync":
+		for _, dir := range complete_dirs(current) {
+			fmt.Fprintf(w, "%s\n", dir)
+		}
+	case "help":
+		for _, c := range commands {
+			if !c.hidden {
+				print_candidate(w, current, c.name, c.summary)
+			}
+		}
+	case "start":
+		if strings.HasPrefix(current, "-") {
+			print_candidate(w, current, "--foreground", "do not detach, log to stderr")
+			print_candidate(w, current, "--resume", "start where the last session left off")
+		}
+	case "logs":
+		if position > 1 && words[position - 1] == "--level" {
+			for _, level := range []string{ "debug", "info", "warn", "error" } {
+				print_candidate(w, current, level, "")
+			}
+			return
+		}
+		print_candidate(w, current, "--follow", "keep printing the records")
+		print_candidate(w, current, "--level", "only the records at a level or above")
+	case "service":
+		print_candidate(w, current, "install", "")
+	case "completion":
+		for _, shell := range []string{ "bash", "fish", "zsh" } {
+			print_candidate(w, current, shell, "")
+		}
+	case "config":
+		candidates := []string{ "list", "--effective" }
+		print_candidate(w, current, candidates[position - 1], "")
+	}
+}
+
+// the songs of the current playlist of the daemon to remove, or of the
+// database.
+func complete_songs(config *Config, cmd string) []Song {
+	if cmd == "remove" {
+		if client, err := dial_rpc(config); err == nil {
+			defer client.Close()
+			var reply PlaylistReply
+			if client.Call("MusicManager.Playlist", "", &reply) == nil {
+				return reply.Songs
+			}
+		}
+	}
+	db, err := open_db_readonly(config.DataDir)
+	if err != nil {
+		return nil
+	}
+	defer db.Close()
+	return to_songs(get_all_songs(db))
+}
+
+func print_candidate(w io.Writer, current string, candidate string, description string) {
+	if !strings.HasPrefix(candidate, current) {
+		return
+	}
+	if description == "" {
+		fmt.Fprintf(w, "%s\n", candidate)
+		return
+	}
+	fmt.Fprintf(w, "%s\t%s\n", candidate, description)
+}
+
+// a word as typed in the shell, quoted or escaped and maybe without its
+// closing quote.
+func unquote_word(word string) string {
+	for _, closing := range []string{ "", `"`, "'" } {
+		if words, err := split_words(word + closing); err == nil && len(words) == 1 {
+			return words[0]
+		}
+	}
+	return word
+}
@@ -0,0 +1,58 @@
+package main
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestComplete(t *testing.T) {
+	music_dir, config := setup_test_env(t)
+	run_cmd(config, "sync")
+	run_cmd(config, "create", "road trip")
+	run_cmd(config, "create", "rock")
+	os.Mkdir(filepath.Join(music_dir, "albums"), 0755)
+
+	complete := func(words ...string) string {
+		var out bytes.Buffer
+		handle_complete(&out, words)
+		return out.String()
+	}
+	tests := []struct {
+		words []string
+		want string
+	}{
+		{ []string{ "pl" }, "play\t" },
+		{ []string{ "--json", "del" }, "delete\tdelete a playlist\n" },
+		{ []string{ "--mus" }, "--music-dir\t" },
+		{ []string{ "play", "ro" }, "road trip\t0 songs\nrock\t0 songs\n" },
+		{ []string{ "delete", `"road t` }, "road trip\t0 songs\n" },
+		{ []string{ "play", "rock", "" }, "" },
+		{ []string{ "add", "thr" }, "3\tthree\n" },
+		{ []string{ "add", "1", "2", "" }, "3\tthree\n" },
+		{ []string{ "sync", music_dir + "/al" }, music_dir + "/albums/\n" },
+		{ []string{ "config", "list", "" }, "--effective\n" },
+		{ []string{ "completion", "z" }, "zsh\n" },
+		{ []string{ "logs", "--level", "w" }, "warn\n" },
+		{ []string{ "__complete", "" }, "" },
+	}
+	for _, test := range tests {
+		if got := complete(test.words...); !strings.HasPrefix(got, test.want) || (test.want == "" && got != "") {
+			t.Errorf("__complete %q = %q, want %q", test.words, got, test.want)
+		}
+	}
+	if got := complete(""); strings.Contains(got, "__complete") || !strings.Contains(got, "completion\t") {
+		t.Errorf("commands: %q", got)
+	}
+
+	// the completions only read the database, a missing one is not created
+	os.RemoveAll(config.DataDir)
+	if got := complete("play", ""); got != "" {
+		t.Errorf("playlists without a database: %q", got)
+	}
+	if _, err := os.Stat(config.DataDir); err == nil {
+		t.Errorf("the completions created %s", config.DataDir)
+	}
+}
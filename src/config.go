@@ -1,52 +1,623 @@
 package main
 
 import (
+	"bytes"
 	"fmt"
 	"os"
 	"encoding/json"
+	"flag"
+	"net"
+	"log/slog"
 	"path/filepath"
+	"strconv"
+	"strings"
 )
 
 type Config struct {
 	MusicDir string `json:"music_dir"`
 	Loop bool `json:"loop"`
-	RpcPort string `json:"rpc_port"`
+	// "unix" or "tcp", the address defaults to apollo.sock in the runtime dir
+	// or localhost:42069
+	RpcNetwork string `json:"rpc_network"`
+	RpcAddr string `json:"rpc_addr,omitempty"`
+	// require the token of the config dir on tcp connections
+	RpcAuth bool `json:"rpc_auth"`
+	// left empty to follow the XDG base directories
+	DataDir string `json:"data_dir,omitempty"`
+	RuntimeDir string `json:"runtime_dir,omitempty"`
+	StateDir string `json:"state_dir,omitempty"`
+	// where the audio goes: speaker, null or wav, the last two consume
+	// the samples output_speed times faster than real time
+	Output string `json:"output"`
+	OutputSpeed float64 `json:"output_speed"`
+	OutputFile string `json:"output_file,omitempty"`
+	// host:port of the http api, disabled when empty
+	HttpAddr string `json:"http_addr,omitempty"`
+	// host:port of the mpd protocol listener, disabled when empty
+	MpdAddr string `json:"mpd_addr,omitempty"`
+	// register the player on the session bus for media keys and playerctl
+	Mpris bool `json:"mpris"`
+	// restore the saved session when the daemon starts without songs
+	Resume bool `json:"resume"`
+	// songs that fail to play are skipped, flagged in the database and the
+	// playlist stops after max_skips of them in a row, 0 for no limit
+	MarkBroken bool `json:"mark_broken"`
+	MaxSkips int `json:"max_skips"`
+	// the log of the daemon: debug, info, warn or error, text or json, and
+	// rotated past log_max_size MiB keeping log_max_files old logs
+	LogLevel string `json:"log_level"`
+	LogFormat string `json:"log_format"`
+	LogMaxSize float64 `json:"log_max_size"`
+	LogMaxFiles int `json:"log_max_files"`
 	// maybe add the default playlist?
+
+	// path of the config file, the values as they are in that file and
+	// where each effective value came from (default, file, env or flag).
+	path string
+	file *Config
+	sources map[string]string
+	// token presented to the daemon and if it is on another host
+	token string
+	remote bool
+	// print the replies as json
+	json_output bool
+	// print nothing but the errors
+	quiet bool
+	// run the daemon without detaching, `apollo start --foreground`
+	foreground bool
+}
+
+// a single overridable config value, resolved in the order:
+// flag > env > file > default
+type ConfigField struct {
+	key string
+	env string
+	flag string
+	usage string
+	boolean bool
+	number bool
+	get func(c *Config) string
+	set func(c *Config, value string) error
+}
+
+var config_fields = []ConfigField{
+	{
+		key: "music_dir",
+		env: "APOLLO_MUSIC_DIR",
+		flag: "music-dir",
+		usage: "default music directory used by sync",
+		get: func(c *Config) string { return c.MusicDir },
+		set: func(c *Config, value string) error {
+			c.MusicDir = value
+			return nil
+		},
+	},
+	{
+		key: "loop",
+		env: "APOLLO_LOOP",
+		flag: "loop",
+		usage: "loop the playlist after the last song",
+		boolean: true,
+		get: func(c *Config) string { return strconv.FormatBool(c.Loop) },
+		set: func(c *Config, value string) error {
+			loop, err := strconv.ParseBool(value)
+			if err != nil {
+				return fmt.Errorf("'%s' is not a boolean", value)
+			}
+			c.Loop = loop
+			return nil
+		},
+	},
+	{
+		key: "rpc_network",
+		env: "APOLLO_RPC_NETWORK",
+		flag: "rpc-network",
+		usage: "transport of the daemon control channel: unix or tcp",
+		get: func(c *Config) string { return c.RpcNetwork },
+		set: func(c *Config, value string) error {
+			if value != "unix" && value != "tcp" {
+				return fmt.Errorf("'%s' is not unix or tcp", value)
+			}
+			c.RpcNetwork = value
+			return nil
+		},
+	},
+	{
+		key: "rpc_addr",
+		env: "APOLLO_RPC_ADDR",
+		flag: "rpc-addr",
+		usage: "socket path or host:port the daemon listens on and the client dials",
+		get: func(c *Config) string { return c.RpcAddr },
+		set: func(c *Config, value string) error {
+			c.RpcAddr = value
+			return nil
+		},
+	},
+	{
+		key: "rpc_auth",
+		env: "APOLLO_RPC_AUTH",
+		flag: "rpc-auth",
+		usage: "require the rpc token on tcp connections, the http api and the mpd listener",
+		boolean: true,
+		get: func(c *Config) string { return strconv.FormatBool(c.RpcAuth) },
+		set: func(c *Config, value string) error {
+			auth, err := strconv.ParseBool(value)
+			if err != nil {
+				return fmt.Errorf("'%s' is not a boolean", value)
+			}
+			c.RpcAuth = auth
+			return nil
+		},
+	},
+	{
+		key: "data_dir",
+		env: "APOLLO_DATA_DIR",
+		flag: "data-dir",
+		usage: "directory of the database (default $XDG_DATA_HOME/apollo)",
+		get: func(c *Config) string { return c.DataDir },
+		set: func(c *Config, value string) error {
+			c.DataDir = value
+			return nil
+		},
+	},
+	{
+		key: "runtime_dir",
+		env: "APOLLO_RUNTIME_DIR",
+		flag: "runtime-dir",
+		usage: "directory of the pid file (default $XDG_RUNTIME_DIR/apollo)",
+		get: func(c *Config) string { return c.RuntimeDir },
+		set: func(c *Config, value string) error {
+			c.RuntimeDir = value
+			return nil
+		},
+	},
+	{
+		key: "state_dir",
+		env: "APOLLO_STATE_DIR",
+		flag: "state-dir",
+		usage: "directory of the log file and the session (default $XDG_STATE_HOME/apollo)",
+		get: func(c *Config) string { return c.StateDir },
+		set: func(c *Config, value string) error {
+			c.StateDir = value
+			return nil
+		},
+	},
+	{
+		key: "output",
+		env: "APOLLO_OUTPUT",
+		flag: "output",
+		usage: "audio output of the daemon: speaker, null or wav",
+		get: func(c *Config) string { return c.Output },
+		set: func(c *Config, value string) error {
+			if value != "speaker" && value != "null" && value != "wav" {
+				return fmt.Errorf("'%s' is not speaker, null or wav", value)
+			}
+			c.Output = value
+			return nil
+		},
+	},
+	{
+		key: "output_speed",
+		env: "APOLLO_OUTPUT_SPEED",
+		flag: "output-speed",
+		usage: "how many times faster than real time the null and wav outputs play",
+		number: true,
+		get: func(c *Config) string { return strconv.FormatFloat(c.OutputSpeed, 'g', -1, 64) },
+		set: func(c *Config, value string) error {
+			speed, err := strconv.ParseFloat(value, 64)
+			if err != nil || speed <= 0 {
+				return fmt.Errorf("'%s' is not a positive number", value)
+			}
+			c.OutputSpeed = speed
+			return nil
+		},
+	},
+	{
+		key: "output_file",
+		env: "APOLLO_OUTPUT_FILE",
+		flag: "output-file",
+		usage: "file written by the wav output (default $XDG_STATE_HOME/apollo/output.wav)",
+		get: func(c *Config) string { return c.OutputFile },
+		set: func(c *Config, value string) error {
+			c.OutputFile = value
+			return nil
+		},
+	},
+	{
+		key: "http_addr",
+		env: "APOLLO_HTTP_ADDR",
+		flag: "http-addr",
+		usage: "host:port the http api listens on, disabled when empty",
+		get: func(c *Config) string { return c.HttpAddr },
+		set: func(c *Config, value string) error {
+			c.HttpAddr = value
+			return nil
+		},
+	},
+	{
+		key: "mpd_addr",
+		env: "APOLLO_MPD_ADDR",
+		flag: "mpd-addr",
+		usage: "host:port the mpd protocol listener listens on, disabled when empty",
+		get: func(c *Config) string { return c.MpdAddr },
+		set: func(c *Config, value string) error {
+			c.MpdAddr = value
+			return nil
+		},
+	},
+	{
+		key: "mpris",
+		env: "APOLLO_MPRIS",
+		flag: "mpris",
+		usage: "register the player as org.mpris.MediaPlayer2.apollo on the session bus",
+		boolean: true,
+		get: func(c *Config) string { return strconv.FormatBool(c.Mpris) },
+		set: func(c *Config, value string) error {
+			mpris, err := strconv.ParseBool(value)
+			if err != nil {
+				return fmt.Errorf("'%s' is not a boolean", value)
+			}
+			c.Mpris = mpris
+			return nil
+		},
+	},
+	{
+		key: "resume",
+		env: "APOLLO_RESUME",
+		flag: "resume",
+		usage: "restore the saved session when the daemon starts without songs",
+		boolean: true,
+		get: func(c *Config) string { return strconv.FormatBool(c.Resume) },
+		set: func(c *Config, value string) error {
+			resume, err := strconv.ParseBool(value)
+			if err != nil {
+				return fmt.Errorf("'%s' is not a boolean", value)
+			}
+			c.Resume = resume
+			return nil
+		},
+	},
+	{
+		key: "mark_broken",
+		env: "APOLLO_MARK_BROKEN",
+		flag: "mark-broken",
+		usage: "flag the songs that fail to play in the database, listed by apollo broken",
+		boolean: true,
+		get: func(c *Config) string { return strconv.FormatBool(c.MarkBroken) },
+		set: func(c *Config, value string) error {
+			mark, err := strconv.ParseBool(value)
+			if err != nil {
+				return fmt.Errorf("'%s' is not a boolean", value)
+			}
+			c.MarkBroken = mark
+			return nil
+		},
+	},
+	{
+		key: "max_skips",
+		env: "APOLLO_MAX_SKIPS",
+		flag: "max-skips",
+		usage: "unplayable songs in a row the playlist stops after, 0 for no limit",
+		number: true,
+		get: func(c *Config) string { return strconv.Itoa(c.MaxSkips) },
+		set: func(c *Config, value string) error {
+			skips, err := strconv.Atoi(value)
+			if err != nil || skips < 0 {
+				return fmt.Errorf("'%s' is not a count of songs", value)
+			}
+			c.MaxSkips = skips
+			return nil
+		},
+	},
+	{
+		key: "log_level",
+		env: "APOLLO_LOG_LEVEL",
+		flag: "log-level",
+		usage: "least important records logged: debug, info, warn or error",
+		get: func(c *Config) string { return c.LogLevel },
+		set: func(c *Config, value string) error {
+			var level slog.Level
+			if err := level.UnmarshalText([]byte(value)); err != nil {
+				return fmt.Errorf("'%s' is not debug, info, warn or error", value)
+			}
+			c.LogLevel = strings.ToLower(value)
+			return nil
+		},
+	},
+	{
+		key: "log_format",
+		env: "APOLLO_LOG_FORMAT",
+		flag: "log-format",
+		usage: "format of the log records: text or json",
+		get: func(c *Config) string { return c.LogFormat },
+		set: func(c *Config, value string) error {
+			if value != "text" && value != "json" {
+				return fmt.Errorf("'%s' is not text or json", value)
+			}
+			c.LogFormat = value
+			return nil
+		},
+	},
+	{
+		key: "log_max_size",
+		env: "APOLLO_LOG_MAX_SIZE",
+		flag: "log-max-size",
+		usage: "MiB apollo.log grows to before it is rotated",
+		number: true,
+		get: func(c *Config) string { return strconv.FormatFloat(c.LogMaxSize, 'g', -1, 64) },
+		set: func(c *Config, value string) error {
+			size, err := strconv.ParseFloat(value, 64)
+			if err != nil || size <= 0 {
+				return fmt.Errorf("'%s' is not a positive number", value)
+			}
+			c.LogMaxSize = size
+			return nil
+		},
+	},
+	{
+		key: "log_max_files",
+		env: "APOLLO_LOG_MAX_FILES",
+		flag: "log-max-files",
+		usage: "rotated logs kept besides apollo.log",
+		number: true,
+		get: func(c *Config) string { return strconv.Itoa(c.LogMaxFiles) },
+		set: func(c *Config, value string) error {
+			files, err := strconv.Atoi(value)
+			if err != nil || files < 0 {
+				return fmt.Errorf("'%s' is not a count of files", value)
+			}
+			c.LogMaxFiles = files
+			return nil
+		},
+	},
+}
+
+// global flags given before the command: `apollo [FLAGS] [COMMAND]`
+type Options struct {
+	config_path string
+	// daemon on another host to control
+	host string
+	token string
+	json bool
+	quiet bool
+	// config key -> value given by flag
+	values map[string]string
+}
+
+func parse_flags(argv []string) (Options, []string) {
+	opts := Options{ values: map[string]string{} }
+	flags := new_flag_set(&opts)
+	flags.Parse(argv)
+	return opts, flags.Args()
 }
 
-func get_config() *Config {
-	dirpath := get_config_dirpath()
-	filepath := filepath.Join(dirpath, "config.json")
-	file, err := os.OpenFile(filepath, os.O_RDWR|os.O_CREATE, 0644)
+// the global flags, setting opts when parsed.
+func new_flag_set(opts *Options) *flag.FlagSet {
+	flags := flag.NewFlagSet("apollo", flag.ExitOnError)
+	flags.Usage = func() {
+		fmt.Fprintf(os.Stderr, "USAGE: %s\n\nFLAGS:\n", main_usage)
+		flags.PrintDefaults()
+		fmt.Fprintf(os.Stderr, "\nRun `apollo help` for the commands.\n")
+	}
+	flags.StringVar(&opts.config_path, "config", "", "path of the config file (env: APOLLO_CONFIG)")
+	flags.StringVar(&opts.host, "host", "", "control the daemon at host[:port] over tcp")
+	flags.StringVar(&opts.token, "token", "", "rpc token of the daemon (env: APOLLO_TOKEN)")
+	flags.BoolVar(&opts.json, "json", false, "print the replies of the daemon as json")
+	flags.BoolVar(&opts.quiet, "quiet", false, "print nothing but the errors, the exit status tells the result")
+	for _, field := range config_fields {
+		usage := fmt.Sprintf("%s (env: %s)", field.usage, field.env)
+		set := func(value string) error {
+			opts.values[field.key] = value
+			return nil
+		}
+		if field.boolean {
+			flags.BoolFunc(field.flag, usage, set)
+		} else {
+			flags.Func(field.flag, usage, set)
+		}
+	}
+	return flags
+}
+
+func get_config(opts Options) *Config {
+	path := opts.config_path
+	if path == "" {
+		path = os.Getenv("APOLLO_CONFIG")
+	}
+	if path == "" {
+		path = filepath.Join(get_config_dirpath(opts.quiet), "config.json")
+	}
+	file_config, err := read_config(path, opts.quiet)
 	if err != nil {
-		panic(err)
+		fmt.Fprintf(os.Stderr, "ERROR: cannot read the config: %v\n", err)
+		os.Exit(exit_failure)
 	}
 
-	var config Config
-	decoder := json.NewDecoder(file)
-	err = decoder.Decode(&config)
-	file.Close()
+	config := *file_config
+	config.file = file_config
+	config.sources = map[string]string{}
+	for k, v := range file_config.sources {
+		config.sources[k] = v
+	}
+	for _, field := range config_fields {
+		if value, ok := os.LookupEnv(field.env); ok {
+			if err := field.set(&config, value); err != nil {
+				fmt.Fprintf(os.Stderr, "ERROR: invalid value of %s: %v\n", field.env, err)
+				os.Exit(1)
+			}
+			config.sources[field.key] = "env: " + field.env
+		}
+		if value, ok := opts.values[field.key]; ok {
+			if err := field.set(&config, value); err != nil {
+				fmt.Fprintf(os.Stderr, "ERROR: invalid value of --%s: %v\n", field.flag, err)
+				os.Exit(1)
+			}
+			config.sources[field.key] = "flag: --" + field.flag
+		}
+	}
+	if opts.host != "" {
+		config.remote = true
+		config.RpcNetwork = "tcp"
+		config.RpcAddr = opts.host
+		if _, _, err := net.SplitHostPort(opts.host); err != nil {
+			config.RpcAddr = net.JoinHostPort(opts.host, "42069")
+		}
+		config.sources["rpc_network"] = "flag: --host"
+		config.sources["rpc_addr"] = "flag: --host"
+	}
+	config.token = opts.token
+	if config.token == "" {
+		config.token = os.Getenv("APOLLO_TOKEN")
+	}
+	config.json_output = opts.json
+	config.quiet = opts.quiet
+	set_default_dirs(&config)
+	if config.RpcAddr == "" {
+		if config.RpcNetwork == "tcp" {
+			config.RpcAddr = "localhost:42069"
+		} else {
+			config.RpcAddr = filepath.Join(config.RuntimeDir, "apollo.sock")
+		}
+	}
+	return &config
+}
 
+// fills the directories that are not set with their XDG defaults.
+func set_default_dirs(config *Config) {
+	if config.DataDir == "" {
+		config.DataDir = get_xdg_dirpath("XDG_DATA_HOME", ".local/share")
+	}
+	if config.StateDir == "" {
+		config.StateDir = get_xdg_dirpath("XDG_STATE_HOME", ".local/state")
+	}
+	if config.OutputFile == "" {
+		config.OutputFile = filepath.Join(config.StateDir, "output.wav")
+	}
+	if config.RuntimeDir == "" {
+		runtime_dir := os.Getenv("XDG_RUNTIME_DIR")
+		if filepath.IsAbs(runtime_dir) {
+			config.RuntimeDir = filepath.Join(runtime_dir, "apollo")
+		} else {
+			// no per-user runtime dir, keep users apart in the temp dir
+			config.RuntimeDir = filepath.Join(os.TempDir(), fmt.Sprintf("apollo-%d", os.Getuid()))
+		}
+	}
+}
+
+// relative paths in XDG variables are invalid and should be ignored per spec.
+func get_xdg_dirpath(env string, fallback string) string {
+	dirpath := os.Getenv(env)
+	if !filepath.IsAbs(dirpath) {
+		dirpath = filepath.Join(os.Getenv("HOME"), fallback)
+	}
+	return filepath.Join(dirpath, "apollo")
+}
+
+// reads the config file in path, creating it with the default config when
+// there is none. A file that is not a config is an error and is left alone.
+func read_config(path string, quiet bool) (*Config, error) {
+	var config Config
+	set_default_config(&config)
+	config.path = path
+	config.sources = map[string]string{}
+	for _, field := range config_fields {
+		config.sources[field.key] = "default"
+	}
+	if _, err := os.Stat(path); os.IsNotExist(err) {
+		if !quiet {
+			fmt.Fprintf(os.Stderr, "Config not found setting default config\n")
+		}
+		if err := save_config(&config); err != nil {
+			return nil, err
+		}
+		return &config, nil
+	}
+	data, err := os.ReadFile(path)
 	if err != nil {
-		set_default_config(&config)
-		save_config(&config)
+		return nil, err
 	}
-	return &config
+	var raw map[string]json.RawMessage
+	// an empty file is a config without settings
+	if len(bytes.TrimSpace(data)) > 0 {
+		if err := json.Unmarshal(data, &raw); err != nil {
+			return nil, fmt.Errorf("%s: %v", path, err)
+		}
+	}
+	// older configs named the rpc address 'rpc_port' and only spoke tcp,
+	// saving the port on all interfaces as default: drop it for the unix
+	// socket, keep tcp for any other address.
+	if value, ok := raw["rpc_port"]; ok {
+		if _, ok := raw["rpc_addr"]; !ok {
+			raw["rpc_addr"] = value
+		}
+	}
+	if _, ok := raw["rpc_network"]; !ok {
+		if string(raw["rpc_addr"]) == `":42069"` {
+			if !quiet {
+				fmt.Fprintf(os.Stderr, "Config: ignoring old default rpc address :42069, using the unix socket\n")
+			}
+			delete(raw, "rpc_addr")
+		} else if _, ok := raw["rpc_addr"]; ok {
+			raw["rpc_network"] = json.RawMessage(`"tcp"`)
+		}
+	}
+	for _, field := range config_fields {
+		value, ok := raw[field.key]
+		if !ok {
+			continue
+		}
+		if field.boolean {
+			var b bool
+			err = json.Unmarshal(value, &b)
+			if err == nil {
+				err = field.set(&config, strconv.FormatBool(b))
+			}
+		} else if field.number {
+			var f float64
+			err = json.Unmarshal(value, &f)
+			if err == nil {
+				err = field.set(&config, strconv.FormatFloat(f, 'g', -1, 64))
+			}
+		} else {
+			var s string
+			err = json.Unmarshal(value, &s)
+			if err == nil {
+				err = field.set(&config, s)
+			}
+		}
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Config: ignoring invalid value of '%s': %v\n", field.key, err)
+			continue
+		}
+		config.sources[field.key] = "file"
+	}
+	return &config, nil
 }
 
 func set_default_config(config *Config) {
-	fmt.Printf("Config not found setting default config\n")
 	*config = Config{
 		MusicDir: filepath.Join(os.Getenv("HOME"), "Music"),
 		Loop: true,
-		RpcPort: ":42069",
+		RpcNetwork: "unix",
+		RpcAuth: true,
+		Output: "speaker",
+		OutputSpeed: 1,
+		MarkBroken: true,
+		MaxSkips: 5,
+		LogLevel: "info",
+		LogFormat: "text",
+		LogMaxSize: 10,
+		LogMaxFiles: 3,
 	}
 }
 
+// saves the values of the config file, overrides from env and flags are
+// never written back.
 func save_config(config *Config) error {
-	dirpath := get_config_dirpath()
-	filepath := filepath.Join(dirpath, "config.json")
-	file, err := os.OpenFile(filepath, os.O_WRONLY|os.O_TRUNC, 0644)
+	if config.file != nil {
+		config = config.file
+	}
+	file, err := os.OpenFile(config.path, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
 	if err != nil {
 		return err
 	}
@@ -60,11 +631,33 @@ func save_config(config *Config) error {
 	return nil
 }
 
-func get_dir(path string) bool {
+func handle_config(config *Config, args []any) {
+	effective := false
+	for _, arg := range args[1:] {
+		if arg.(string) == "--effective" {
+			effective = true
+		}
+	}
+	switch args[0].(string) {
+	case "list":
+		fmt.Printf("Config: %s\n", config.path)
+		for _, field := range config_fields {
+			if effective {
+				fmt.Printf("%s = %s (%s)\n", field.key, field.get(config), config.sources[field.key])
+			} else {
+				fmt.Printf("%s = %s\n", field.key, field.get(config.file))
+			}
+		}
+	}
+}
+
+func get_dir(path string, perm os.FileMode, quiet bool) bool {
 	file_info, err := os.Stat(path)
 	if err != nil {
-		fmt.Printf("Apollo: Creating config dir in %s\n", path)
-		os.Mkdir(path, 0755)
+		if !quiet {
+			fmt.Fprintf(os.Stderr, "Apollo: Creating dir in %s\n", path)
+		}
+		os.MkdirAll(path, perm)
 		file_info, err = os.Stat(path)
 		if err != nil {
 			panic(err)
@@ -73,12 +666,12 @@ func get_dir(path string) bool {
 	return file_info.IsDir()
 }
 
-func get_config_dirpath() string {
+func get_config_dirpath(quiet bool) string {
 	user_config, err := os.UserConfigDir()
 	if err != nil {
 		panic(err)
 	}
 	config_dirpath := filepath.Join(user_config, "apollo")
-	get_dir(config_dirpath)
+	get_dir(config_dirpath, 0755, quiet)
 	return config_dirpath
 }
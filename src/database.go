@@ -3,19 +3,21 @@ package main
 import (
 	"database/sql"
 	"fmt"
-	"log"
+	"io"
+	"net/url"
 	"os"
 	"path/filepath"
 	"slices"
 	"strings"
+	"time"
 
 	_ "github.com/mattn/go-sqlite3"
 )
 
-func get_db() (*sql.DB, error) {
-	data_dirpath := os.Getenv("HOME") + "/.local/share/apollo"
+func get_db(data_dirpath string, quiet bool) (*sql.DB, error) {
 	db_filepath := filepath.Join(data_dirpath, "apollo.db")
-	get_dir(data_dirpath)
+	get_dir(data_dirpath, 0755, quiet)
+	migrate_db(db_filepath)
 
 	db, err := sql.Open("sqlite3", db_filepath)
 	if err != nil {
@@ -39,20 +41,99 @@ func get_db() (*sql.DB, error) {
 		foreign key (playlist_id) references playlists(id) on delete cascade,
 		foreign key (music_id) references musics(id) on delete cascade
 	);
+	create table if not exists broken_songs (
+		music_id integer not null primary key,
+		error text not null,
+		time integer not null,
+		foreign key (music_id) references musics(id) on delete cascade
+	);
 	`
 	_, err = db.Exec(query)
 	if err != nil {
-		log.Printf("%q: %s\n", err, query)
+		logger(log_db).Error("cannot create the tables", "err", err)
 		return db, err
 	}
 	return db, nil
 }
 
+// moves the database from where it was always created before the data
+// directory became configurable.
+// opens the database for queries only, without creating or migrating it,
+// for the completions.
+func open_db_readonly(data_dirpath string) (*sql.DB, error) {
+	db_filepath := filepath.Join(data_dirpath, "apollo.db")
+	if _, err := os.Stat(db_filepath); err != nil {
+		return nil, err
+	}
+	dsn := &url.URL{ Scheme: "file", Path: db_filepath, RawQuery: "mode=ro" }
+	return sql.Open("sqlite3", dsn.String())
+}
+
+func migrate_db(db_filepath string) {
+	legacy_filepath := filepath.Join(os.Getenv("HOME"), ".local/share/apollo", "apollo.db")
+	if legacy_filepath == db_filepath {
+		return
+	}
+	if _, err := os.Stat(db_filepath); err == nil {
+		return
+	}
+	if _, err := os.Stat(legacy_filepath); err != nil {
+		return
+	}
+	logger(log_db).Info("moving the database", "from", legacy_filepath, "to", db_filepath)
+	// the changes not checkpointed yet are in the sidecar files of the wal or
+	// the rollback journal, moved before the database and back on a failure
+	moved := []string{}
+	for _, suffix := range []string{ "-wal", "-shm", "-journal", "" } {
+		if _, err := os.Stat(legacy_filepath + suffix); err != nil {
+			continue
+		}
+		if err := move_file(legacy_filepath + suffix, db_filepath + suffix); err != nil {
+			logger(log_db).Error("cannot move the database", "file", legacy_filepath + suffix, "err", err)
+			for _, suffix := range moved {
+				move_file(db_filepath + suffix, legacy_filepath + suffix)
+			}
+			return
+		}
+		moved = append(moved, suffix)
+	}
+}
+
+func move_file(src string, dst string) error {
+	if err := os.Rename(src, dst); err == nil {
+		return nil
+	}
+	// rename does not work across filesystems, copy it instead
+	if err := copy_file(src, dst); err != nil {
+		os.Remove(dst)
+		return err
+	}
+	return os.Remove(src)
+}
+
+func copy_file(src string, dst string) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	out, err := os.OpenFile(dst, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0644)
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(out, in)
+	if err != nil {
+		out.Close()
+		return err
+	}
+	return out.Close()
+}
+
 func get_all_songs(db *sql.DB) []Music {
 	musics := []Music{}
 	result, err := db.Query("select * from musics;")
 	if err != nil {
-		log.Fatal(err)
+		logger(log_db).Error("cannot get the songs", "err", err)
 		return musics
 	}
 	for result.Next() {
@@ -66,14 +147,15 @@ func get_all_songs(db *sql.DB) []Music {
 	return musics
 }
 
-func register_dir(db *sql.DB, dirpath string) error {
+// returns the number of songs added to the database
+func register_dir(db *sql.DB, dirpath string) (int, error) {
 	songs, err := get_songs_from_dir(dirpath)
 	if err != nil {
-		return fmt.Errorf("Error getting songs from %s: %v\n", dirpath, err)
+		return 0, fmt.Errorf("Error getting songs from %s: %v\n", dirpath, err)
 	}
 	rows, err := db.Query("select path from musics;")
 	if err != nil {
-		return fmt.Errorf("Error Querying songs from db: %v\n", err)
+		return 0, fmt.Errorf("Error Querying songs from db: %v\n", err)
 	}
 	exists := []string{}
 	for rows.Next() {
@@ -93,34 +175,34 @@ func register_dir(db *sql.DB, dirpath string) error {
 			if err != nil {
 				continue
 			}
-			name := strings.TrimSuffix(info.Name(), ".ogg")
+			name := get_title(info.Name())
 			value := fmt.Sprintf("('%s', '%s')", name, path)
 			new_songs = append(new_songs, value)
 		}
 	}
 	if len(new_songs) == 0 {
-		fmt.Printf("No new values to insert\n")
-		return nil
+		logger(log_sync).Info("no new songs", "dir", dirpath)
+		return 0, nil
 	}
 	values := strings.Join(new_songs, ",")
 	result, err := db.Exec(fmt.Sprintf("insert into musics(title, path) values %s;", values))
 	if err != nil {
-		return fmt.Errorf("Error: inserting %s to db: %v", values, err)
+		return 0, fmt.Errorf("Error: inserting %s to db: %v", values, err)
 	}
 	count, err := result.RowsAffected()
 	if err != nil {
-		log.Fatal(err)
-		return nil
+		logger(log_sync).Error("cannot count the added songs", "err", err)
+		return 0, nil
 	}
-	fmt.Printf("Insert to db success with %d row(s) affected\n", count)
-	return nil
+	logger(log_sync).Info("added songs", "dir", dirpath, "count", count)
+	return int(count), nil
 }
 
 func clean_musics(db *sql.DB) uint {
 	paths := []string{}
 	rows, err := db.Query("select path from musics;")
 	if err != nil {
-		fmt.Printf("Error getting musics from database:%v\n", err)
+		logger(log_db).Error("cannot get the songs", "err", err)
 		return 0
 	}
 	for rows.Next() {
@@ -136,15 +218,22 @@ func clean_musics(db *sql.DB) uint {
 		}
 		invalid_paths = append(invalid_paths, path)
 	}
-	values := strings.Join(invalid_paths, ",")
-	result, err := db.Exec(fmt.Sprintf("delete from musics where path in (%s);", values))
+	if len(invalid_paths) == 0 {
+		return 0
+	}
+	values := []any{}
+	for _, path := range invalid_paths {
+		values = append(values, path)
+	}
+	placeholders := strings.TrimSuffix(strings.Repeat("?,", len(values)), ",")
+	result, err := db.Exec(fmt.Sprintf("delete from musics where path in (%s);", placeholders), values...)
 	if err != nil {
-		fmt.Printf("Error deleting musics from database:%v\n", err)
+		logger(log_db).Error("cannot delete the missing songs", "err", err)
 		return 0
 	}
 	rows_affected, err := result.RowsAffected()
 	if err != nil {
-		fmt.Printf("Error getting rows affected:%v\n", err)
+		logger(log_db).Error("cannot count the deleted songs", "err", err)
 		return 0
 	}
 	return uint(rows_affected)
@@ -172,7 +261,7 @@ func get_playlist(db *sql.DB, name string) (Playlist, error) {
 	where p.id = %d;`, playlist.id)
 	rows, err := db.Query(query)
 	if err != nil {
-		fmt.Printf("Error getting musics from database:%v\n", err)
+		logger(log_db).Error("cannot get the songs of the playlist", "playlist", name, "err", err)
 		return playlist, fmt.Errorf("Error getting musics from database:%v\n", err)
 	}
 
@@ -187,13 +276,13 @@ func get_playlist(db *sql.DB, name string) (Playlist, error) {
 	return playlist, nil
 }
 
-func exists(db *sql.DB, table string, where string) bool {
+func exists(db *sql.DB, table string, where string, args ...any) bool {
 	query := fmt.Sprintf("select exists (select 1 from %s where %s);", table, where)
-	row := db.QueryRow(query)
+	row := db.QueryRow(query, args...)
 	var exists bool
 	err := row.Scan(&exists)
 	if err != nil {
-		fmt.Printf("Error checking on %s table where %s: %v\n", table, where, err)
+		logger(log_db).Error("cannot check the table", "table", table, "where", where, "err", err)
 		return false
 	}
 	return exists
@@ -210,67 +299,73 @@ func get_song(db *sql.DB ,title string) (Music, error) {
 	return song, nil
 }
 
-func sync_musics(db *sql.DB, dirpath string, fallback string) (msg string, err error)  {
-	msg = ""
+func get_song_by_id(db *sql.DB, id int) (Music, error) {
+	song := Music{}
+	row := db.QueryRow("select id, title, path from musics where id = ?;", id)
+	err := row.Scan(&song.id, &song.title, &song.path)
+	if err != nil {
+		return song, fmt.Errorf("Cannot get song %d from db: %v", id, err)
+	}
+	return song, nil
+}
+
+func get_song_by_path(db *sql.DB, path string) (Music, error) {
+	song := Music{}
+	row := db.QueryRow("select id, title, path from musics where path = ?;", path)
+	err := row.Scan(&song.id, &song.title, &song.path)
+	if err != nil {
+		return song, fmt.Errorf("Cannot get song '%s' from db: %v", path, err)
+	}
+	return song, nil
+}
+
+func sync_musics(db *sql.DB, dirpath string, fallback string) (SyncReply, error)  {
+	reply := SyncReply{ Dir: dirpath }
 	if dirpath == "" {
+		reply.Dir = fallback
+		reply.Default = true
 		file, err := os.Stat(fallback)
 		if err != nil || !file.IsDir() {
-			return msg, fmt.Errorf("Default Dir: %s is not a valid directory path: %v", fallback,  err)
+			return reply, fmt.Errorf("Default Dir: %s is not a valid directory path: %v", fallback,  err)
 		}
-		msg = "Syncing database to default directory"
-		return msg, register_dir(db, fallback)
+		reply.Added, err = register_dir(db, fallback)
+		return reply, err
 	}
 	info, err := os.Stat(dirpath)
 	if err != nil || !info.IsDir() {
-		msg = fmt.Sprintf("Invalid argument '%s': not a directory path", dirpath)
-		return msg, fmt.Errorf("%s", msg)
-	}
-	msg = fmt.Sprintf("Syncing database to '%s'", dirpath)
-	return msg, register_dir(db, dirpath)
-}
-
-func list_musics(db *sql.DB) string {
-	msg := ""
-	songs := get_all_songs(db)
-	if len(songs) == 0 {
-		msg = "No songs found in database"
-	} else {
-		msg = "Listing Database Records"
-		for _, song := range songs {
-			msg = fmt.Sprintf("%s\n%d: %s -> %s", msg, song.id, song.title, song.path)
-		}
+		return reply, fmt.Errorf("Invalid argument '%s': not a directory path", dirpath)
 	}
-	return msg
+	reply.Added, err = register_dir(db, dirpath)
+	return reply, err
 }
 
-func create_playlist(db *sql.DB, name string) (string, error) {
-	if exists(db, "playlists", fmt.Sprintf("name = %s", name)) {
-		return fmt.Sprintf("Playlist: '%s' already exists", name), nil
+// returns false when a playlist with the name already exists
+func create_playlist(db *sql.DB, name string) (bool, error) {
+	if exists(db, "playlists", "name = ?", name) {
+		return false, nil
 	}
 	_, err := db.Exec("insert into playlists(name) values (?);", name)
 	if err != nil {
-		return fmt.Sprintf("ERROR on inserting: %v", err), err
+		return false, fmt.Errorf("ERROR on inserting: %v", err)
 	}
-	return fmt.Sprintf("Successfully created playlist '%s'!", name), nil
+	return true, nil
 }
 
-func delete_playlist(db *sql.DB, name string) (string, error) {
+// returns false when there is no playlist with the name
+func delete_playlist(db *sql.DB, name string) (bool, error) {
 	result, err := db.Exec("delete from playlists where name = ?;", name)
 	if err != nil {
-		return fmt.Sprintf("Error deleting musics from database:%v", err), err
+		return false, fmt.Errorf("Error deleting musics from database:%v", err)
 	}
 	rows_affected, err := result.RowsAffected()
 	if err != nil {
-		return fmt.Sprintf("Error getting rows affected:%v", err), err
-	}
-	if rows_affected == 0 {
-		return fmt.Sprintf("No playlist with '%s' in database!", name), nil
+		return false, fmt.Errorf("Error getting rows affected:%v", err)
 	}
-	return fmt.Sprintf("Successfully deleted playlist '%s'!", name), nil
+	return rows_affected > 0, nil
 }
 
-func list_playlist(db *sql.DB) (string, error) {
-	msg := ""
+func list_playlist(db *sql.DB) ([]PlaylistSummary, error) {
+	playlists := []PlaylistSummary{}
 	query := `
 	select playlists.*, count(playlist_songs.music_id) as song_count
 	from playlists
@@ -279,22 +374,17 @@ func list_playlist(db *sql.DB) (string, error) {
 	`
 	result, err := db.Query(query)
 	if err != nil {
-		return msg, fmt.Errorf("ERROR: query error of playlists %v", err)
+		return playlists, fmt.Errorf("ERROR: query error of playlists %v", err)
 	}
 	for result.Next() {
-		var id int
-		var count int
-		var name string
-		err = result.Scan(&id, &name, &count)
+		var playlist PlaylistSummary
+		err = result.Scan(&playlist.Id, &playlist.Name, &playlist.Count)
 		if err != nil {
 			continue
 		}
-		msg = fmt.Sprintf("%s\n[%d] %s with %d song(s)", msg, id, name, count)
+		playlists = append(playlists, playlist)
 	}
-	if msg == "" {
-		msg = "No playlists found"
-	}
-	return msg, nil
+	return playlists, nil
 }
 
 func add_songs(db *sql.DB, playlist_id int, song_ids []int) ([]Music, error) {
@@ -319,17 +409,17 @@ func add_songs(db *sql.DB, playlist_id int, song_ids []int) ([]Music, error) {
 
 	rows, err := db.Query(query, playlist_id)
 	if err != nil {
-		fmt.Printf("Error Inserting songs to playlist: %v ", err)
+		logger(log_db).Error("cannot get the songs of the playlist", "playlist_id", playlist_id, "err", err)
 		return []Music{}, fmt.Errorf("Error Inserting songs to playlist: %v ", err)
 	}
 	for rows.Next() {
 		var music_id int
 		err := rows.Scan(&music_id)
 		if err != nil {
-			fmt.Printf("Error Scanning: %v ", err)
+			logger(log_db).Error("cannot scan a song id", "err", err)
 			continue
 		}
-		fmt.Printf("Inserted song with id: %d\n", music_id)
+		logger(log_db).Debug("song already in the playlist", "playlist_id", playlist_id, "id", music_id)
 		existing_ids = append(existing_ids, fmt.Sprintf("%d", music_id))
 	}
 
@@ -354,24 +444,24 @@ func add_songs(db *sql.DB, playlist_id int, song_ids []int) ([]Music, error) {
 		`, playlist_id, strings.Join(new_ids, ","))
 
 	rows, err = db.Query(query)
-	fmt.Printf("Logging insert query: %s\n", query)
+	logger(log_db).Debug("insert query", "query", query)
 	if err != nil {
-		fmt.Printf("Error Inserting songs to playlist: %v ", err)
+		logger(log_db).Error("cannot add the songs to the playlist", "playlist_id", playlist_id, "err", err)
 		return []Music{}, fmt.Errorf("Error Inserting songs to playlist: %v ", err)
 	}
 	for rows.Next() {
 		var music_id int
 		err := rows.Scan(&music_id)
 		if err != nil {
-			fmt.Printf("Error Scanning: %v ", err)
+			logger(log_db).Error("cannot scan a song id", "err", err)
 			continue
 		}
-		fmt.Printf("Inserted song with id: %d\n", music_id)
+		logger(log_db).Debug("added song to the playlist", "playlist_id", playlist_id, "id", music_id)
 		inserted_ids = append(inserted_ids, fmt.Sprintf("%d", music_id))
 	}
 
 	values := strings.Join(inserted_ids, ",")
-	fmt.Printf("Inserted this values in db:%s\n", values)
+	logger(log_db).Debug("added songs to the playlist", "playlist_id", playlist_id, "ids", values)
 	query = fmt.Sprintf("select * from musics where id in (%s);", values)
 	rows, err = db.Query(query)
 	songs := []Music{}
@@ -382,7 +472,7 @@ func add_songs(db *sql.DB, playlist_id int, song_ids []int) ([]Music, error) {
 		var song Music
 		err := rows.Scan(&song.id, &song.title, &song.path)
 		if err != nil {
-			fmt.Printf("Error Scanning: %v ", err)
+			logger(log_db).Error("cannot scan a song", "err", err)
 			continue
 		}
 		songs = append(songs, song)
@@ -426,3 +516,43 @@ func remove_songs(db *sql.DB, playlist_id int, song_ids []int) ([]int, error) {
 	}
 	return deleted_songs, nil
 }
+
+// flags the song at path as failing to play, a song that is not in the
+// database is not flagged.
+func mark_broken(db *sql.DB, path string, reason string) error {
+	_, err := db.Exec(`
+	insert or replace into broken_songs (music_id, error, time)
+	select id, ?, ? from musics where path = ?;`, reason, time.Now().Unix(), path)
+	return err
+}
+
+// clears the flag of the song at path once it plays again
+func unmark_broken(db *sql.DB, path string) error {
+	_, err := db.Exec("delete from broken_songs where music_id in (select id from musics where path = ?);", path)
+	return err
+}
+
+func list_broken(db *sql.DB) ([]BrokenSong, error) {
+	songs := []BrokenSong{}
+	rows, err := db.Query(`
+	select m.id, m.title, m.path, b.error, b.time
+	from broken_songs b
+	join musics m on m.id = b.music_id
+	order by m.id;`)
+	if err != nil {
+		return songs, fmt.Errorf("Error getting broken songs from database: %v", err)
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var song BrokenSong
+		var since int64
+		err = rows.Scan(&song.Id, &song.Title, &song.Path, &song.Error, &since)
+		if err != nil {
+			logger(log_db).Error("cannot scan a broken song", "err", err)
+			continue
+		}
+		song.Time = time.Unix(since, 0)
+		songs = append(songs, song)
+	}
+	return songs, nil
+}
@@ -0,0 +1,306 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// Drives the commands of the cli against a daemon served in-process, with
+// every directory in a temp dir and the audio going to the null output.
+
+type test_daemon struct {
+	config *Config
+	daemon *Daemon
+	manager *MusicManager
+}
+
+func setup_test_env(t *testing.T) (string, *Config) {
+	t.Helper()
+	root := t.TempDir()
+	music_dir := filepath.Join(root, "Music")
+	for _, name := range []string{"a/one.wav", "a/two.wav", "b/three.wav"} {
+		path := filepath.Join(music_dir, name)
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatal(err)
+		}
+		write_fixture(t, path, 300*time.Millisecond)
+	}
+	t.Setenv("HOME", root)
+	t.Setenv("XDG_CONFIG_HOME", filepath.Join(root, "config"))
+	t.Setenv("XDG_DATA_HOME", filepath.Join(root, "data"))
+	t.Setenv("XDG_STATE_HOME", filepath.Join(root, "state"))
+	t.Setenv("XDG_RUNTIME_DIR", filepath.Join(root, "run"))
+	t.Setenv("APOLLO_MUSIC_DIR", music_dir)
+	t.Setenv("APOLLO_OUTPUT", "null")
+	t.Setenv("APOLLO_OUTPUT_SPEED", "20")
+	config := get_config(Options{ values: map[string]string{} })
+	return music_dir, config
+}
+
+func start_test_daemon(t *testing.T, config *Config) *test_daemon {
+	t.Helper()
+	get_dir(config.RuntimeDir, 0700, config.quiet)
+	db, err := get_db(config.DataDir, config.quiet)
+	if err != nil {
+		t.Fatalf("get_db: %v", err)
+	}
+	output, err := new_output(config)
+	if err != nil {
+		t.Fatalf("new_output: %v", err)
+	}
+	d := &Daemon{ network: config.RpcNetwork, config: config }
+	d.token, err = get_token(config)
+	if err != nil {
+		t.Fatalf("get_token: %v", err)
+	}
+	d.listener, err = listen_rpc(d.network, config.RpcAddr)
+	if err != nil {
+		t.Fatalf("listen_rpc: %v", err)
+	}
+	m := new_manager(config, db, output, nil)
+	go serve_rpc(d, m)
+	t.Cleanup(func() {
+		d.listener.Close()
+		m.Stop("", &PlayerReply{})
+		output.Close()
+		db.Close()
+	})
+	return &test_daemon{ config: config, daemon: d, manager: m }
+}
+
+// runs the command line `apollo argv...` and returns what it printed, the
+// errors included as on a terminal.
+func run_cmd(config *Config, argv ...string) string {
+	cmd, args := parse_cmds(argv, config)
+	var out bytes.Buffer
+	if err := handle_daemon(&out, &Daemon{ network: config.RpcNetwork, config: config }, cmd, args); err != nil {
+		print_error(&out, config, err)
+	}
+	return out.String()
+}
+
+func expect_output(t *testing.T, config *Config, want string, argv ...string) string {
+	t.Helper()
+	out := run_cmd(config, argv...)
+	if !strings.Contains(out, want) {
+		t.Errorf("apollo %s: output %q does not contain %q", strings.Join(argv, " "), out, want)
+	}
+	return out
+}
+
+func (td *test_daemon) state() (name string, length int, current int, playing bool, paused bool) {
+	m := td.manager
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.playlist.name, m.playlist.length(), m.current, m.playing, m.paused
+}
+
+func TestOfflineCommands(t *testing.T) {
+	_, config := setup_test_env(t)
+	expect_output(t, config, "Syncing database to default directory", "sync")
+	out := expect_output(t, config, "Listing Database Records", "list")
+	for _, title := range []string{"1: one", "2: two", "3: three"} {
+		if !strings.Contains(out, title) {
+			t.Errorf("list: output %q does not contain %q", out, title)
+		}
+	}
+	expect_output(t, config, "Successfully created playlist 'mix'!", "create", "mix")
+	expect_output(t, config, "[1] mix with 0 song(s)", "playlists")
+	expect_output(t, config, "Successfully deleted playlist 'mix'!", "delete", "mix")
+	expect_output(t, config, "Daemon is not active...", "next")
+}
+
+func TestJsonOutput(t *testing.T) {
+	_, config := setup_test_env(t)
+	run_cmd(config, "sync")
+	start_test_daemon(t, config)
+	config.json_output = true
+
+	var status Status
+	if err := json.Unmarshal([]byte(run_cmd(config, "status")), &status); err != nil {
+		t.Fatalf("status: %v", err)
+	}
+	if status.Playlist != "All Songs" || status.Length != 3 || status.Playing {
+		t.Errorf("status = %+v", status)
+	}
+	var reply PlayerReply
+	if err := json.Unmarshal([]byte(run_cmd(config, "play")), &reply); err != nil {
+		t.Fatalf("play: %v", err)
+	}
+	if reply.Action != action_started || reply.Status.Song == nil || reply.Status.Song.Title != "one" {
+		t.Errorf("play = %+v", reply)
+	}
+	var failure struct{ Error RpcError `json:"error"` }
+	if err := json.Unmarshal([]byte(run_cmd(config, "play", "nope")), &failure); err != nil {
+		t.Fatalf("play nope: %v", err)
+	}
+	if failure.Error.Code != code_not_found {
+		t.Errorf("error = %+v, want code %s", failure.Error, code_not_found)
+	}
+}
+
+func TestExitStatus(t *testing.T) {
+	_, config := setup_test_env(t)
+	run_cmd(config, "sync")
+	status := func(argv ...string) (int, string) {
+		cmd, args := parse_cmds(argv, config)
+		var out bytes.Buffer
+		err := handle_daemon(&out, &Daemon{ network: config.RpcNetwork, config: config }, cmd, args)
+		return exit_status(err), out.String()
+	}
+	if code, out := status("next"); code != exit_not_running || out != "" {
+		t.Errorf("next without a daemon = %d, %q", code, out)
+	}
+	start_test_daemon(t, config)
+	if code, _ := status("status"); code != exit_ok {
+		t.Errorf("status = %d", code)
+	}
+	if code, out := status("play", "nope"); code != exit_not_found || out != "" {
+		t.Errorf("play nope = %d, %q", code, out)
+	}
+	run_cmd(config, "create", "mix")
+	if code, out := status("play", "mix"); code != exit_not_found || out != "" {
+		t.Errorf("play mix with 0 songs = %d, %q", code, out)
+	}
+	if code, _ := status("add", "x"); code != exit_invalid {
+		t.Errorf("add x = %d", code)
+	}
+	config.quiet = true
+	if code, out := status("vol", "0.5"); code != exit_ok || out != "" {
+		t.Errorf("quiet vol = %d, %q", code, out)
+	}
+	config.quiet = false
+	config.token = "wrong"
+	config.RpcNetwork, config.RpcAddr, config.remote = "tcp", "127.0.0.1:1", true
+	if code, _ := status("status"); code != exit_rpc {
+		t.Errorf("unreachable status = %d", code)
+	}
+}
+
+func TestKill(t *testing.T) {
+	_, config := setup_test_env(t)
+	run_cmd(config, "sync")
+	td := start_test_daemon(t, config)
+	expect_output(t, config, "Playing Song: one", "play")
+	expect_output(t, config, "Apollo Daemon killed", "kill")
+	if _, err := dial_rpc(config); err == nil {
+		t.Errorf("the daemon still accepts connections after kill")
+	}
+	// what main does once serve_rpc returns
+	td.manager.shutdown(fade_duration)
+	td.daemon.wait_conns(time.Second)
+	if _, _, _, playing, _ := td.state(); playing {
+		t.Errorf("still playing after kill")
+	}
+}
+
+func TestDaemonPlayback(t *testing.T) {
+	music_dir, config := setup_test_env(t)
+	// one lasts a second at 20 times the speed, it is still playing when
+	// stopped and the indices of next and prev are known
+	write_fixture(t, filepath.Join(music_dir, "a/one.wav"), 20*time.Second)
+	run_cmd(config, "sync")
+	td := start_test_daemon(t, config)
+
+	expect_output(t, config, "1. one <- [Selected]", "playlist")
+	expect_output(t, config, "Playing Song: one", "play")
+	if _, length, _, playing, _ := td.state(); !playing || length != 3 {
+		t.Fatalf("playing = %v with %d song(s), want the 3 songs playing", playing, length)
+	}
+	expect_output(t, config, "Already Playing song", "play")
+
+	expect_output(t, config, "Song Toggled!", "toggle")
+	if _, _, _, _, paused := td.state(); !paused {
+		t.Errorf("not paused after toggle")
+	}
+	expect_output(t, config, "Unpausing 'All Songs'", "play")
+	if _, _, _, _, paused := td.state(); paused {
+		t.Errorf("paused after play")
+	}
+
+	expect_output(t, config, "Volume changed by -1, now -1", "vol", "-1")
+	td.manager.mu.Lock()
+	volume := td.manager.volume
+	td.manager.mu.Unlock()
+	if volume != -1 {
+		t.Errorf("volume = %g, want -1", volume)
+	}
+
+	expect_output(t, config, "Stopping at index", "stop")
+	if _, _, _, playing, _ := td.state(); playing {
+		t.Errorf("still playing after stop")
+	}
+	expect_output(t, config, "Next with index: 1", "next")
+	expect_output(t, config, "Previous with index: 0", "prev")
+	expect_output(t, config, "Previous with index: 2", "prev")
+
+	// songs play 20 times faster, the playlist keeps looping
+	expect_output(t, config, "Playing Song: three", "play")
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		if _, _, current, _, _ := td.state(); current != 2 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("playlist did not advance from the last song")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	expect_output(t, config, "Going next", "next")
+	expect_output(t, config, "Stopping at index", "stop")
+	expect_output(t, config, "Apollo is not playing anything...", "stop")
+}
+
+func TestDaemonPlaylists(t *testing.T) {
+	_, config := setup_test_env(t)
+	run_cmd(config, "sync")
+	td := start_test_daemon(t, config)
+
+	expect_output(t, config, "Successfully created playlist 'mix'!", "create", "mix")
+	expect_output(t, config, "Playlist: 'mix' already exists", "create", "mix")
+	expect_output(t, config, "[1] mix with 0 song(s)", "playlists")
+	expect_output(t, config, "Can't play 'mix', has 0 songs", "play", "mix")
+	if name, _, _, _, _ := td.state(); name != "mix" {
+		t.Errorf("playlist = %q, want mix", name)
+	}
+
+	expect_output(t, config, "Added 2 song(s) to 'mix' playlist", "add", "1", "3")
+	expect_output(t, config, "Songs provided are already in the playlist", "add", "1")
+	expect_output(t, config, "[1] mix with 2 song(s)", "playlists")
+	expect_output(t, config, "Deleted 1 song(s) from 'mix' playlist", "remove", "1")
+	if _, length, _, _, _ := td.state(); length != 1 {
+		t.Errorf("playlist has %d song(s), want 1", length)
+	}
+	expect_output(t, config, "1. three", "playlist")
+	expect_output(t, config, "Playing Song: three", "play")
+
+	expect_output(t, config, "playlist 'nope' does not exist", "play", "nope")
+	expect_output(t, config, "Successfully deleted playlist 'mix'!", "delete", "mix")
+}
+
+func TestDaemonLibrary(t *testing.T) {
+	music_dir, config := setup_test_env(t)
+	start_test_daemon(t, config)
+
+	expect_output(t, config, "Syncing database to default directory", "sync")
+	expect_output(t, config, "3: three", "list")
+
+	extra_dir := filepath.Join(t.TempDir(), "extra")
+	os.Mkdir(extra_dir, 0755)
+	write_fixture(t, filepath.Join(extra_dir, "four.wav"), 100*time.Millisecond)
+	expect_output(t, config, "Syncing database to '"+extra_dir+"'", "sync", extra_dir)
+	expect_output(t, config, "4: four", "list")
+
+	os.Remove(filepath.Join(music_dir, "a", "two.wav"))
+	expect_output(t, config, "Cleaned 1 item(s) in the database", "clean")
+	out := expect_output(t, config, "1: one", "list")
+	if strings.Contains(out, "two") {
+		t.Errorf("list: cleaned song still listed in %q", out)
+	}
+	expect_output(t, config, "Cleaned 0 item(s) in the database", "clean")
+}
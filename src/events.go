@@ -0,0 +1,229 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// Changes of the player published to the http clients, over server-sent
+// events at /events and over a websocket at /events/ws, so they do not have
+// to poll /status.
+
+const (
+	event_track_started = "track_started"
+	event_track_ended = "track_ended"
+	// the song could not be played, it is skipped
+	event_track_skipped = "track_skipped"
+	event_paused = "paused"
+	event_resumed = "resumed"
+	event_stopped = "stopped"
+	event_volume_changed = "volume_changed"
+	event_playlist_switched = "playlist_switched"
+	event_library_synced = "library_synced"
+	// sent first to every new subscriber
+	event_status = "status"
+)
+
+type Event struct {
+	Type string `json:"type"`
+	// increases with every published event, 0 for the status events
+	Seq uint64 `json:"seq"`
+	Time time.Time `json:"time"`
+	// state of the player right after the change
+	Status Status `json:"status"`
+	// the song that started or ended
+	Song *Song `json:"song,omitempty"`
+	Sync *SyncReply `json:"sync,omitempty"`
+	// why the song was skipped
+	Error string `json:"error,omitempty"`
+}
+
+// events a subscriber can fall behind before events are dropped for it
+const event_backlog = 32
+
+type event_bus struct {
+	mu sync.Mutex
+	subscribers map[chan Event]struct{}
+	seq uint64
+	// the last events, handed to the clients of Wait that missed them
+	history []Event
+}
+
+func new_event_bus() *event_bus {
+	return &event_bus{ subscribers: map[chan Event]struct{}{} }
+}
+
+func (b *event_bus) subscribe() chan Event {
+	ch := make(chan Event, event_backlog)
+	b.mu.Lock()
+	b.subscribers[ch] = struct{}{}
+	b.mu.Unlock()
+	return ch
+}
+
+func (b *event_bus) unsubscribe(ch chan Event) {
+	b.mu.Lock()
+	delete(b.subscribers, ch)
+	b.mu.Unlock()
+}
+
+// subscribes and returns the kept events after seq together, so no event
+// is missed in between. Nothing was missed when seq is 0.
+func (b *event_bus) subscribe_after(seq uint64) (chan Event, []Event, uint64) {
+	ch := b.subscribe()
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	missed := []Event{}
+	for _, event := range b.history {
+		if seq != 0 && event.Seq > seq {
+			missed = append(missed, event)
+		}
+	}
+	return ch, missed, b.seq
+}
+
+// never blocks, it is called while the state of the player is locked.
+func (b *event_bus) publish(event Event) {
+	if b == nil {
+		return
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.seq++
+	event.Seq = b.seq
+	b.history = append(b.history, event)
+	if len(b.history) > event_backlog {
+		b.history = slices.Delete(b.history, 0, 1)
+	}
+	for ch := range b.subscribers {
+		select {
+		case ch <- event:
+		default:
+		}
+	}
+}
+
+// must be called with m.mu held
+func (m *MusicManager) new_event(kind string) Event {
+	event := Event{ Type: kind, Time: time.Now(), Status: m.status() }
+	event.Song = event.Status.Song
+	return event
+}
+
+// must be called with m.mu held
+func (m *MusicManager) emit(kind string) {
+	m.events.publish(m.new_event(kind))
+}
+
+// subscribes to the events, starting with the current status.
+func (m *MusicManager) subscribe() chan Event {
+	ch := m.events.subscribe()
+	m.mu.Lock()
+	event := m.new_event(event_status)
+	m.mu.Unlock()
+	select {
+	case ch <- event:
+	default:
+	}
+	return ch
+}
+
+// how long Wait waits for a change
+const max_wait = 30 * time.Second
+
+// replies the next change of the player after the event numbered args, for
+// the rpc clients that cannot follow /events. The first call passes 0 and the
+// next ones the Seq of the last reply. Replies a status event when nothing
+// changes for a while.
+func (m *MusicManager) Wait(args uint64, reply *Event) error {
+	ch, missed, seq := m.events.subscribe_after(args)
+	defer m.events.unsubscribe(ch)
+	if len(missed) > 0 {
+		*reply = missed[0]
+		return nil
+	}
+	timeout := time.NewTimer(max_wait)
+	defer timeout.Stop()
+	select {
+	case event := <-ch:
+		*reply = event
+	case <-timeout.C:
+		m.mu.Lock()
+		*reply = m.new_event(event_status)
+		m.mu.Unlock()
+		reply.Seq = seq
+	}
+	return nil
+}
+
+func handle_events(m *MusicManager) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		flusher, ok := w.(http.Flusher)
+		if !ok {
+			write_http(w, nil, new_rpc_error(code_internal, "streaming is not supported"))
+			return
+		}
+		ch := m.subscribe()
+		defer m.events.unsubscribe(ch)
+		w.Header().Set("Content-Type", "text/event-stream")
+		w.Header().Set("Cache-Control", "no-store")
+		// keeps proxies from closing an idle connection
+		ping := time.NewTicker(30 * time.Second)
+		defer ping.Stop()
+		for {
+			select {
+			case <-r.Context().Done():
+				return
+			case <-ping.C:
+				fmt.Fprintf(w, ": ping\n\n")
+			case event := <-ch:
+				data, err := json.Marshal(event)
+				if err != nil {
+					continue
+				}
+				fmt.Fprintf(w, "event: %s\ndata: %s\n\n", event.Type, data)
+			}
+			flusher.Flush()
+		}
+	}
+}
+
+var upgrader = websocket.Upgrader{}
+
+func handle_events_ws(m *MusicManager) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		conn, err := upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		ch := m.subscribe()
+		defer m.events.unsubscribe(ch)
+		// nothing is expected from the client, reading handles the close
+		closed := make(chan struct{})
+		go func() {
+			defer close(closed)
+			for {
+				if _, _, err := conn.NextReader(); err != nil {
+					return
+				}
+			}
+		}()
+		for {
+			select {
+			case <-closed:
+				return
+			case event := <-ch:
+				if err := conn.WriteJSON(event); err != nil {
+					return
+				}
+			}
+		}
+	}
+}
@@ -0,0 +1,248 @@
+package main
+
+import (
+	"crypto/subtle"
+	"embed"
+	"encoding/json"
+	"errors"
+	"io"
+	"io/fs"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// REST api over the MusicManager methods, served when http_addr is set.
+// Every resource replies with the json of the rpc reply, failures with
+// {"error": {"code": ..., "message": ...}}. The api is described in
+// openapi.json, served at /openapi.json.
+
+//go:embed openapi.json
+var openapi_spec []byte
+
+// the web ui, served at / with its assets under /ui/
+//go:embed web
+var web_files embed.FS
+
+// a client slower than this to send the headers is hung up on. There is no
+// write timeout, the streams and the events stay open as long as the client.
+var http_header_timeout = 10 * time.Second
+
+func start_http(d *Daemon, m *MusicManager) {
+	if d.config.HttpAddr == "" {
+		return
+	}
+	listener, err := net.Listen("tcp", d.config.HttpAddr)
+	if err != nil {
+		logger(log_http).Error("cannot listen", "addr", d.config.HttpAddr, "err", err)
+		return
+	}
+	logger(log_http).Info("serving", "addr", listener.Addr().String())
+	d.http = &http.Server{
+		Handler: new_http_handler(d, m),
+		ReadHeaderTimeout: http_header_timeout,
+		IdleTimeout: 2 * time.Minute,
+	}
+	go d.http.Serve(listener)
+}
+
+func new_http_handler(d *Daemon, m *MusicManager) http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /openapi.json", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.Write(openapi_spec)
+	})
+	web, _ := fs.Sub(web_files, "web")
+	mux.Handle("GET /ui/", http.StripPrefix("/ui/", http.FileServerFS(web)))
+	mux.HandleFunc("GET /{$}", func(w http.ResponseWriter, r *http.Request) {
+		http.ServeFileFS(w, r, web, "index.html")
+	})
+	mux.HandleFunc("GET /status", func(w http.ResponseWriter, r *http.Request) {
+		var reply Status
+		err := m.Status("", &reply)
+		write_http(w, reply, err)
+	})
+	player := map[string]func(string, *PlayerReply) error{
+		"stop": m.Stop,
+		"toggle": m.Toggle,
+		"next": m.Next,
+		"previous": m.Previous,
+	}
+	for action, method := range player {
+		mux.HandleFunc("POST /player/"+action, func(w http.ResponseWriter, r *http.Request) {
+			var reply PlayerReply
+			err := method("", &reply)
+			write_http(w, reply, err)
+		})
+	}
+	mux.HandleFunc("POST /player/play", func(w http.ResponseWriter, r *http.Request) {
+		var args struct{ Playlist string `json:"playlist"` }
+		if err := read_body(r, &args); err != nil {
+			write_http(w, nil, err)
+			return
+		}
+		var reply PlayerReply
+		err := m.Play(args.Playlist, &reply)
+		write_http(w, reply, err)
+	})
+	mux.HandleFunc("POST /player/volume", func(w http.ResponseWriter, r *http.Request) {
+		var args struct{ Delta float64 `json:"delta"` }
+		if err := read_body(r, &args); err != nil {
+			write_http(w, nil, err)
+			return
+		}
+		var reply PlayerReply
+		err := m.Volume(args.Delta, &reply)
+		write_http(w, reply, err)
+	})
+	mux.HandleFunc("POST /player/jump", func(w http.ResponseWriter, r *http.Request) {
+		var args struct{ Index int `json:"index"` }
+		if err := read_body(r, &args); err != nil {
+			write_http(w, nil, err)
+			return
+		}
+		var reply PlayerReply
+		err := m.Jump(args.Index, &reply)
+		write_http(w, reply, err)
+	})
+	mux.HandleFunc("GET /playlist", func(w http.ResponseWriter, r *http.Request) {
+		var reply PlaylistReply
+		err := m.Playlist("", &reply)
+		write_http(w, reply, err)
+	})
+	mux.HandleFunc("GET /playlists", func(w http.ResponseWriter, r *http.Request) {
+		var reply PlaylistsReply
+		err := m.Playlists("", &reply)
+		write_http(w, reply, err)
+	})
+	mux.HandleFunc("POST /playlists", func(w http.ResponseWriter, r *http.Request) {
+		var args struct{ Name string `json:"name"` }
+		if err := read_body(r, &args); err != nil || args.Name == "" {
+			write_http(w, nil, new_rpc_error(code_invalid, "a playlist name is required"))
+			return
+		}
+		var reply PlaylistChange
+		err := m.Create(args.Name, &reply)
+		write_http(w, reply, err)
+	})
+	mux.HandleFunc("GET /playlists/{name}", func(w http.ResponseWriter, r *http.Request) {
+		playlist, err := get_playlist(m.db, r.PathValue("name"))
+		if err != nil {
+			write_http(w, nil, new_rpc_error(code_not_found, "playlist '%s' does not exist", r.PathValue("name")))
+			return
+		}
+		write_http(w, PlaylistReply{ Id: playlist.id, Name: playlist.name, Songs: to_songs(playlist.songs) }, nil)
+	})
+	mux.HandleFunc("DELETE /playlists/{name}", func(w http.ResponseWriter, r *http.Request) {
+		var reply PlaylistChange
+		err := m.Delete(r.PathValue("name"), &reply)
+		if err == nil && !reply.Changed {
+			err = new_rpc_error(code_not_found, "playlist '%s' does not exist", reply.Name)
+		}
+		write_http(w, reply, err)
+	})
+	for _, method := range []string{"POST", "DELETE"} {
+		mux.HandleFunc(method+" /playlists/{name}/songs", func(w http.ResponseWriter, r *http.Request) {
+			var args struct{ Ids []int `json:"ids"` }
+			if err := read_body(r, &args); err != nil || len(args.Ids) == 0 {
+				write_http(w, nil, new_rpc_error(code_invalid, "song ids are required"))
+				return
+			}
+			reply, err := m.edit_playlist(r.PathValue("name"), args.Ids, method == "DELETE")
+			write_http(w, reply, err)
+		})
+	}
+	mux.HandleFunc("GET /library", func(w http.ResponseWriter, r *http.Request) {
+		var reply LibraryReply
+		if err := m.List("", &reply); err != nil {
+			write_http(w, nil, err)
+			return
+		}
+		query := strings.ToLower(r.URL.Query().Get("q"))
+		songs := []Song{}
+		for _, song := range reply.Songs {
+			if strings.Contains(strings.ToLower(song.Title), query) {
+				songs = append(songs, song)
+			}
+		}
+		write_http(w, LibraryReply{ Songs: songs }, nil)
+	})
+	mux.HandleFunc("GET /songs/{id}/stream", handle_song_stream(m))
+	mux.HandleFunc("GET /live", handle_live(m))
+	mux.HandleFunc("GET /events", handle_events(m))
+	mux.HandleFunc("GET /events/ws", handle_events_ws(m))
+	mux.HandleFunc("POST /library/sync", func(w http.ResponseWriter, r *http.Request) {
+		var args struct{ Dir string `json:"dir"` }
+		if err := read_body(r, &args); err != nil {
+			write_http(w, nil, err)
+			return
+		}
+		var reply SyncReply
+		err := m.Sync(args.Dir, &reply)
+		write_http(w, reply, err)
+	})
+	mux.HandleFunc("POST /library/clean", func(w http.ResponseWriter, r *http.Request) {
+		var reply CleanReply
+		err := m.Clean("", &reply)
+		write_http(w, reply, err)
+	})
+	return d.authorize(mux)
+}
+
+// requires the token of the daemon when rpc_auth is on, given as a bearer
+// token or in the token query parameter for clients that cannot set headers.
+// The spec and the web ui stay public, the ui asks for the token itself.
+func (d *Daemon) authorize(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		public := r.URL.Path == "/" || r.URL.Path == "/openapi.json" || strings.HasPrefix(r.URL.Path, "/ui/")
+		if !d.config.RpcAuth || public {
+			next.ServeHTTP(w, r)
+			return
+		}
+		token, found := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if !found {
+			token = r.URL.Query().Get("token")
+		}
+		if subtle.ConstantTimeCompare([]byte(token), []byte(d.token)) != 1 {
+			w.Header().Set("WWW-Authenticate", "Bearer")
+			write_http(w, nil, new_rpc_error(code_unauthorized, "invalid token"))
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// decodes the optional json body of a request.
+func read_body(r *http.Request, args any) error {
+	err := json.NewDecoder(r.Body).Decode(args)
+	if err != nil && !errors.Is(err, io.EOF) {
+		return new_rpc_error(code_invalid, "invalid json body: %v", err)
+	}
+	return nil
+}
+
+func write_http(w http.ResponseWriter, reply any, err error) {
+	w.Header().Set("Content-Type", "application/json")
+	if err != nil {
+		rpc_err := as_rpc_error(err)
+		w.WriteHeader(http_status(rpc_err.Code))
+		json.NewEncoder(w).Encode(map[string]any{ "error": rpc_err })
+		return
+	}
+	json.NewEncoder(w).Encode(reply)
+}
+
+func http_status(code string) int {
+	switch code {
+	case code_not_found:
+		return http.StatusNotFound
+	case code_invalid:
+		return http.StatusBadRequest
+	case code_empty:
+		return http.StatusConflict
+	case code_unauthorized:
+		return http.StatusUnauthorized
+	}
+	return http.StatusInternalServerError
+}
@@ -0,0 +1,387 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+func start_test_http(t *testing.T) (*httptest.Server, *test_daemon) {
+	t.Helper()
+	_, config := setup_test_env(t)
+	run_cmd(config, "sync")
+	td := start_test_daemon(t, config)
+	server := httptest.NewServer(new_http_handler(td.daemon, td.manager))
+	t.Cleanup(server.Close)
+	return server, td
+}
+
+// sends the request with the token of the daemon and decodes the json reply.
+func do_http(t *testing.T, server *httptest.Server, td *test_daemon, method string, path string, body string, reply any) int {
+	t.Helper()
+	req, err := http.NewRequest(method, server.URL+path, strings.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("Authorization", "Bearer "+td.daemon.token)
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("%s %s: %v", method, path, err)
+	}
+	defer resp.Body.Close()
+	if reply != nil {
+		if err := json.NewDecoder(resp.Body).Decode(reply); err != nil {
+			t.Fatalf("%s %s: decoding reply: %v", method, path, err)
+		}
+	}
+	return resp.StatusCode
+}
+
+func TestHttpAuth(t *testing.T) {
+	server, td := start_test_http(t)
+	resp, err := http.Get(server.URL + "/status")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusUnauthorized {
+		t.Errorf("status without token: %d, want 401", resp.StatusCode)
+	}
+	resp, err = http.Get(server.URL + "/status?token=" + td.daemon.token)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Errorf("status with token query: %d, want 200", resp.StatusCode)
+	}
+
+	resp, err = http.Get(server.URL + "/openapi.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	var spec struct{ Paths map[string]any `json:"paths"` }
+	if err := json.NewDecoder(resp.Body).Decode(&spec); err != nil {
+		t.Fatalf("openapi.json: %v", err)
+	}
+	for _, path := range []string{"/status", "/player/next", "/playlists/{name}/songs", "/library"} {
+		if _, found := spec.Paths[path]; !found {
+			t.Errorf("openapi.json does not describe %s", path)
+		}
+	}
+}
+
+func TestHttpApi(t *testing.T) {
+	server, td := start_test_http(t)
+
+	var status Status
+	if code := do_http(t, server, td, "GET", "/status", "", &status); code != 200 || status.Length != 3 {
+		t.Errorf("GET /status: %d %+v", code, status)
+	}
+	var reply PlayerReply
+	do_http(t, server, td, "POST", "/player/next", "", &reply)
+	if reply.Action != action_selected || reply.Status.Index != 1 {
+		t.Errorf("POST /player/next: %+v", reply)
+	}
+
+	var change PlaylistChange
+	if code := do_http(t, server, td, "POST", "/playlists", `{"name": "mix"}`, &change); code != 200 || !change.Changed {
+		t.Errorf("POST /playlists: %d %+v", code, change)
+	}
+	// mix is not the current playlist, only the database changes
+	var songs SongsChange
+	if code := do_http(t, server, td, "POST", "/playlists/mix/songs", `{"ids": [1, 3]}`, &songs); code != 200 || len(songs.Ids) != 2 {
+		t.Errorf("POST /playlists/mix/songs: %d %+v", code, songs)
+	}
+	var playlist PlaylistReply
+	do_http(t, server, td, "GET", "/playlists/mix", "", &playlist)
+	if len(playlist.Songs) != 2 || playlist.Songs[1].Title != "three" {
+		t.Errorf("GET /playlists/mix: %+v", playlist)
+	}
+	do_http(t, server, td, "POST", "/player/play", `{"playlist": "mix"}`, &reply)
+	if !reply.Switched || reply.Status.Song.Title != "one" {
+		t.Errorf("POST /player/play: %+v", reply)
+	}
+	do_http(t, server, td, "DELETE", "/playlists/mix/songs", `{"ids": [1]}`, &songs)
+	if name, length, _, _, _ := td.state(); name != "mix" || length != 1 {
+		t.Errorf("current playlist %s has %d song(s) after removing, want 1", name, length)
+	}
+
+	var library LibraryReply
+	do_http(t, server, td, "GET", "/library?q=T", "", &library)
+	if len(library.Songs) != 2 {
+		t.Errorf("GET /library?q=T: %+v", library)
+	}
+
+	var failure struct{ Error RpcError `json:"error"` }
+	if code := do_http(t, server, td, "GET", "/playlists/nope", "", &failure); code != 404 || failure.Error.Code != code_not_found {
+		t.Errorf("GET /playlists/nope: %d %+v", code, failure)
+	}
+	if code := do_http(t, server, td, "POST", "/player/volume", `{"delta": "loud"}`, &failure); code != 400 {
+		t.Errorf("POST /player/volume with a string: %d %+v", code, failure)
+	}
+	if code := do_http(t, server, td, "DELETE", "/playlists/mix", "", &change); code != 200 || !change.Changed {
+		t.Errorf("DELETE /playlists/mix: %d %+v", code, change)
+	}
+}
+
+func TestHttpStream(t *testing.T) {
+	server, td := start_test_http(t)
+	req, _ := http.NewRequest("GET", server.URL+"/songs/1/stream?token="+td.daemon.token, nil)
+	req.Header.Set("Range", "bytes=0-3")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	body, _ := io.ReadAll(resp.Body)
+	if resp.StatusCode != http.StatusPartialContent || string(body) != "RIFF" {
+		t.Errorf("range of song 1: %d %q", resp.StatusCode, body)
+	}
+	if content_type := resp.Header.Get("Content-Type"); content_type != "audio/wav" {
+		t.Errorf("content type = %q", content_type)
+	}
+	if code := do_http(t, server, td, "GET", "/songs/99/stream", "", nil); code != 404 {
+		t.Errorf("stream of a missing song: %d, want 404", code)
+	}
+}
+
+func TestHttpLive(t *testing.T) {
+	server, td := start_test_http(t)
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	req, _ := http.NewRequestWithContext(ctx, "GET", server.URL+"/live?token="+td.daemon.token, nil)
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	header := make([]byte, 44)
+	if _, err := io.ReadFull(resp.Body, header); err != nil || string(header[:4]) != "RIFF" {
+		t.Fatalf("live header %q: %v", header, err)
+	}
+
+	expect_output(t, td.config, "Playing Song: one", "play")
+	// a second of 16 bit stereo audio
+	samples := make([]byte, int(output_rate)*4)
+	if _, err := io.ReadFull(resp.Body, samples); err != nil {
+		t.Fatalf("reading live audio: %v", err)
+	}
+	silent := true
+	for _, b := range samples {
+		if b != 0 {
+			silent = false
+			break
+		}
+	}
+	if silent {
+		t.Errorf("live audio is silent while playing")
+	}
+}
+
+// reads server-sent events until one of the type is found.
+func next_event(t *testing.T, reader *bufio.Reader, kind string) Event {
+	t.Helper()
+	for {
+		line, err := reader.ReadString('\n')
+		if err != nil {
+			t.Fatalf("waiting for %s event: %v", kind, err)
+		}
+		data, found := strings.CutPrefix(line, "data: ")
+		if !found {
+			continue
+		}
+		var event Event
+		if err := json.Unmarshal([]byte(data), &event); err != nil {
+			t.Fatalf("decoding event %q: %v", data, err)
+		}
+		if event.Type == kind {
+			return event
+		}
+	}
+}
+
+func TestHttpEvents(t *testing.T) {
+	server, td := start_test_http(t)
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	req, _ := http.NewRequestWithContext(ctx, "GET", server.URL+"/events?token="+td.daemon.token, nil)
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if content_type := resp.Header.Get("Content-Type"); content_type != "text/event-stream" {
+		t.Errorf("content type = %q", content_type)
+	}
+	reader := bufio.NewReader(resp.Body)
+	if event := next_event(t, reader, event_status); event.Status.Length != 3 {
+		t.Errorf("status event: %+v", event)
+	}
+
+	expect_output(t, td.config, "Playing Song: one", "play")
+	if event := next_event(t, reader, event_track_started); event.Song == nil || event.Song.Title != "one" {
+		t.Errorf("track_started event: %+v", event)
+	}
+	// songs play 20 times faster
+	if event := next_event(t, reader, event_track_ended); event.Song == nil || event.Song.Title != "one" {
+		t.Errorf("track_ended event: %+v", event)
+	}
+	expect_output(t, td.config, "Song Toggled!", "toggle")
+	next_event(t, reader, event_paused)
+	expect_output(t, td.config, "Volume changed by 0.5, now 0.5", "vol", "0.5")
+	if event := next_event(t, reader, event_volume_changed); event.Status.Volume != 0.5 {
+		t.Errorf("volume_changed event: %+v", event)
+	}
+	expect_output(t, td.config, "Syncing database", "sync")
+	if event := next_event(t, reader, event_library_synced); event.Sync == nil || !event.Sync.Default {
+		t.Errorf("library_synced event: %+v", event)
+	}
+}
+
+// events published between two calls of Wait are not lost.
+func TestWaitMissed(t *testing.T) {
+	_, td := start_test_http(t)
+	var first Event
+	done := make(chan error)
+	go func() { done <- td.manager.Wait(0, &first) }()
+	for deadline := time.Now().Add(2 * time.Second); ; {
+		td.manager.events.mu.Lock()
+		waiting := len(td.manager.events.subscribers)
+		td.manager.events.mu.Unlock()
+		if waiting > 0 || time.Now().After(deadline) {
+			break
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	expect_output(t, td.config, "Syncing database", "sync")
+	if err := <-done; err != nil || first.Type != event_library_synced {
+		t.Fatalf("Wait(0) = %+v, %v", first, err)
+	}
+	expect_output(t, td.config, "Successfully created playlist 'mix'!", "create", "mix")
+	expect_output(t, td.config, "Can't play 'mix'", "play", "mix")
+	expect_output(t, td.config, "Syncing database", "sync")
+	var event Event
+	for _, want := range []string{event_playlist_switched, event_library_synced} {
+		td.manager.Wait(first.Seq, &event)
+		if event.Type != want {
+			t.Errorf("Wait(%d) = %s, want %s", first.Seq, event.Type, want)
+		}
+		first = event
+	}
+}
+
+func TestWebsocketEvents(t *testing.T) {
+	server, td := start_test_http(t)
+	url := "ws" + strings.TrimPrefix(server.URL, "http") + "/events/ws?token=" + td.daemon.token
+	conn, _, err := websocket.DefaultDialer.Dial(url, nil)
+	if err != nil {
+		t.Fatalf("dial: %v", err)
+	}
+	defer conn.Close()
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	var event Event
+	if err := conn.ReadJSON(&event); err != nil || event.Type != event_status {
+		t.Fatalf("first event %+v: %v", event, err)
+	}
+	expect_output(t, td.config, "Successfully created playlist 'mix'!", "create", "mix")
+	expect_output(t, td.config, "Can't play 'mix'", "play", "mix")
+	if err := conn.ReadJSON(&event); err != nil || event.Type != event_playlist_switched || event.Status.Playlist != "mix" {
+		t.Errorf("playlist_switched event %+v: %v", event, err)
+	}
+}
+
+func TestHttpWebUi(t *testing.T) {
+	server, _ := start_test_http(t)
+	for path, want := range map[string]string{
+		"/": `<script src="/ui/app.js">`,
+		"/ui/app.js": "new EventSource(",
+		"/ui/style.css": "#np-bar",
+	} {
+		// the ui asks for the token itself
+		resp, err := http.Get(server.URL + path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		body, _ := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		if resp.StatusCode != 200 || !strings.Contains(string(body), want) {
+			t.Errorf("GET %s: %d, body does not contain %q", path, resp.StatusCode, want)
+		}
+	}
+	// works offline, nothing is loaded from elsewhere
+	entries, _ := web_files.ReadDir("web")
+	for _, entry := range entries {
+		data, _ := web_files.ReadFile("web/" + entry.Name())
+		if strings.Contains(string(data), "http://") || strings.Contains(string(data), "https://") {
+			t.Errorf("web/%s references an external url", entry.Name())
+		}
+	}
+}
+
+func TestHttpJump(t *testing.T) {
+	server, td := start_test_http(t)
+	var reply PlayerReply
+	if code := do_http(t, server, td, "POST", "/player/jump", `{"index": 2}`, &reply); code != 200 {
+		t.Fatalf("POST /player/jump: %d", code)
+	}
+	if reply.Action != action_started || reply.Status.Song.Title != "three" {
+		t.Errorf("POST /player/jump: %+v", reply)
+	}
+	// the song is loaded once the playlist goroutine gets to it
+	deadline := time.Now().Add(5 * time.Second)
+	var status Status
+	for status.Duration == 0 {
+		if time.Now().After(deadline) {
+			t.Fatalf("no duration in the status while playing")
+		}
+		do_http(t, server, td, "GET", "/status", "", &status)
+	}
+	if status.Duration < 0.29 || status.Duration > 0.31 || status.Position > status.Duration {
+		t.Errorf("position %g of a %g seconds song, want a 0.3 seconds song", status.Position, status.Duration)
+	}
+	var failure struct{ Error RpcError `json:"error"` }
+	if code := do_http(t, server, td, "POST", "/player/jump", `{"index": 3}`, &failure); code != 400 {
+		t.Errorf("jump past the end: %d %+v", code, failure)
+	}
+}
+
+func TestHttpSlowClient(t *testing.T) {
+	timeout := http_header_timeout
+	http_header_timeout = 100 * time.Millisecond
+	t.Cleanup(func() { http_header_timeout = timeout })
+	_, config := setup_test_env(t)
+	td := start_test_daemon(t, config)
+	free, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	config.HttpAddr = free.Addr().String()
+	free.Close()
+	start_http(td.daemon, td.manager)
+	if td.daemon.http == nil {
+		t.Fatalf("not serving http")
+	}
+	t.Cleanup(func() { td.daemon.http.Close() })
+	conn, err := net.Dial("tcp", config.HttpAddr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	// the headers never end
+	io.WriteString(conn, "GET /status HTTP/1.1\r\nHost: apollo\r\n")
+	conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	if _, err := io.ReadAll(conn); err != nil {
+		t.Errorf("the slow client was not hung up on: %v", err)
+	}
+}
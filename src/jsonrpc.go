@@ -0,0 +1,177 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/rpc"
+	"strings"
+	"sync"
+)
+
+// JSON-RPC 2.0 codec for the rpc server, so clients that are not written in
+// Go can call the same methods. Requests and responses are json objects, one
+// per line:
+//
+//	{"jsonrpc": "2.0", "id": 1, "method": "MusicManager.Next"}
+//	{"jsonrpc": "2.0", "id": 2, "method": "Play", "params": ["mix"]}
+//
+// The service defaults to MusicManager. Every method takes a single argument
+// given as params or as the only element of params. Batches are not supported.
+
+const (
+	jsonrpc_parse_error = -32700
+	jsonrpc_invalid_request = -32600
+	jsonrpc_method_not_found = -32601
+	jsonrpc_invalid_params = -32602
+	jsonrpc_internal_error = -32603
+	// the method failed, the apollo error code is in data
+	jsonrpc_server_error = -32000
+)
+
+type JsonRpcRequest struct {
+	Version string `json:"jsonrpc"`
+	Method string `json:"method"`
+	Params json.RawMessage `json:"params,omitempty"`
+	// absent on notifications, which get no response, while "id": null is
+	// kept as null and answered
+	Id json.RawMessage `json:"id,omitempty"`
+}
+
+type JsonRpcError struct {
+	Code int `json:"code"`
+	Message string `json:"message"`
+	Data *RpcError `json:"data,omitempty"`
+}
+
+type JsonRpcResponse struct {
+	Version string `json:"jsonrpc"`
+	// null when nil
+	Id json.RawMessage `json:"id"`
+	Result any `json:"result,omitempty"`
+	Error *JsonRpcError `json:"error,omitempty"`
+}
+
+type jsonrpc_codec struct {
+	conn io.ReadWriteCloser
+	decoder *json.Decoder
+	// guards the writes, errors are written outside of the rpc server
+	mu sync.Mutex
+	encoder *json.Encoder
+	seq uint64
+	// id of the pending requests by seq, nil for notifications
+	pending map[uint64]json.RawMessage
+	params json.RawMessage
+}
+
+func new_jsonrpc_codec(conn io.ReadWriteCloser) *jsonrpc_codec {
+	return &jsonrpc_codec{
+		conn: conn,
+		decoder: json.NewDecoder(conn),
+		encoder: json.NewEncoder(conn),
+		pending: map[uint64]json.RawMessage{},
+	}
+}
+
+func (c *jsonrpc_codec) ReadRequestHeader(r *rpc.Request) error {
+	for {
+		var raw json.RawMessage
+		err := c.decoder.Decode(&raw)
+		if err != nil {
+			var syntax_err *json.SyntaxError
+			if errors.As(err, &syntax_err) {
+				// the stream cannot be resynchronized after invalid json
+				c.write_error(nil, jsonrpc_parse_error, "Parse error", nil)
+			}
+			return err
+		}
+		var req JsonRpcRequest
+		err = json.Unmarshal(raw, &req)
+		if err != nil || req.Version != "2.0" || req.Method == "" {
+			c.write_error(nil, jsonrpc_invalid_request, "Invalid Request", nil)
+			continue
+		}
+		method := req.Method
+		if !strings.Contains(method, ".") {
+			method = "MusicManager." + method
+		}
+		c.mu.Lock()
+		c.seq++
+		c.pending[c.seq] = req.Id
+		r.Seq = c.seq
+		c.mu.Unlock()
+		r.ServiceMethod = method
+		c.params = req.Params
+		return nil
+	}
+}
+
+func (c *jsonrpc_codec) ReadRequestBody(x any) error {
+	params := bytes.TrimSpace(c.params)
+	c.params = nil
+	if x == nil || len(params) == 0 || bytes.Equal(params, []byte("null")) {
+		return nil
+	}
+	// ["mix"] is the argument "mix", [1, 2] the argument []int{1, 2}
+	var list []json.RawMessage
+	if json.Unmarshal(params, &list) == nil && len(list) == 1 {
+		if json.Unmarshal(list[0], x) == nil {
+			return nil
+		}
+	}
+	err := json.Unmarshal(params, x)
+	if err != nil {
+		return new_rpc_error(code_invalid, "invalid params: %v", err)
+	}
+	return nil
+}
+
+func (c *jsonrpc_codec) WriteResponse(r *rpc.Response, body any) error {
+	c.mu.Lock()
+	id, found := c.pending[r.Seq]
+	delete(c.pending, r.Seq)
+	c.mu.Unlock()
+	if found && id == nil {
+		return nil
+	}
+	if r.Error == "" {
+		return c.write(JsonRpcResponse{ Version: "2.0", Id: id, Result: body })
+	}
+	// errors of the rpc server itself are not prefixed by an apollo code
+	if strings.HasPrefix(r.Error, "rpc: ") {
+		return c.write_error(id, jsonrpc_method_not_found, r.Error, nil)
+	}
+	rpc_err := as_rpc_error(rpc.ServerError(r.Error))
+	code := jsonrpc_server_error
+	switch rpc_err.Code {
+	case code_invalid:
+		code = jsonrpc_invalid_params
+	case code_internal:
+		code = jsonrpc_internal_error
+	}
+	return c.write_error(id, code, rpc_err.Message, rpc_err)
+}
+
+func (c *jsonrpc_codec) write_error(id json.RawMessage, code int, message string, data *RpcError) error {
+	return c.write(JsonRpcResponse{
+		Version: "2.0",
+		Id: id,
+		Error: &JsonRpcError{ Code: code, Message: message, Data: data },
+	})
+}
+
+func (c *jsonrpc_codec) write(response JsonRpcResponse) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	err := c.encoder.Encode(response)
+	if err != nil {
+		return fmt.Errorf("writing json-rpc response: %v", err)
+	}
+	return nil
+}
+
+func (c *jsonrpc_codec) Close() error {
+	return c.conn.Close()
+}
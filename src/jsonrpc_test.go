@@ -0,0 +1,136 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"net"
+	"testing"
+)
+
+type jsonrpc_client struct {
+	t *testing.T
+	conn net.Conn
+	reader *bufio.Reader
+}
+
+func dial_jsonrpc(t *testing.T, config *Config, handshake string) *jsonrpc_client {
+	t.Helper()
+	conn, err := net.Dial(config.RpcNetwork, config.RpcAddr)
+	if err != nil {
+		t.Fatalf("dial: %v", err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	c := &jsonrpc_client{ t: t, conn: conn, reader: bufio.NewReader(conn) }
+	if handshake != "" {
+		fmt.Fprintf(conn, "%s\n", handshake)
+		if line, _ := c.reader.ReadString('\n'); line != "OK\n" {
+			t.Fatalf("handshake: got %q", line)
+		}
+	}
+	return c
+}
+
+// sends a raw line and decodes the response line.
+func (c *jsonrpc_client) send(line string) JsonRpcResponse {
+	c.t.Helper()
+	fmt.Fprintf(c.conn, "%s\n", line)
+	data, err := c.reader.ReadBytes('\n')
+	if err != nil {
+		c.t.Fatalf("reading response to %s: %v", line, err)
+	}
+	var response struct {
+		JsonRpcResponse
+		Result json.RawMessage `json:"result"`
+	}
+	if err := json.Unmarshal(data, &response); err != nil {
+		c.t.Fatalf("decoding %q: %v", data, err)
+	}
+	response.JsonRpcResponse.Result = response.Result
+	return response.JsonRpcResponse
+}
+
+func TestJsonRpc(t *testing.T) {
+	_, config := setup_test_env(t)
+	run_cmd(config, "sync")
+	start_test_daemon(t, config)
+	c := dial_jsonrpc(t, config, "")
+
+	response := c.send(`{"jsonrpc": "2.0", "id": 1, "method": "MusicManager.Status"}`)
+	var status Status
+	if response.Error != nil || json.Unmarshal(response.Result.(json.RawMessage), &status) != nil {
+		t.Fatalf("Status: %+v", response)
+	}
+	if string(response.Id) != "1" || status.Length != 3 {
+		t.Errorf("Status: id %s, status %+v", response.Id, status)
+	}
+
+	response = c.send(`{"jsonrpc": "2.0", "id": "a", "method": "Next"}`)
+	var reply PlayerReply
+	json.Unmarshal(response.Result.(json.RawMessage), &reply)
+	if response.Error != nil || reply.Action != action_selected || reply.Status.Index != 1 {
+		t.Errorf("Next: %+v", response)
+	}
+
+	response = c.send(`{"jsonrpc": "2.0", "id": 3, "method": "Create", "params": ["mix"]}`)
+	if response.Error != nil {
+		t.Errorf("Create: %+v", response.Error)
+	}
+	c.send(`{"jsonrpc": "2.0", "id": 3, "method": "Play", "params": ["mix"]}`)
+	response = c.send(`{"jsonrpc": "2.0", "id": 3, "method": "Add", "params": [1, 3]}`)
+	var change SongsChange
+	json.Unmarshal(response.Result.(json.RawMessage), &change)
+	if response.Error != nil || len(change.Ids) != 2 {
+		t.Errorf("Add: %+v", response)
+	}
+	response = c.send(`{"jsonrpc": "2.0", "id": 3, "method": "Remove", "params": [3]}`)
+	json.Unmarshal(response.Result.(json.RawMessage), &change)
+	if response.Error != nil || len(change.Ids) != 1 || change.Ids[0] != 3 {
+		t.Errorf("Remove: %+v", response)
+	}
+	response = c.send(`{"jsonrpc": "2.0", "id": 4, "method": "Play", "params": ["nope"]}`)
+	if response.Error == nil || response.Error.Code != jsonrpc_server_error || response.Error.Data.Code != code_not_found {
+		t.Errorf("Play nope: %+v", response)
+	}
+	response = c.send(`{"jsonrpc": "2.0", "id": 5, "method": "Volume", "params": ["loud"]}`)
+	if response.Error == nil || response.Error.Code != jsonrpc_invalid_params {
+		t.Errorf("Volume loud: %+v", response)
+	}
+	response = c.send(`{"jsonrpc": "2.0", "id": 6, "method": "Shuffle"}`)
+	if response.Error == nil || response.Error.Code != jsonrpc_method_not_found {
+		t.Errorf("Shuffle: %+v", response)
+	}
+	response = c.send(`{"id": 7, "method": "Status"}`)
+	if response.Error == nil || response.Error.Code != jsonrpc_invalid_request {
+		t.Errorf("missing version: %+v", response)
+	}
+
+	// notifications get no response, the next line answers the next request
+	response = c.send(`{"jsonrpc": "2.0", "method": "Previous"}` + "\n" + `{"jsonrpc": "2.0", "id": 8, "method": "Status"}`)
+	if string(response.Id) != "8" {
+		t.Errorf("after notification: %+v", response)
+	}
+
+	// a null id is not a notification
+	response = c.send(`{"jsonrpc": "2.0", "id": null, "method": "Status"}`)
+	if response.Error != nil || string(response.Id) != "null" || response.Result == nil {
+		t.Errorf("null id: %+v", response)
+	}
+
+	response = c.send(`{"jsonrpc": }`)
+	if response.Error == nil || response.Error.Code != jsonrpc_parse_error {
+		t.Errorf("invalid json: %+v", response)
+	}
+}
+
+func TestJsonRpcHandshake(t *testing.T) {
+	_, config := setup_test_env(t)
+	start_test_daemon(t, config)
+	c := dial_jsonrpc(t, config, "JSONRPC "+get_client_token(config))
+	response := c.send(`{"jsonrpc": "2.0", "id": 1, "method": "Playlists"}`)
+	if response.Error != nil {
+		t.Errorf("Playlists: %+v", response.Error)
+	}
+	// the go client still gets the gob codec on the same socket
+	expect_output(t, config, "No playlists found", "playlists")
+}
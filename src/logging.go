@@ -0,0 +1,325 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/rpc"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// the log of the daemon: leveled records of log/slog tagged with the
+// subsystem they come from, written as text or json to apollo.log in the
+// state dir, or to stderr in the foreground, and kept in memory for
+// `apollo logs`.
+
+// subsystems tagging the records
+const (
+	log_daemon = "daemon"
+	log_rpc = "rpc"
+	log_player = "player"
+	log_db = "db"
+	log_sync = "sync"
+	log_http = "http"
+	log_mpd = "mpd"
+	log_mpris = "mpris"
+)
+
+// records kept for `apollo logs`
+const log_backlog = 500
+
+var log_level = new(slog.LevelVar)
+var log_records = new_log_buffer()
+
+// where every logger writes, set by setup_log
+var log_root slog.Handler = &log_handler{
+	inner: slog.NewTextHandler(os.Stderr, &slog.HandlerOptions{ Level: log_level }),
+	records: log_records,
+}
+
+// the loggers of the subsystems over log_root, made again when it changes
+var log_loggers = struct {
+	mu sync.Mutex
+	root slog.Handler
+	by_tag map[string]*slog.Logger
+}{}
+
+// the logger of a subsystem
+func logger(tag string) *slog.Logger {
+	log_loggers.mu.Lock()
+	defer log_loggers.mu.Unlock()
+	if log_loggers.root != log_root {
+		log_loggers.root = log_root
+		log_loggers.by_tag = map[string]*slog.Logger{}
+	}
+	l, ok := log_loggers.by_tag[tag]
+	if !ok {
+		l = slog.New(log_root).With("tag", tag)
+		log_loggers.by_tag[tag] = l
+	}
+	return l
+}
+
+// sends the records at the level of the config or above to w.
+func setup_log(config *Config, w io.Writer) {
+	var level slog.Level
+	// checked when the config was read
+	level.UnmarshalText([]byte(config.LogLevel))
+	log_level.Set(level)
+	options := &slog.HandlerOptions{ Level: log_level }
+	var inner slog.Handler = slog.NewTextHandler(w, options)
+	if config.LogFormat == "json" {
+		inner = slog.NewJSONHandler(w, options)
+	}
+	log_root = &log_handler{ inner: inner, records: log_records }
+}
+
+type LogRecord struct {
+	Seq uint64 `json:"seq"`
+	Time time.Time `json:"time"`
+	Level slog.Level `json:"level"`
+	Tag string `json:"tag"`
+	Message string `json:"msg"`
+	// key=value pairs as in the text log
+	Attrs string `json:"attrs,omitempty"`
+}
+
+// writes the records to the log and keeps them for `apollo logs`.
+type log_handler struct {
+	inner slog.Handler
+	records *log_buffer
+	tag string
+	attrs []slog.Attr
+}
+
+func (h *log_handler) Enabled(ctx context.Context, level slog.Level) bool {
+	return h.inner.Enabled(ctx, level)
+}
+
+func (h *log_handler) Handle(ctx context.Context, r slog.Record) error {
+	attrs := slices.Clone(h.attrs)
+	r.Attrs(func(attr slog.Attr) bool {
+		attrs = append(attrs, attr)
+		return true
+	})
+	pairs := []string{}
+	for _, attr := range attrs {
+		value := attr.Value.String()
+		if value == "" || strings.ContainsAny(value, " =\"") {
+			value = strconv.Quote(value)
+		}
+		pairs = append(pairs, attr.Key + "=" + value)
+	}
+	h.records.add(LogRecord{
+		Time: r.Time,
+		Level: r.Level,
+		Tag: h.tag,
+		Message: r.Message,
+		Attrs: strings.Join(pairs, " "),
+	})
+	return h.inner.Handle(ctx, r)
+}
+
+func (h *log_handler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	handler := *h
+	handler.attrs = slices.Clone(h.attrs)
+	for _, attr := range attrs {
+		if attr.Key == "tag" {
+			handler.tag = attr.Value.String()
+		} else {
+			handler.attrs = append(handler.attrs, attr)
+		}
+	}
+	handler.inner = h.inner.WithAttrs(attrs)
+	return &handler
+}
+
+func (h *log_handler) WithGroup(name string) slog.Handler {
+	handler := *h
+	handler.inner = h.inner.WithGroup(name)
+	return &handler
+}
+
+// the last log_backlog records, numbered like the events.
+type log_buffer struct {
+	mu sync.Mutex
+	seq uint64
+	records []LogRecord
+	// closed and replaced on every record, for the followers
+	added chan struct{}
+}
+
+func new_log_buffer() *log_buffer {
+	return &log_buffer{ added: make(chan struct{}) }
+}
+
+func (b *log_buffer) add(record LogRecord) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.seq++
+	record.Seq = b.seq
+	b.records = append(b.records, record)
+	if len(b.records) > log_backlog {
+		b.records = b.records[len(b.records)-log_backlog:]
+	}
+	close(b.added)
+	b.added = make(chan struct{})
+}
+
+// the records after seq at level or above, the last seq and a channel closed
+// on the next record.
+func (b *log_buffer) after(seq uint64, level slog.Level) ([]LogRecord, uint64, chan struct{}) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	records := []LogRecord{}
+	for _, record := range b.records {
+		if record.Seq > seq && record.Level >= level {
+			records = append(records, record)
+		}
+	}
+	return records, b.seq, b.added
+}
+
+type LogsArgs struct {
+	// seq of the last record seen, 0 for all the kept records
+	After uint64
+	Level slog.Level
+	// wait up to max_wait for a record when there is none
+	Follow bool
+}
+
+type LogsReply struct {
+	Records []LogRecord
+	Last uint64
+}
+
+func (d *Daemon) Logs(args LogsArgs, reply *LogsReply) error {
+	timeout := time.NewTimer(max_wait)
+	defer timeout.Stop()
+	for {
+		records, last, added := log_records.after(args.After, args.Level)
+		if len(records) > 0 || !args.Follow {
+			*reply = LogsReply{ Records: records, Last: last }
+			return nil
+		}
+		// the records below the level are skipped for good
+		args.After = last
+		select {
+		case <-added:
+		case <-timeout.C:
+			*reply = LogsReply{ Records: records, Last: last }
+			return nil
+		}
+	}
+}
+
+// prints the records kept by the daemon, following them until it stops with
+// query.Follow.
+func print_logs(w io.Writer, client *rpc.Client, config *Config, query LogsArgs) error {
+	for following := false; ; following = true {
+		var reply LogsReply
+		err := client.Call("Daemon.Logs", query, &reply)
+		// the daemon stopped
+		if following && (errors.Is(err, rpc.ErrShutdown) || errors.Is(err, io.ErrUnexpectedEOF)) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		for _, record := range reply.Records {
+			print_log_record(w, config, record)
+		}
+		if !query.Follow {
+			return nil
+		}
+		query.After = reply.Last
+	}
+}
+
+func print_log_record(w io.Writer, config *Config, record LogRecord) {
+	if config.quiet {
+		return
+	}
+	if config.json_output {
+		json.NewEncoder(w).Encode(record)
+		return
+	}
+	line := fmt.Sprintf("%s %-5s [%s] %s", record.Time.Format("2006-01-02 15:04:05.000"), record.Level, record.Tag, record.Message)
+	if record.Attrs != "" {
+		line += " " + record.Attrs
+	}
+	fmt.Fprintln(w, line)
+}
+
+// a log file rotated when it grows over max_size bytes: apollo.log becomes
+// apollo.log.1, apollo.log.1 becomes apollo.log.2 and so on, keeping
+// max_files old logs.
+type rotating_file struct {
+	mu sync.Mutex
+	path string
+	max_size int64
+	max_files int
+	file *os.File
+	size int64
+}
+
+func open_rotating_file(path string, max_size int64, max_files int) (*rotating_file, error) {
+	f := &rotating_file{ path: path, max_size: max_size, max_files: max_files }
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0640)
+	if err != nil {
+		return nil, err
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+	f.file = file
+	f.size = info.Size()
+	return f, nil
+}
+
+func (f *rotating_file) Write(p []byte) (int, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	// the current file keeps the records when a new one cannot be opened,
+	// rotating again on the next write
+	if f.size > 0 && f.size + int64(len(p)) > f.max_size {
+		f.rotate()
+	}
+	n, err := f.file.Write(p)
+	f.size += int64(n)
+	return n, err
+}
+
+// must be called with f.mu held
+func (f *rotating_file) rotate() error {
+	for i := f.max_files - 1; i >= 1; i-- {
+		os.Rename(fmt.Sprintf("%s.%d", f.path, i), fmt.Sprintf("%s.%d", f.path, i+1))
+	}
+	if f.max_files > 0 {
+		os.Rename(f.path, f.path + ".1")
+	}
+	file, err := os.OpenFile(f.path, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0640)
+	if err != nil {
+		return err
+	}
+	f.file.Close()
+	f.file = file
+	f.size = 0
+	return nil
+}
+
+func (f *rotating_file) Close() error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.file.Close()
+}
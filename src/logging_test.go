@@ -0,0 +1,109 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestSetupLog(t *testing.T) {
+	root, level := log_root, log_level.Level()
+	t.Cleanup(func() {
+		log_root = root
+		log_level.Set(level)
+	})
+	var out bytes.Buffer
+	setup_log(&Config{ LogLevel: "warn", LogFormat: "json" }, &out)
+	if logger(log_db) != logger(log_db) {
+		t.Errorf("a logger is made on every call")
+	}
+	logger(log_db).Info("hidden")
+	logger(log_db).Warn("cannot get the songs", "err", "locked")
+	var record map[string]any
+	if err := json.Unmarshal(out.Bytes(), &record); err != nil {
+		t.Fatalf("log %q: %v", out.String(), err)
+	}
+	if record["level"] != "WARN" || record["tag"] != "db" || record["msg"] != "cannot get the songs" || record["err"] != "locked" {
+		t.Errorf("record: %v", record)
+	}
+}
+
+func TestLogs(t *testing.T) {
+	_, last, _ := log_records.after(0, slog.LevelDebug)
+	logger(log_player).Info("now playing", "path", "/music/one two.wav")
+	logger(log_sync).Warn("no new songs")
+	d := &Daemon{}
+	var reply LogsReply
+	d.Logs(LogsArgs{ After: last, Level: slog.LevelWarn }, &reply)
+	if len(reply.Records) != 1 || reply.Records[0].Tag != log_sync || reply.Records[0].Message != "no new songs" {
+		t.Errorf("records at warn: %+v", reply.Records)
+	}
+	d.Logs(LogsArgs{ After: last, Level: slog.LevelDebug }, &reply)
+	if len(reply.Records) != 2 || reply.Records[0].Attrs != `path="/music/one two.wav"` {
+		t.Errorf("records: %+v", reply.Records)
+	}
+
+	go func() {
+		time.Sleep(20 * time.Millisecond)
+		logger(log_player).Debug("below the level")
+		logger(log_player).Error("cannot decode the song")
+	}()
+	d.Logs(LogsArgs{ After: reply.Last, Level: slog.LevelError, Follow: true }, &reply)
+	if len(reply.Records) != 1 || reply.Records[0].Message != "cannot decode the song" {
+		t.Errorf("followed records: %+v", reply.Records)
+	}
+
+	var out bytes.Buffer
+	print_log_record(&out, &Config{}, reply.Records[0])
+	if !strings.HasSuffix(out.String(), " ERROR [player] cannot decode the song\n") {
+		t.Errorf("printed record: %q", out.String())
+	}
+}
+
+func TestLogsCommand(t *testing.T) {
+	_, config := setup_test_env(t)
+	start_test_daemon(t, config)
+	logger(log_mpd).Warn("cannot listen", "addr", "localhost:6600")
+	expect_output(t, config, "WARN  [mpd] cannot listen addr=localhost:6600\n", "logs", "--level", "warn")
+}
+
+func TestRotatingFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "apollo.log")
+	file, err := open_rotating_file(path, 100, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+	for i := 0; i < 20; i++ {
+		fmt.Fprintf(file, "record %02d of the log\n", i)
+	}
+	for _, name := range []string{ "apollo.log", "apollo.log.1", "apollo.log.2" } {
+		info, err := os.Stat(filepath.Join(filepath.Dir(path), name))
+		if err != nil || info.Size() > 100 {
+			t.Errorf("%s: %v, %v", name, info, err)
+		}
+	}
+	if _, err := os.Stat(path + ".3"); err == nil {
+		t.Errorf("more old logs than log_max_files")
+	}
+	if data, _ := os.ReadFile(path); !strings.HasSuffix(string(data), "record 19 of the log\n") {
+		t.Errorf("apollo.log: %q", data)
+	}
+
+	// the new log cannot be opened, the records go on to the current one
+	file.path = filepath.Join(filepath.Dir(path), "gone", "apollo.log")
+	for i := 20; i < 30; i++ {
+		if _, err := fmt.Fprintf(file, "record %02d of the log\n", i); err != nil {
+			t.Fatalf("writing after a failed rotation: %v", err)
+		}
+	}
+	if data, _ := os.ReadFile(path); !strings.HasSuffix(string(data), "record 29 of the log\n") {
+		t.Errorf("apollo.log after a failed rotation: %q", data)
+	}
+}
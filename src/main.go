@@ -4,20 +4,28 @@ import (
 	"database/sql"
 	"errors"
 	"fmt"
-	"io/fs"
+	"io"
+	"log/slog"
+	"math"
 	"net"
+	"net/http"
 	"net/rpc"
 	"os"
+	"os/signal"
 	"path/filepath"
 	"slices"
 	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
 	"time"
 
+	"github.com/godbus/dbus/v5"
 	"github.com/gopxl/beep"
 	"github.com/gopxl/beep/effects"
-	"github.com/gopxl/beep/speaker"
 	"github.com/gopxl/beep/vorbis"
+	"github.com/gopxl/beep/wav"
 	"github.com/sevlyar/go-daemon"
 )
 
@@ -33,62 +41,219 @@ type Music struct {
 	path string
 }
 
+// RPC calls are served concurrently, every field below mu is only accessed
+// while holding it, by the RPC methods and by the play_playlist goroutine.
 type MusicManager struct {
+	config *Config
+	db *sql.DB
+	output Output
+	// what is played, for the /live listeners
+	live *live_stream
+	events *event_bus
+
+	mu sync.Mutex
 	playlist Playlist
 	playing bool
 	current int
 	paused bool
-	config *Config
-	db *sql.DB
-
-	// channels
-	toggle chan bool
-	volume chan float64
-	done chan bool
+	volume float64
+	// closed to stop the running play_playlist goroutine
+	stop chan struct{}
+	// controls of the song being played, also read by the output
+	ctrl *beep.Ctrl
+	vol *effects.Volume
+	// the decoded song, for its position
+	song beep.StreamSeekCloser
+	format beep.Format
+	// seconds into the first song played after a restored session
+	resume_at float64
+	// set by shutdown, the session is no longer saved
+	closed bool
 }
 
 type Daemon struct {
 	context *daemon.Context
+	// pid file of the daemon run in the foreground
+	pid_file *daemon.LockFile
+	stopping atomic.Bool
+	// the rpc connections being served
+	conns sync.WaitGroup
 	network string
+	listener net.Listener
+	server *rpc.Server
+	// serves the http api when http_addr is set
+	http *http.Server
+	// speaks the mpd protocol when mpd_addr is set
+	mpd net.Listener
+	// connection to the session bus when mpris is set
+	mpris *dbus.Conn
 	config *Config
+	// token required from connections when auth is set
+	token string
+	auth bool
 }
 
 
 func main() {
-	cmd, args := parse_cmds()
+	opts, argv := parse_flags(os.Args[1:])
+	config := get_config(opts)
+	// the cli only shows the warnings and errors of the log
+	setup_log(config, os.Stderr)
+	if log_level.Level() < slog.LevelWarn {
+		log_level.Set(slog.LevelWarn)
+	}
+	cmd, args := parse_cmds(argv, config)
 
-	config := get_config()
-	dmon := Daemon{ network: "tcp", config: config }
-	if (cmd != "start") {
-		handle_daemon(&dmon, cmd, args)
+	if cmd == "config" {
+		handle_config(config, args)
+		return
+	}
+	if cmd == "service" {
+		if err := install_service(os.Stdout, config); err != nil {
+			print_error(os.Stderr, config, err)
+			os.Exit(exit_status(err))
+		}
 		return
 	}
-	dmon.context = &daemon.Context {
-		PidFileName: "/tmp/apollo.pid",
-		PidFilePerm: 0644,
-		LogFileName: "/tmp/apollo.log",
-		LogFilePerm: 0640,
-		WorkDir:     "./",
-		Umask:       027,
+	if cmd == "completion" {
+		fmt.Print(completion_scripts[args[0].(string)])
+		return
 	}
-	process, err := dmon.context.Reborn()
-	if err != nil {
+	if cmd == "__complete" {
+		words := []string{}
+		for _, arg := range args {
+			words = append(words, arg.(string))
+		}
+		handle_complete(os.Stdout, words)
 		return
 	}
-
-	if process != nil {
-		fmt.Printf("Starting Apollo...\n")
+	if cmd == "tui" || cmd == "shell" {
+		run := run_tui
+		if cmd == "shell" {
+			run = run_shell
+		}
+		if err := run(config); err != nil {
+			print_error(os.Stderr, config, err)
+			os.Exit(exit_status(err))
+		}
 		return
 	}
+	dmon := Daemon{ network: config.RpcNetwork, config: config }
+	var err error
+	if (cmd != "start") {
+		if err := handle_daemon(os.Stdout, &dmon, cmd, args); err != nil {
+			print_error(os.Stderr, config, err)
+			os.Exit(exit_status(err))
+		}
+		return
+	}
+	get_dir(config.RuntimeDir, 0700, config.quiet)
+	get_dir(config.StateDir, 0755, config.quiet)
+	dmon.auth = config.RpcNetwork == "tcp" && config.RpcAuth
+	dmon.token, err = get_token(config)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Apollo Error: cannot get the rpc token: %v\n", err)
+		os.Exit(exit_failure)
+	}
+	pid_filepath := filepath.Join(config.RuntimeDir, "apollo.pid")
+	// the daemon started by Reborn inherits the locked pid file
+	if !daemon.WasReborn() {
+		if err := check_pid_file(pid_filepath); err != nil {
+			fmt.Fprintf(os.Stderr, "Apollo Error: cannot start the daemon: %v\n", err)
+			os.Exit(exit_failure)
+		}
+	}
+	if config.foreground {
+		// all the daemon prints is its log
+		os.Stdout = os.Stderr
+		dmon.pid_file, err = lock_pid_file(pid_filepath)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Apollo Error: cannot start the daemon: %v\n", err)
+			os.Exit(exit_failure)
+		}
+	} else {
+		dmon.context = &daemon.Context {
+			PidFileName: pid_filepath,
+			PidFilePerm: 0644,
+			// what the daemon writes outside of its log, like a panic
+			LogFileName: filepath.Join(config.StateDir, "crash.log"),
+			LogFilePerm: 0640,
+			WorkDir:     "./",
+			Umask:       027,
+		}
+		process, err := dmon.context.Reborn()
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Apollo Error: cannot start the daemon: %v\n", err)
+			os.Exit(exit_failure)
+		}
+		if process != nil {
+			if !config.quiet {
+				fmt.Printf("Starting Apollo...\n")
+			}
+			return
+		}
+	}
+	if err := run_daemon(&dmon, config, args); err != nil {
+		os.Exit(exit_failure)
+	}
+}
 
-	defer dmon.context.Release()
+// runs the daemon until it stops, the error it fails with is in its log.
+func run_daemon(dmon *Daemon, config *Config, args []any) error {
+	defer dmon.release()
+	if config.foreground {
+		setup_log(config, os.Stderr)
+	} else {
+		log_file, err := open_rotating_file(filepath.Join(config.StateDir, "apollo.log"), int64(config.LogMaxSize * (1 << 20)), config.LogMaxFiles)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Apollo Error: cannot open the log: %v\n", err)
+			return err
+		}
+		defer log_file.Close()
+		setup_log(config, log_file)
+	}
 
-	db, err := get_db()
+	db, err := get_db(config.DataDir, config.quiet)
 	if err != nil {
-		fmt.Printf("Error getting db: %v\n", err)
-		return
+		logger(log_db).Error("cannot open the database", "err", err)
+		return err
 	}
 	defer db.Close()
+
+	output, err := new_output(config)
+	if err != nil {
+		logger(log_player).Error("cannot open the output", "output", config.Output, "err", err)
+		return err
+	}
+	defer output.Close()
+
+	manager := new_manager(config, db, output, args)
+	if config.Resume && len(args) == 0 {
+		if session, err := load_session(config); err == nil {
+			if err := manager.restore(session); err != nil {
+				logger(log_player).Error("cannot resume the session", "err", err)
+			}
+		} else if !os.IsNotExist(err) {
+			logger(log_player).Error("cannot read the session", "err", err)
+		}
+	}
+	go manager.keep_session()
+	start_http(dmon, manager)
+	start_mpd(dmon, manager)
+	start_mpris(dmon, manager)
+	if err := start_rpc(dmon, manager); err != nil {
+		dmon.shutdown()
+		manager.shutdown(0)
+		return err
+	}
+	manager.shutdown(fade_duration)
+	dmon.wait_conns(time.Second)
+	return nil
+}
+
+// the songs given on start make up the "Unlisted" playlist, without them
+// all songs in the database are played.
+func new_manager(config *Config, db *sql.DB, output Output, args []any) *MusicManager {
 	playlist := Playlist{
 		id: 0,
 		name: "Unlisted",
@@ -106,20 +271,16 @@ func main() {
 		playlist.name = "All Songs"
 	}
 
-	manager := MusicManager{
+	return &MusicManager{
 		playlist: playlist,
 		config: config,
+		output: output,
+		live: new_live_stream(),
+		events: new_event_bus(),
 		current: 0,
 		playing: false,
-		toggle: make(chan bool),
-		volume: make(chan float64),
-		done: make(chan bool),
 		db: db,
 	}
-
-	start_rpc(&dmon, &manager)
-	// start_musicplayer()
-	// start_http()
 }
 
 func (p *Playlist) length() int {
@@ -142,317 +303,787 @@ func (p *Playlist) remove(song_ids []int) {
 	p.songs = new_songs
 }
 
+// must be called with m.mu held
 func (m *MusicManager) current_song() *Music {
 	return &m.playlist.songs[m.current]
 }
 
+// replies before the daemon shuts down like on SIGTERM.
 func (d *Daemon) Kill(args string, reply *string) error {
 	*reply = "Daemon Killed"
-	d.context.Release()
+	go d.shutdown()
+	return nil
+}
+
+// stops serving on a signal or kill, start_rpc returns and main closes the
+// rest.
+func (d *Daemon) shutdown() {
+	if !d.stopping.CompareAndSwap(false, true) {
+		return
+	}
+	logger(log_daemon).Info("shutting down")
+	sd_notify("STOPPING=1")
+	// nil when start_rpc could not listen
+	if d.listener != nil {
+		d.listener.Close()
+	}
+	if d.http != nil {
+		d.http.Close()
+	}
+	if d.mpd != nil {
+		d.mpd.Close()
+	}
+	if d.mpris != nil {
+		d.mpris.Close()
+	}
 	save_config(d.config)
-	os.Exit(0)
+}
+
+// waits for the clients to hang up, the one that sent kill does once it has
+// the reply.
+func (d *Daemon) wait_conns(timeout time.Duration) {
+	done := make(chan struct{})
+	go func() {
+		d.conns.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(timeout):
+	}
+}
+
+// fails when a daemon holds the pid file, a file left by a daemon that did
+// not exit cleanly is removed.
+func check_pid_file(path string) error {
+	if _, err := os.Stat(path); err != nil {
+		return nil
+	}
+	lock, err := daemon.OpenLockFile(path, 0644)
+	if err != nil {
+		return err
+	}
+	pid, _ := lock.ReadPid()
+	if err := lock.Lock(); err != nil {
+		lock.Close()
+		return fmt.Errorf("Apollo is already running with pid %d", pid)
+	}
+	fmt.Fprintf(os.Stderr, "Apollo: Removing the stale pid file of pid %d\n", pid)
+	return lock.Remove()
+}
+
+// the pid of the daemon holding the pid file, 0 when none does.
+func running_pid(path string) int {
+	if _, err := os.Stat(path); err != nil {
+		return 0
+	}
+	lock, err := daemon.OpenLockFile(path, 0644)
+	if err != nil {
+		return 0
+	}
+	defer lock.Close()
+	if err := lock.Lock(); err == nil {
+		lock.Unlock()
+		return 0
+	}
+	pid, _ := lock.ReadPid()
+	return pid
+}
+
+// creates and locks the pid file. daemon.CreatePidFile is not used, it
+// removes the file of the running daemon when it cannot lock it.
+func lock_pid_file(path string) (*daemon.LockFile, error) {
+	lock, err := daemon.OpenLockFile(path, 0644)
+	if err != nil {
+		return nil, err
+	}
+	if err := lock.Lock(); err != nil {
+		lock.Close()
+		return nil, fmt.Errorf("Apollo is already running")
+	}
+	if err := lock.WritePid(); err != nil {
+		lock.Remove()
+		return nil, err
+	}
+	return lock, nil
+}
+
+// removes the pid file
+func (d *Daemon) release() {
+	if d.context != nil {
+		d.context.Release()
+	}
+	if d.pid_file != nil {
+		d.pid_file.Remove()
+	}
+}
+
+// must be called with m.mu held
+func (m *MusicManager) status() Status {
+	status := Status{
+		PlaylistId: m.playlist.id,
+		Playlist: m.playlist.name,
+		Length: m.playlist.length(),
+		Index: m.current,
+		Playing: m.playing,
+		Paused: m.paused,
+		Volume: m.volume,
+		Loop: m.config.Loop,
+	}
+	if m.current < m.playlist.length() {
+		song := to_song(*m.current_song())
+		status.Song = &song
+	}
+	if m.playing && m.song != nil {
+		m.output.Lock()
+		status.Position = m.format.SampleRate.D(m.song.Position()).Seconds()
+		status.Duration = m.format.SampleRate.D(m.song.Len()).Seconds()
+		m.output.Unlock()
+	}
+	return status
+}
+
+// must be called with m.mu held
+func (m *MusicManager) player_reply(action string) PlayerReply {
+	return PlayerReply{ Action: action, Status: m.status() }
+}
+
+func (m *MusicManager) Status(args string, reply *Status) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	*reply = m.status()
 	return nil
 }
 
-func (m *MusicManager) Play(args string, reply *string) error {
-	if args != "" && args != m.playlist.name {
-		playlist, err := get_playlist(m.db, args)
-		if err != nil {
-			fmt.Printf("Error: getting playlist from db: %v\n", err)
-			return fmt.Errorf("Error: getting playlist from db: %v\n", err)
-		}
-		// stops current playlist
-		if m.playing {
-			m.playing = false
-			m.toggle <-true
-			m.done <-true
-		}
-		// resets playlist index and sets the new playlist
-		*reply = fmt.Sprintf("Switching playlist to '%s'\n", playlist.name)
-		m.current = 0
-		m.playlist = playlist
+func (m *MusicManager) Play(args string, reply *PlayerReply) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	switched, err := m.switch_playlist(args)
+	if err != nil {
+		return err
 	}
 	if !m.playing {
+		// the playlist ended without looping
+		if m.current >= m.playlist.length() {
+			m.current = 0
+		}
 		if m.playlist.length() == 0 {
-			*reply = fmt.Sprintf("%sCan't play '%s', has 0 songs", *reply, m.playlist.name)
-			return nil
+			return new_rpc_error(code_empty, "Can't play '%s', has 0 songs", m.playlist.name)
 		}
-		*reply = *reply + "Playing Song: " + m.current_song().title
-		go m.play_playlist()
+		m.start_playlist()
+		*reply = m.player_reply(action_started)
+	} else if m.paused {
+		m.set_paused(false)
+		*reply = m.player_reply(action_resumed)
 	} else {
-		if m.paused == true {
-			m.toggle <-false
-			*reply = fmt.Sprintf("Unpausing '%s'", m.playlist.name)
-		}
-		*reply = "Already Playing song...."
+		*reply = m.player_reply(action_already_playing)
 	}
+	reply.Switched = switched
 	return nil
 }
 
-func (m *MusicManager) Clean(args string, reply *string) error {
+// stops the current playlist and switches to the named one, unless it is
+// already the current one. Must be called with m.mu held.
+func (m *MusicManager) switch_playlist(name string) (bool, error) {
+	if name == "" || name == m.playlist.name {
+		return false, nil
+	}
+	playlist, err := get_playlist(m.db, name)
+	if err != nil {
+		logger(log_player).Warn("cannot switch the playlist", "playlist", name, "err", err)
+		return false, new_rpc_error(code_not_found, "getting playlist '%s' from db: %v", name, err)
+	}
+	// stops current playlist
+	m.stop_playlist()
+	// resets playlist index and sets the new playlist
+	m.current = 0
+	m.playlist = playlist
+	m.emit(event_playlist_switched)
+	return true, nil
+}
+
+func (m *MusicManager) Clean(args string, reply *CleanReply) error {
 	changes := clean_musics(m.db)
-	*reply = fmt.Sprintf("Cleaned %d item(s) in the database", changes)
+	*reply = CleanReply{ Removed: int(changes) }
+	return nil
+}
+
+func (m *MusicManager) Broken(args string, reply *BrokenReply) error {
+	songs, err := list_broken(m.db)
+	if err != nil {
+		return new_rpc_error(code_internal, "%v", err)
+	}
+	*reply = BrokenReply{ Songs: songs }
 	return nil
 }
 
-func (m *MusicManager) Stop(args string, reply *string) error {
+func (m *MusicManager) Stop(args string, reply *PlayerReply) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
 	if m.playing {
-		m.playing = false
-		m.toggle <-true
-		m.done <-true
-		*reply = fmt.Sprintf("Stopping at index: %d", m.current)
+		m.stop_playlist()
+		*reply = m.player_reply(action_stopped)
+		m.emit(event_stopped)
 	} else {
-		*reply = "Apollo is not playing anything..."
+		*reply = m.player_reply(action_not_playing)
 	}
 	return nil
 }
 
-func (m *MusicManager) Previous(args string, reply *string) error {
+func (m *MusicManager) Previous(args string, reply *PlayerReply) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
 	if m.playlist.length() == 0 {
-		return errors.New("No songs in playlist")
+		return new_rpc_error(code_empty, "No songs in playlist")
 	}
 	if m.current == 0 || m.current >= m.playlist.length() {
 		m.current = m.playlist.length() - 1
 	} else {
 		m.current--
 	}
-	*reply = fmt.Sprintf("Previous with index: %d\b", m.current)
 	if m.playing {
-		m.playing = false
-		m.toggle <-true
-		m.done <-true
-		go m.play_playlist()
+		m.stop_playlist()
+		m.start_playlist()
+		*reply = m.player_reply(action_skipped)
+	} else {
+		*reply = m.player_reply(action_selected)
 	}
 	return nil
 
 }
 
-func (m *MusicManager) Playlist(args string, reply *string) error {
-	if m.playlist.length() == 0 {
-		*reply = fmt.Sprintf("Playlist: [%d] %s\nNo songs", m.playlist.id ,m.playlist.name)
-	} else {
-		*reply = fmt.Sprintf("Playlist: [%d] %s\n", m.playlist.id, m.playlist.name)
-		for i, song := range m.playlist.songs {
-			title := song.title
-			if i == m.current {
-				title = title + " <- [Selected]"
-			}
-			row := fmt.Sprintf("%d. %s\n", i+1, title)
-			*reply = *reply + row
-		}
+// plays the song at the index of the playlist.
+func (m *MusicManager) Jump(args int, reply *PlayerReply) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if args < 0 || args >= m.playlist.length() {
+		return new_rpc_error(code_invalid, "no song at index %d of '%s'", args, m.playlist.name)
 	}
+	m.stop_playlist()
+	m.current = args
+	m.start_playlist()
+	*reply = m.player_reply(action_started)
 	return nil
 }
 
-func (m *MusicManager) Next(args string, reply *string) error {
+func (m *MusicManager) Playlist(args string, reply *PlaylistReply) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	*reply = PlaylistReply{
+		Id: m.playlist.id,
+		Name: m.playlist.name,
+		Current: m.current,
+		Songs: to_songs(m.playlist.songs),
+	}
+	return nil
+}
+
+func (m *MusicManager) Next(args string, reply *PlayerReply) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
 	if m.playlist.length() == 0 {
-		return errors.New("No songs in playlist")
+		return new_rpc_error(code_empty, "No songs in playlist")
+	}
+	m.current++
+	if m.playlist.length() <= m.current {
+		m.current = 0
 	}
 	if m.playing {
-		m.toggle <-true
-		m.done <-true
-		m.toggle <-false
-		*reply = "Going next"
+		m.stop_playlist()
+		m.start_playlist()
+		*reply = m.player_reply(action_skipped)
 	} else{
-		m.current++
-		if m.playlist.length() <= m.current {
-			m.current = 0
-		}
-		*reply = fmt.Sprintf("Next with index: %d", m.current)
+		*reply = m.player_reply(action_selected)
 	}
 	return nil
 }
 
-func (m *MusicManager) Toggle(args string, reply *string) error {
-	if m.playing {
-		*reply = "Song Toggled!"
-		m.toggle <-!m.paused
+func (m *MusicManager) Toggle(args string, reply *PlayerReply) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if !m.playing {
+		*reply = m.player_reply(action_not_playing)
 		return nil
 	}
-	*reply = "No Song Playing..."
+	m.set_paused(!m.paused)
+	if m.paused {
+		*reply = m.player_reply(action_paused)
+	} else {
+		*reply = m.player_reply(action_resumed)
+	}
 	return nil
 }
 
-func (m *MusicManager) Volume(args float64, reply *string) error {
-	if m.playing {
-		*reply = fmt.Sprintf("Setting volume to %g\n", args)
-		m.volume <-args
+func (m *MusicManager) Volume(args float64, reply *PlayerReply) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if !m.playing {
+		*reply = m.player_reply(action_not_playing)
 		return nil
 	}
-	*reply = "No Song Playing..."
+	m.volume += args
+	if m.vol != nil {
+		m.output.Lock()
+		m.vol.Volume = m.volume
+		m.output.Unlock()
+	}
+	*reply = m.player_reply(action_volume)
+	reply.Change = args
+	m.emit(event_volume_changed)
 	return nil
 }
 
-func (m *MusicManager) List(args string, reply *string) error {
-	*reply = list_musics(m.db)
+// the volume is a power of 2 where 0 plays the song as it is, other players
+// use a factor of the amplitude.
+func linear_volume(volume float64) float64 {
+	return math.Pow(2, volume)
+}
+
+func from_linear_volume(factor float64) float64 {
+	if factor <= 0 {
+		// not silent but close enough
+		return -10
+	}
+	return math.Log2(factor)
+}
+
+// moves the position in the current song by args seconds, within the song.
+func (m *MusicManager) Seek(args float64, reply *PlayerReply) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if !m.playing || m.song == nil {
+		*reply = m.player_reply(action_not_playing)
+		return nil
+	}
+	m.output.Lock()
+	position := m.song.Position() + m.format.SampleRate.N(time.Duration(args * float64(time.Second)))
+	position = min(max(position, 0), m.song.Len() - 1)
+	err := m.song.Seek(position)
+	m.output.Unlock()
+	if err != nil {
+		return new_rpc_error(code_internal, "cannot seek: %v", err)
+	}
+	*reply = m.player_reply(action_seeked)
 	return nil
 }
 
-func (m *MusicManager) Sync(args string, reply *string) error {
+func (m *MusicManager) List(args string, reply *LibraryReply) error {
+	*reply = LibraryReply{ Songs: to_songs(get_all_songs(m.db)) }
+	return nil
+}
+
+func (m *MusicManager) Sync(args string, reply *SyncReply) error {
 	var err error
 	*reply, err = sync_musics(m.db, args, m.config.MusicDir)
-	return err
+	if err != nil {
+		return new_rpc_error(code_invalid, "%v", err)
+	}
+	m.mu.Lock()
+	event := m.new_event(event_library_synced)
+	m.mu.Unlock()
+	sync := *reply
+	event.Sync = &sync
+	m.events.publish(event)
+	return nil
 }
 
-func (m *MusicManager) Create(args string, reply *string) error {
-	var err error
-	*reply, err = create_playlist(m.db, args)
-	return err
+func (m *MusicManager) Create(args string, reply *PlaylistChange) error {
+	created, err := create_playlist(m.db, args)
+	if err != nil {
+		return new_rpc_error(code_internal, "%v", err)
+	}
+	*reply = PlaylistChange{ Name: args, Changed: created }
+	return nil
 }
 
-func (m *MusicManager) Delete(args string, reply *string) error {
+func (m *MusicManager) Delete(args string, reply *PlaylistChange) error {
+	deleted, err := delete_playlist(m.db, args)
+	if err != nil {
+		return new_rpc_error(code_internal, "%v", err)
+	}
+	*reply = PlaylistChange{ Name: args, Changed: deleted }
+	return nil
+}
+
+func (m *MusicManager) Playlists(args string, reply *PlaylistsReply) error {
+	playlists, err := list_playlist(m.db)
+	if err != nil {
+		return new_rpc_error(code_internal, "%v", err)
+	}
+	*reply = PlaylistsReply{ Playlists: playlists }
+	return nil
+}
+
+func (m *MusicManager) Add(args []int, reply *SongsChange) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
 	var err error
-	*reply, err = delete_playlist(m.db, args)
+	*reply, err = edit_songs(m.db, &m.playlist, args, false)
 	return err
 }
 
-func (m *MusicManager) Playlists(args string, reply *string) error {
+func (m *MusicManager) Remove(args []int, reply *SongsChange) error {
+	// TODO: if playing, stop
+	m.mu.Lock()
+	defer m.mu.Unlock()
 	var err error
-	*reply, err = list_playlist(m.db)
+	*reply, err = edit_songs(m.db, &m.playlist, args, true)
 	return err
 }
 
-func (m *MusicManager) Add(args []int, reply *string) error {
-	var err error
-	songs, err := add_songs(m.db ,m.playlist.id, args)
-	if err != nil {
-		*reply = fmt.Sprintf("Error: adding songs to playlist:%v", err)
-		return fmt.Errorf("%s", *reply)
+// adds or removes songs of the named playlist, which is the current one or
+// one only in the database.
+func (m *MusicManager) edit_playlist(name string, ids []int, remove bool) (SongsChange, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if name == m.playlist.name {
+		return edit_songs(m.db, &m.playlist, ids, remove)
 	}
-	if len(songs) == 0 {
-		*reply = fmt.Sprintf("Songs provided are already in the playlist")
-		return nil
+	playlist, err := get_playlist(m.db, name)
+	if err != nil {
+		return SongsChange{}, new_rpc_error(code_not_found, "playlist '%s' does not exist", name)
 	}
-	m.playlist.add(songs)
-	*reply = fmt.Sprintf("Added %d song(s) to '%s' playlist", len(songs), m.playlist.name)
-	return nil
+	return edit_songs(m.db, &playlist, ids, remove)
 }
 
-func (m *MusicManager) Remove(args []int, reply *string) error {
-	// TODO: if playing, stop
-	var err error
-	song_ids, err := remove_songs(m.db ,m.playlist.id, args)
+func edit_songs(db *sql.DB, playlist *Playlist, ids []int, remove bool) (SongsChange, error) {
+	change := SongsChange{ Playlist: playlist.name, Ids: []int{} }
+	if remove {
+		song_ids, err := remove_songs(db, playlist.id, ids)
+		if err != nil {
+			return change, new_rpc_error(code_invalid, "removing songs from playlist: %v", err)
+		}
+		playlist.remove(song_ids)
+		change.Ids = song_ids
+		return change, nil
+	}
+	songs, err := add_songs(db, playlist.id, ids)
 	if err != nil {
-		*reply = fmt.Sprintf("Error: removing songs to playlist:%v", err)
-		return fmt.Errorf("%s", *reply)
+		return change, new_rpc_error(code_invalid, "adding songs to playlist: %v", err)
 	}
-	if len(song_ids) == 0 {
-		*reply = fmt.Sprintf("Songs provided are not in the playlist")
-		return nil
+	playlist.add(songs)
+	for _, song := range songs {
+		change.Ids = append(change.Ids, song.id)
 	}
-	m.playlist.remove(song_ids)
-	*reply = fmt.Sprintf("Deleted %d song(s) from '%s' playlist", len(song_ids), m.playlist.name)
-	return nil
+	return change, nil
 }
 
-func start_rpc(d *Daemon, m *MusicManager) {
-	rpc.RegisterName("MusicManager", m)
-	rpc.RegisterName("Daemon", d)
-	listener, err := net.Listen(d.network, d.config.RpcPort)
+func start_rpc(d *Daemon, m *MusicManager) error {
+	listener, err := activated_listener(sd_listen_fds_start)
+	if listener == nil && err == nil {
+		listener, err = listen_rpc(d.network, d.config.RpcAddr)
+	}
 	if err != nil {
-		panic(err)
+		logger(log_daemon).Error("cannot listen", "network", d.network, "addr", d.config.RpcAddr, "err", err)
+		sd_notify_error(err)
+		return err
 	}
-	fmt.Printf("Apollo Started!\n")
+	d.listener = listener
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGTERM, syscall.SIGINT)
+	go func() {
+		sig := <-signals
+		logger(log_daemon).Info("received a signal", "signal", sig.String())
+		d.shutdown()
+	}()
+	logger(log_daemon).Info("started", "network", d.network, "addr", d.config.RpcAddr)
+	sd_notify("READY=1")
+	serve_rpc(d, m)
+	return nil
+}
+
+// serves connections on d.listener until it is closed.
+func serve_rpc(d *Daemon, m *MusicManager) {
+	d.server = rpc.NewServer()
+	d.server.RegisterName("MusicManager", m)
+	d.server.RegisterName("Daemon", d)
 	for {
-		conn, err:= listener.Accept()
+		conn, err:= d.listener.Accept()
+		if errors.Is(err, net.ErrClosed) {
+			return
+		}
 		if err != nil {
 			continue
 		}
-		go rpc.ServeConn(conn)
+		// added before the goroutine starts, wait_conns cannot miss it
+		d.conns.Add(1)
+		go d.serve_conn(conn)
 	}
 }
 
-// TODO: support other formats
-func (m *MusicManager) play_playlist() {
-	if m.playlist.length() == 0 {
-		fmt.Printf("No songs in playlist\n")
-		return
+// the unix socket is only accessible by the user running the daemon.
+func listen_rpc(network string, addr string) (net.Listener, error) {
+	if network == "unix" {
+		// a socket left by a daemon that did not exit cleanly blocks listening
+		if conn, err := net.Dial(network, addr); err == nil {
+			conn.Close()
+			return nil, fmt.Errorf("Apollo is already listening on %s: %w", addr, syscall.EADDRINUSE)
+		}
+		os.Remove(addr)
 	}
-	m.paused = false
+	listener, err := net.Listen(network, addr)
+	if err != nil {
+		return nil, err
+	}
+	if network == "unix" {
+		err = os.Chmod(addr, 0600)
+		if err != nil {
+			listener.Close()
+			return nil, err
+		}
+	}
+	return listener, nil
+}
+
+// starts playing from the current song, must be called with m.mu held.
+func (m *MusicManager) start_playlist() {
+	m.stop = make(chan struct{})
 	m.playing = true
-	fmt.Printf("Playlist Playing...!\n")
-	for m.playing && m.current < m.playlist.length() {
-		file_path := m.current_song().path
+	m.paused = false
+	go m.play_playlist(m.stop)
+}
+
+// stops the running playlist, must be called with m.mu held. The output is
+// cleared here so a playlist started right after is not affected.
+func (m *MusicManager) stop_playlist() {
+	if m.stop != nil {
+		close(m.stop)
+		m.stop = nil
+	}
+	m.playing = false
+	m.paused = false
+	m.ctrl = nil
+	m.vol = nil
+	m.song = nil
+	m.resume_at = 0
+	m.output.Clear()
+}
+
+// how long the music fades out when the daemon stops
+const fade_duration = 300 * time.Millisecond
+
+// saves the session and fades the music out before stopping, so it is not
+// cut mid-buffer.
+func (m *MusicManager) shutdown(fade time.Duration) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.closed = true
+	if err := save_session(m.config, m.session()); err != nil {
+		logger(log_player).Error("cannot save the session", "err", err)
+	}
+	if !m.playing {
+		return
+	}
+	if !m.paused && m.vol != nil {
+		const steps = 10
+		for i := 1; i <= steps; i++ {
+			m.output.Lock()
+			// 10 halvings of the volume is close to silence
+			m.vol.Volume = m.volume - 10 * float64(i) / steps
+			m.output.Unlock()
+			time.Sleep(fade / steps)
+		}
+	}
+	m.stop_playlist()
+	m.emit(event_stopped)
+}
+
+// must be called with m.mu held
+func (m *MusicManager) set_paused(paused bool) {
+	m.paused = paused
+	if m.ctrl != nil {
+		m.output.Lock()
+		m.ctrl.Paused = paused
+		m.output.Unlock()
+	}
+	if paused {
+		m.emit(event_paused)
+	} else {
+		m.emit(event_resumed)
+	}
+}
+
+func stopped(stop chan struct{}) bool {
+	select {
+	case <-stop:
+		return true
+	default:
+		return false
+	}
+}
+
+// plays the songs of the playlist until it ends or stop is closed. The state
+// is only changed while stop is still open, after it is closed the state
+// belongs to whoever closed it.
+func (m *MusicManager) play_playlist(stop chan struct{}) {
+	logger(log_player).Debug("playlist started")
+	// unplayable songs in a row
+	failures := 0
+	for {
+		m.mu.Lock()
+		if stopped(stop) {
+			m.mu.Unlock()
+			return
+		}
+		if m.current >= m.playlist.length() {
+			m.playing = false
+			m.stop = nil
+			m.emit(event_stopped)
+			m.mu.Unlock()
+			break
+		}
+		song := *m.current_song()
+		m.mu.Unlock()
 
-		file, err := os.Open(file_path)
+		played, err := m.play_song(song.path, stop)
+		if err == nil && !played {
+			return
+		}
 		if err != nil {
-			fmt.Printf("Failed to open file %s: not a valid format\n", file_path)
-			panic(err)
+			logger(log_player).Warn("skipping an unplayable song", "path", song.path, "err", err)
+			if m.config.MarkBroken {
+				if err := mark_broken(m.db, song.path, err.Error()); err != nil {
+					logger(log_db).Error("cannot flag the song as broken", "path", song.path, "err", err)
+				}
+			}
 		}
-		defer file.Close()
 
-		streamer, format, err := vorbis.Decode(file)
+		m.mu.Lock()
+		if stopped(stop) {
+			m.mu.Unlock()
+			return
+		}
 		if err != nil {
-			fmt.Printf("Failed to decode file %s: not a valid format\n", file_path)
-			panic(err)
-		}
-		defer streamer.Close()
-
-		fmt.Printf("Now Playing: %s\n", file_path)
-		m.play_song(streamer, format)
-		if m.playing {
-			fmt.Printf("Incrementing current index: %d -> %d\n", m.current, m.current+1)
-			m.current++
-			if m.config.Loop && m.playlist.length() <= m.current {
-				m.current = 0
+			failures++
+			// meant for the song that failed
+			m.resume_at = 0
+			event := m.new_event(event_track_skipped)
+			event.Error = err.Error()
+			m.events.publish(event)
+			// a full round of failures would loop forever
+			if (m.config.MaxSkips > 0 && failures >= m.config.MaxSkips) || failures >= m.playlist.length() {
+				logger(log_player).Error("stopping after unplayable songs", "count", failures)
+				m.playing = false
+				m.stop = nil
+				m.emit(event_stopped)
+				m.mu.Unlock()
+				break
 			}
+		} else {
+			failures = 0
+			m.emit(event_track_ended)
+		}
+		logger(log_player).Debug("next song", "index", m.current+1)
+		m.current++
+		if m.config.Loop && m.playlist.length() <= m.current {
+			m.current = 0
 		}
+		m.mu.Unlock()
 	}
-	m.playing = false
-	fmt.Printf("Playlist stopped!\n")
+	logger(log_player).Debug("playlist stopped")
+}
+
+// TODO: support other formats
+var decoders = map[string]func(file *os.File) (beep.StreamSeekCloser, beep.Format, error){
+	".ogg": func(file *os.File) (beep.StreamSeekCloser, beep.Format, error) {
+		return vorbis.Decode(file)
+	},
+	".wav": func(file *os.File) (beep.StreamSeekCloser, beep.Format, error) {
+		return wav.Decode(file)
+	},
 }
 
-func (m *MusicManager) play_song(s beep.StreamSeekCloser, format beep.Format) {
-	speaker.Init(format.SampleRate, format.SampleRate.N(time.Second/10))
+func is_supported(path string) bool {
+	_, ok := decoders[strings.ToLower(filepath.Ext(path))]
+	return ok
+}
+
+func get_title(path string) string {
+	name := filepath.Base(path)
+	return strings.TrimSuffix(name, filepath.Ext(name))
+}
+
+// plays a single song and returns false if it was interrupted by stop, or
+// the error of a song that cannot be opened or decoded.
+func (m *MusicManager) play_song(file_path string, stop chan struct{}) (bool, error) {
+	file, err := os.Open(file_path)
+	if err != nil {
+		return false, err
+	}
+	defer file.Close()
 
-	ctrl := &beep.Ctrl{Streamer: beep.Loop(1, s), Paused: m.paused}
-	vol := &effects.Volume{
-		Streamer: ctrl,
+	decode, ok := decoders[strings.ToLower(filepath.Ext(file_path))]
+	if !ok {
+		decode = decoders[".ogg"]
+	}
+	streamer, format, err := decode(file)
+	if err != nil {
+		return false, fmt.Errorf("cannot decode %s: %v", filepath.Base(file_path), err)
+	}
+	defer streamer.Close()
+	if m.config.MarkBroken {
+		if err := unmark_broken(m.db, file_path); err != nil {
+			logger(log_db).Error("cannot clear the broken flag", "path", file_path, "err", err)
+		}
+	}
+
+	done := make(chan struct{})
+	m.mu.Lock()
+	if stopped(stop) {
+		m.mu.Unlock()
+		return false, nil
+	}
+	logger(log_player).Info("now playing", "path", file_path)
+	m.seek_resumed(streamer, format)
+	resampled := beep.Resample(4, format.SampleRate, output_rate, streamer)
+	m.ctrl = &beep.Ctrl{Streamer: resampled, Paused: m.paused}
+	m.song = streamer
+	m.format = format
+	m.vol = &effects.Volume{
+		Streamer: m.ctrl,
 		Base: 2,
-		Volume: 0,
+		Volume: m.volume,
 		Silent: false,
 	}
-	speaker.Play(beep.Seq(vol, beep.Callback(func(){
-		m.done <-true
+	m.output.Play(beep.Seq(m.live.tap(m.vol), beep.Callback(func(){
+		close(done)
 	})))
-	for {
-		select {
-		case <-m.done:
-			return
-		case m.paused =<-m.toggle:
-			speaker.Lock()
-			ctrl.Paused = m.paused
-			speaker.Unlock()
-		case volume :=<-m.volume:
-			speaker.Lock()
-			vol.Volume += volume
-			speaker.Unlock()
-		}
+	m.emit(event_track_started)
+	m.mu.Unlock()
+
+	select {
+	case <-done:
+		return true, nil
+	case <-stop:
+		return false, nil
 	}
 }
 
-func try_getsongs(name string) ([]Music, error) {
+func try_getsongs(name string, config *Config) ([]Music, error) {
 	songs := []Music{}
 	file, err := os.Stat(name)
 	if err != nil {
-		db, err := get_db()
+		db, err := get_db(config.DataDir, config.quiet)
 		if err != nil {
-			fmt.Printf("Cannot open database in in args..\n")
-		} else {
-			song, err := get_song(db, name)
-			if err != nil {
-				fmt.Printf("Cannot get song %s in database\n", name)
+			logger(log_db).Warn("cannot open the database", "err", err)
+			if db != nil {
+				db.Close()
 			}
-			songs = append(songs, song)
+			return nil, err
 		}
 		defer db.Close()
-		return songs, nil
+		song, err := get_song(db, name)
+		if err != nil {
+			logger(log_db).Debug("no song with the title", "title", name)
+			return nil, err
+		}
+		return append(songs, song), nil
 	}
-	fmt.Printf("Checking if dir or file: %s.\n", name)
+	logger(log_player).Debug("looking for songs", "path", name)
 	if !file.IsDir() {
-		title := strings.TrimSuffix(file.Name(), ".ogg")
+		title := get_title(file.Name())
 		songs = append(songs, Music{0, title, name})
-		fmt.Printf("Found file %s\n", name)
+		logger(log_player).Debug("found a song", "path", name)
 	} else {
 		dirpath := strings.TrimRight(name, "/")
 		songs, err = get_songs_from_dir(dirpath)
@@ -463,96 +1094,152 @@ func try_getsongs(name string) ([]Music, error) {
 	return songs, nil
 }
 
-func has_args() bool {
-	return len(os.Args) > 2
+// a command line that cannot be run, shown with the usage of the command.
+type usage_error struct {
+	message string
+	usage string
+}
+
+func (e *usage_error) Error() string {
+	return e.message
+}
+
+func new_usage_error(usage string, format string, a ...any) error {
+	return &usage_error{ message: fmt.Sprintf(format, a...), usage: usage }
 }
 
-func parse_cmds() (cmd string, args []any) {
-	if len(os.Args) == 1 {
-		return "start", args
+func parse_cmds(argv []string, config *Config) (cmd string, args []any) {
+	cmd, args, err := parse_command(argv, config)
+	var usage *usage_error
+	if errors.As(err, &usage) {
+		fmt.Fprintf(os.Stderr, "ERROR: %s\n", usage.message)
+		fmt.Fprintf(os.Stderr, "USAGE: %s\n", usage.usage)
+		os.Exit(exit_invalid)
 	}
-	arg := os.Args[1]
-	switch arg {
-	case "playlist", "toggle", "next", "prev", "stop", "list", "kill", "clean", "playlists":
-		return arg, args
-	case "add", "remove":
-		cmd := arg
-		if !has_args() {
-			fmt.Fprintf(os.Stderr, "ERROR: missing argument to %s \n", cmd)
-			fmt.Fprintf(os.Stderr, "USAGE: apollo %s [SONG IDS...]\n", cmd)
-			os.Exit(1)
-		}
-		args := []any{}
-		for _,v := range os.Args[2:] {
+	if cmd == "help" {
+		handle_help(os.Stdout, args)
+		os.Exit(0)
+	}
+	return cmd, args
+}
+
+func handle_help(w io.Writer, args []any) {
+	switch {
+	case len(args) == 0:
+		print_help(w)
+	case args[0] == "--man":
+		print_man(w)
+	default:
+		print_command_help(w, find_command(args[0].(string)))
+	}
+}
+
+// parses the command and its arguments, anything else is a song, a directory
+// or a title to start the daemon with.
+func parse_command(argv []string, config *Config) (cmd string, args []any, err error) {
+	if len(argv) == 0 {
+		return "start", args, nil
+	}
+	c := find_command(argv[0])
+	if c == nil {
+		songs, err := get_start_songs(argv, config)
+		return "start", songs, err
+	}
+	rest := argv[1:]
+	if c.name == "__complete" {
+		for _, v := range rest {
 			args = append(args, v)
 		}
-		return cmd, args
-	case "play":
-		cmd := arg
-		if has_args() {
-			arg = os.Args[2]
-			args = make([]any, 1)
-			args[0] = arg
-		}
-		return cmd, args
-	case "create", "delete":
-		cmd := arg
-		if !has_args() {
-			fmt.Fprintf(os.Stderr, "ERROR: missing argument to %s\n", cmd)
-			fmt.Fprintf(os.Stderr, "USAGE: apollo %s [PLAYLIST NAME]\n", cmd)
-			os.Exit(1)
-		}
-		arg = os.Args[2]
-		args = make([]any, 1)
-		args[0] = arg
-		return cmd, args
+		return c.name, args, nil
+	}
+	if slices.Contains(rest, "--help") || slices.Contains(rest, "-h") {
+		return "help", []any{ c.name }, nil
+	}
+	if err := c.check_args(rest); err != nil {
+		return c.name, nil, err
+	}
+	for _, v := range rest {
+		args = append(args, v)
+	}
+	switch c.name {
+	case "start":
+		songs := []string{}
+		for _, v := range rest {
+			if v == "--foreground" {
+				config.foreground = true
+			} else if v == "--resume" {
+				config.Resume = true
+			} else {
+				songs = append(songs, v)
+			}
+		}
+		args = nil
+		if len(songs) > 0 {
+			args, err = get_start_songs(songs, config)
+		}
+		return c.name, args, err
+	case "service":
+		if rest[0] != "install" {
+			return c.name, nil, new_usage_error(c.usage(), "invalid argument to service '%s'", rest[0])
+		}
+	case "config":
+		if rest[0] != "list" || (len(rest) > 1 && rest[1] != "--effective") {
+			return c.name, nil, new_usage_error(c.usage(), "invalid argument to config")
+		}
 	case "sync":
-		cmd = arg
-		if has_args() {
-			arg := os.Args[2]
-			info, err := os.Stat(arg)
+		if len(rest) > 0 {
+			info, err := os.Stat(rest[0])
 			if err != nil || !info.IsDir() {
-				fmt.Fprintf(os.Stderr, "ERROR: invalid argument to sync '%s'\n", arg)
-				fmt.Fprintf(os.Stderr, "USAGE: apollo sync [DIRPATH]\n")
-				os.Exit(1)
+				return c.name, nil, new_usage_error(c.usage(), "invalid argument to sync '%s'", rest[0])
 			}
-			args = make([]any, 1)
-			args[0] = arg
 		}
-		return cmd, args
 	case "vol":
-		if !has_args() {
-			fmt.Fprintf(os.Stderr ,"ERROR: volume argument value required\n")
-			fmt.Fprintf(os.Stderr ,"USAGE: apollo vol [VALUE] \n")
-			os.Exit(1)
-		}
-		cmd = arg
-		arg = os.Args[2]
-		args = make([]any, 1)
-		var err error
-		args[0], err = strconv.ParseFloat(arg, 64)
+		value, err := strconv.ParseFloat(rest[0], 64)
 		if err != nil {
-			fmt.Fprintf(os.Stderr ,"ERROR: invalid volume value '%s'\n", arg)
-			fmt.Fprintf(os.Stderr ,"USAGE: apollo vol [VALUE] \n")
-			os.Exit(1)
+			return c.name, nil, new_usage_error(c.usage(), "invalid volume value '%s'", rest[0])
+		}
+		args = []any{ value }
+	case "logs":
+		query := LogsArgs{ Level: slog.LevelDebug }
+		for i := 0; i < len(rest); i++ {
+			switch {
+			case rest[i] == "-f" || rest[i] == "--follow":
+				query.Follow = true
+			case rest[i] == "--level" && i+1 < len(rest):
+				i++
+				if err := query.Level.UnmarshalText([]byte(rest[i])); err != nil {
+					return c.name, nil, new_usage_error(c.usage(), "invalid log level '%s'", rest[i])
+				}
+			default:
+				return c.name, nil, new_usage_error(c.usage(), "invalid argument to logs '%s'", rest[i])
+			}
+		}
+		args = []any{ query }
+	case "completion":
+		if _, ok := completion_scripts[rest[0]]; !ok {
+			return c.name, nil, new_usage_error(c.usage(), "no completion for the shell '%s'", rest[0])
 		}
-		return cmd, args
 	case "help":
-		fmt.Print("NOT IMPLEMENTED\n")
-		os.Exit(0)
-	default:
-		songs, err := try_getsongs(arg)
+		if len(rest) > 0 && rest[0] != "--man" && find_command(rest[0]) == nil {
+			return c.name, nil, new_usage_error(c.usage(), "unknown command '%s'", rest[0])
+		}
+	}
+	return c.name, args, nil
+}
+
+// the songs of the files, directories or titles the daemon is started with.
+func get_start_songs(names []string, config *Config) ([]any, error) {
+	args := []any{}
+	for _, name := range names {
+		songs, err := try_getsongs(name, config)
 		if err != nil {
-			fmt.Fprintf(os.Stderr ,"ERROR: %s is not a valid song argument or command\n", arg)
-			fmt.Fprintf(os.Stderr ,"USAGE: apollo [COMMAND | FILEPATH | DIRPATH | TITLE] \n")
-			os.Exit(1)
+			return nil, new_usage_error(main_usage, "%s is not a valid song argument or command", name)
 		}
-		args = make([]any, len(songs))
-		for i, v := range songs {
-			args[i] = v
+		for _, v := range songs {
+			args = append(args, v)
 		}
 	}
-	return "start", args
+	return args, nil
 }
 
 func get_songs_from_dir(dirpath string) ([]Music, error) {
@@ -561,15 +1248,8 @@ func get_songs_from_dir(dirpath string) ([]Music, error) {
 		if err != nil {
 			return err
 		}
-		if d.IsDir() {
-			dirfs := os.DirFS(path)
-			files, err := fs.Glob(dirfs, "*.ogg")
-			if err == nil && len(files) > 0 {
-				for _, song := range files {
-					path := fmt.Sprintf("%s/%s", path, song)
-					songs = append(songs, Music{0, song, path})
-				}
-			}
+		if !d.IsDir() && is_supported(path) {
+			songs = append(songs, Music{0, d.Name(), path})
 		}
 		return nil
 	})
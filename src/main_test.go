@@ -0,0 +1,420 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gopxl/beep"
+	"github.com/gopxl/beep/generators"
+	"github.com/gopxl/beep/wav"
+)
+
+// writes a sine tone wav file, sampled below the output rate so playing it
+// goes through the resampler.
+func write_fixture(t *testing.T, path string, duration time.Duration) {
+	t.Helper()
+	format := beep.Format{ SampleRate: 22050, NumChannels: 2, Precision: 2 }
+	tone, err := generators.SineTone(format.SampleRate, 440)
+	if err != nil {
+		t.Fatalf("sine tone: %v", err)
+	}
+	file, err := os.Create(path)
+	if err != nil {
+		t.Fatalf("creating fixture: %v", err)
+	}
+	defer file.Close()
+	err = wav.Encode(file, beep.Take(format.SampleRate.N(duration), tone), format)
+	if err != nil {
+		t.Fatalf("encoding fixture: %v", err)
+	}
+}
+
+func new_test_manager(t *testing.T, count int) *MusicManager {
+	t.Helper()
+	db, err := get_db(t.TempDir(), true)
+	if err != nil {
+		t.Fatalf("get_db: %v", err)
+	}
+	t.Cleanup(func() { db.Close() })
+
+	_, err = db.Exec("insert into playlists(name) values ('test');")
+	if err != nil {
+		t.Fatalf("creating playlist: %v", err)
+	}
+	dirpath := t.TempDir()
+	playlist := Playlist{ id: 1, name: "test", songs: []Music{} }
+	for i := 1; i <= count; i++ {
+		song := Music{ i, fmt.Sprintf("song %d", i), filepath.Join(dirpath, fmt.Sprintf("song%d.wav", i)) }
+		write_fixture(t, song.path, 500*time.Millisecond)
+		_, err = db.Exec("insert into musics(title, path) values (?, ?);", song.title, song.path)
+		if err != nil {
+			t.Fatalf("inserting song: %v", err)
+		}
+		playlist.songs = append(playlist.songs, song)
+	}
+	// plays every song in 50ms
+	output := new_paced_output(10, nil)
+	t.Cleanup(func() { output.Close() })
+	return &MusicManager{
+		playlist: playlist,
+		config: &Config{ Loop: true, StateDir: t.TempDir() },
+		db: db,
+		output: output,
+	}
+}
+
+func TestConcurrentNavigation(t *testing.T) {
+	m := new_test_manager(t, 5)
+	var wg sync.WaitGroup
+	for i := 0; i < 50; i++ {
+		wg.Add(2)
+		go func() {
+			defer wg.Done()
+			var reply PlayerReply
+			if err := m.Next("", &reply); err != nil {
+				t.Errorf("Next: %v", err)
+			}
+		}()
+		go func() {
+			defer wg.Done()
+			var reply PlayerReply
+			if err := m.Previous("", &reply); err != nil {
+				t.Errorf("Previous: %v", err)
+			}
+		}()
+	}
+	wg.Wait()
+	// every next is undone by a previous, in any order
+	if m.current != 0 {
+		t.Errorf("current = %d, want 0", m.current)
+	}
+}
+
+func TestConcurrentCommands(t *testing.T) {
+	m := new_test_manager(t, 5)
+	commands := []func() error{
+		func() error { return m.Play("", &PlayerReply{}) },
+		func() error { return m.Next("", &PlayerReply{}) },
+		func() error { return m.Previous("", &PlayerReply{}) },
+		func() error { return m.Toggle("", &PlayerReply{}) },
+		func() error { return m.Volume(0.5, &PlayerReply{}) },
+		func() error { return m.Playlist("", &PlaylistReply{}) },
+		func() error { return m.Status("", &Status{}) },
+		func() error { return m.Stop("", &PlayerReply{}) },
+		func() error { return m.Remove([]int{1, 2}, &SongsChange{}) },
+		func() error { return m.Add([]int{1, 2}, &SongsChange{}) },
+	}
+	var wg sync.WaitGroup
+	for i := 0; i < 20; i++ {
+		for _, command := range commands {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				command()
+			}()
+		}
+	}
+	wg.Wait()
+
+	var reply PlayerReply
+	if err := m.Stop("", &reply); err != nil {
+		t.Fatalf("Stop: %v", err)
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.playing || m.stop != nil {
+		t.Errorf("playing = %v after stop", m.playing)
+	}
+}
+
+func TestPlaylistAdvances(t *testing.T) {
+	m := new_test_manager(t, 3)
+	m.config.Loop = false
+	var reply PlayerReply
+	if err := m.Play("", &reply); err != nil {
+		t.Fatalf("Play: %v", err)
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		m.mu.Lock()
+		playing, current := m.playing, m.current
+		m.mu.Unlock()
+		if !playing {
+			if current != 3 {
+				t.Errorf("current = %d, want 3 at the end of the playlist", current)
+			}
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("playlist still playing song %d", current)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// the types of the events until one of type last, or the timeout
+func collect_events(t *testing.T, ch chan Event, last string) []Event {
+	t.Helper()
+	events := []Event{}
+	timeout := time.After(5 * time.Second)
+	for {
+		select {
+		case event := <-ch:
+			events = append(events, event)
+			if event.Type == last {
+				return events
+			}
+		case <-timeout:
+			t.Fatalf("no %s event after %d events", last, len(events))
+		}
+	}
+}
+
+func TestSkipUnplayable(t *testing.T) {
+	m := new_test_manager(t, 3)
+	m.config.MarkBroken = true
+	m.events = new_event_bus()
+	t.Cleanup(func() { m.Stop("", &PlayerReply{}) })
+	os.WriteFile(m.playlist.songs[1].path, []byte("not a wav"), 0644)
+	os.Remove(m.playlist.songs[2].path)
+	ch := m.events.subscribe()
+	var reply PlayerReply
+	m.Play("", &reply)
+	// song 1 plays, songs 2 and 3 are skipped and the playlist loops
+	skipped := []string{}
+	for _, event := range collect_events(t, ch, event_track_ended) {
+		if event.Type == event_track_skipped {
+			t.Errorf("skipped %s before it was played", event.Song.Title)
+		}
+	}
+	events := collect_events(t, ch, event_track_started)
+	for _, event := range events {
+		if event.Type == event_track_skipped {
+			if event.Error == "" {
+				t.Errorf("skipped %s without an error", event.Song.Title)
+			}
+			skipped = append(skipped, event.Song.Title)
+		}
+	}
+	if len(skipped) != 2 || skipped[0] != "song 2" || skipped[1] != "song 3" {
+		t.Errorf("skipped %v, want song 2 and song 3", skipped)
+	}
+	if status := events[len(events)-1].Status; status.Index != 0 {
+		t.Errorf("playing song %d after the skips, want song 0", status.Index)
+	}
+	var broken BrokenReply
+	if err := m.Broken("", &broken); err != nil {
+		t.Fatalf("Broken: %v", err)
+	}
+	if len(broken.Songs) != 2 || broken.Songs[0].Id != 2 || broken.Songs[1].Id != 3 {
+		t.Errorf("broken songs: %+v", broken.Songs)
+	}
+
+	// a song that plays again is no longer broken
+	write_fixture(t, m.playlist.songs[1].path, 500*time.Millisecond)
+	collect_events(t, ch, event_track_skipped)
+	if m.Broken("", &broken); len(broken.Songs) != 1 || broken.Songs[0].Id != 3 {
+		t.Errorf("broken songs after the fix: %+v", broken.Songs)
+	}
+}
+
+func TestStopAfterSkips(t *testing.T) {
+	for _, max_skips := range []int{ 2, 0 } {
+		m := new_test_manager(t, 3)
+		m.config.MaxSkips = max_skips
+		m.events = new_event_bus()
+		for _, song := range m.playlist.songs {
+			os.Remove(song.path)
+		}
+		ch := m.events.subscribe()
+		var reply PlayerReply
+		m.Play("", &reply)
+		skips := 0
+		for _, event := range collect_events(t, ch, event_stopped) {
+			if event.Type == event_track_skipped {
+				skips++
+			}
+		}
+		// without a limit a full round of the playlist
+		want := max_skips
+		if want == 0 {
+			want = 3
+		}
+		var status Status
+		if m.Status("", &status); skips != want || status.Playing {
+			t.Errorf("max_skips %d: stopped after %d skips, playing %v", max_skips, skips, status.Playing)
+		}
+	}
+}
+
+func TestStopWhenNotPlaying(t *testing.T) {
+	m := new_test_manager(t, 2)
+	var reply PlayerReply
+	if err := m.Stop("", &reply); err != nil {
+		t.Fatalf("Stop: %v", err)
+	}
+	if reply.Action != action_not_playing {
+		t.Errorf("action = %q, want %q", reply.Action, action_not_playing)
+	}
+	if err := m.Toggle("", &reply); err != nil {
+		t.Fatalf("Toggle: %v", err)
+	}
+	if reply.Action != action_not_playing || reply.Status.Playing {
+		t.Errorf("action = %q, playing = %v", reply.Action, reply.Status.Playing)
+	}
+}
+
+func TestShutdownFadesOut(t *testing.T) {
+	m := new_test_manager(t, 2)
+	var reply PlayerReply
+	m.Play("", &reply)
+	for deadline := time.Now().Add(2 * time.Second); ; time.Sleep(5 * time.Millisecond) {
+		m.mu.Lock()
+		started := m.vol != nil
+		m.mu.Unlock()
+		if started || time.Now().After(deadline) {
+			break
+		}
+	}
+	start := time.Now()
+	m.shutdown(100 * time.Millisecond)
+	if elapsed := time.Since(start); elapsed < 100*time.Millisecond {
+		t.Errorf("stopped after %v, before fading out", elapsed)
+	}
+	if m.Status("", &Status{}); m.playing {
+		t.Errorf("still playing after shutdown")
+	}
+	// nothing to fade
+	start = time.Now()
+	m.shutdown(time.Second)
+	if elapsed := time.Since(start); elapsed > 100*time.Millisecond {
+		t.Errorf("shutdown when stopped took %v", elapsed)
+	}
+}
+
+func TestPidFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "apollo.pid")
+	if err := check_pid_file(path); err != nil {
+		t.Errorf("no pid file: %v", err)
+	}
+	// left by a daemon that crashed, nothing holds its lock
+	os.WriteFile(path, []byte("999999"), 0644)
+	if running_pid(path) != 0 {
+		t.Errorf("stale pid file is running")
+	}
+	if err := check_pid_file(path); err != nil {
+		t.Errorf("stale pid file: %v", err)
+	}
+	if _, err := os.Stat(path); err == nil {
+		t.Errorf("stale pid file not removed")
+	}
+	lock, err := lock_pid_file(path)
+	if err != nil {
+		t.Fatalf("lock_pid_file: %v", err)
+	}
+	defer lock.Remove()
+	if pid := running_pid(path); pid != os.Getpid() {
+		t.Errorf("running_pid = %d, want %d", pid, os.Getpid())
+	}
+	if err := check_pid_file(path); err == nil {
+		t.Errorf("started next to a running daemon")
+	}
+	if _, err := lock_pid_file(path); err == nil {
+		t.Errorf("locked the pid file twice")
+	}
+	if _, err := os.Stat(path); err != nil {
+		t.Errorf("failing to lock removed the pid file: %v", err)
+	}
+}
+
+func TestMigrateDb(t *testing.T) {
+	home := t.TempDir()
+	t.Setenv("HOME", home)
+	legacy_dirpath := filepath.Join(home, ".local/share/apollo")
+	os.MkdirAll(legacy_dirpath, 0755)
+	// a database in wal mode with its changes not checkpointed, copied while
+	// it is open like a daemon that crashed leaves it
+	dirpath := t.TempDir()
+	db, err := sql.Open("sqlite3", filepath.Join(dirpath, "apollo.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	db.SetMaxOpenConns(1)
+	for _, query := range []string{ "pragma journal_mode=wal;", "pragma wal_autocheckpoint=0;", "create table musics (id integer primary key, title text);", "insert into musics (title) values ('one');" } {
+		if _, err := db.Exec(query); err != nil {
+			t.Fatalf("%s: %v", query, err)
+		}
+	}
+	for _, name := range []string{ "apollo.db", "apollo.db-wal", "apollo.db-shm" } {
+		if err := copy_file(filepath.Join(dirpath, name), filepath.Join(legacy_dirpath, name)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	db_filepath := filepath.Join(t.TempDir(), "apollo.db")
+	migrate_db(db_filepath)
+	for _, name := range []string{ "apollo.db", "apollo.db-wal", "apollo.db-shm" } {
+		if _, err := os.Stat(filepath.Join(legacy_dirpath, name)); err == nil {
+			t.Errorf("%s left in the legacy dir", name)
+		}
+	}
+	migrated, err := sql.Open("sqlite3", db_filepath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer migrated.Close()
+	var title string
+	if err := migrated.QueryRow("select title from musics;").Scan(&title); err != nil || title != "one" {
+		t.Errorf("migrated song = %q, %v", title, err)
+	}
+}
+
+func TestReadConfig(t *testing.T) {
+	dirpath := t.TempDir()
+	if _, err := read_config(filepath.Join(dirpath, "missing", "config.json"), true); err == nil {
+		t.Errorf("read a config in a missing dir")
+	}
+	path := filepath.Join(dirpath, "config.json")
+	config, err := read_config(path, true)
+	if err != nil {
+		t.Fatalf("read_config: %v", err)
+	}
+	if !config.Loop || config.sources["loop"] != "default" {
+		t.Errorf("default config: %+v", config)
+	}
+	if _, err := os.Stat(path); err != nil {
+		t.Errorf("default config not saved: %v", err)
+	}
+
+	// the address of an older config is a tcp one, but for the old default
+	for legacy, want := range map[string][2]string{
+		`{"rpc_port": ":5000"}`: { "tcp", ":5000" },
+		`{"rpc_addr": "localhost:5000"}`: { "tcp", "localhost:5000" },
+		`{"rpc_port": ":42069"}`: { "unix", "" },
+	} {
+		os.WriteFile(path, []byte(legacy), 0644)
+		config, err := read_config(path, true)
+		if err != nil {
+			t.Errorf("%s: %v", legacy, err)
+		} else if config.RpcNetwork != want[0] || config.RpcAddr != want[1] {
+			t.Errorf("%s: rpc %q %q", legacy, config.RpcNetwork, config.RpcAddr)
+		}
+	}
+
+	// a file that is not a config is reported and left alone
+	notes := filepath.Join(dirpath, "notes.txt")
+	os.WriteFile(notes, []byte("loop: off\n"), 0644)
+	if _, err := read_config(notes, true); err == nil || !strings.Contains(err.Error(), notes) {
+		t.Errorf("read_config of a text file: %v", err)
+	}
+	if data, _ := os.ReadFile(notes); string(data) != "loop: off\n" {
+		t.Errorf("text file overwritten with %q", data)
+	}
+}
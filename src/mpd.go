@@ -0,0 +1,512 @@
+package main
+
+import (
+	"bufio"
+	"crypto/subtle"
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"math"
+	"net"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// A practical subset of the MPD protocol, served on mpd_addr so mpd clients
+// like mpc and ncmpcpp can control the daemon. The queue of mpd is the
+// current playlist, the stored playlists are the playlists of the database and
+// the uri of a song is its path. Unless rpc_auth is off the clients have to
+// send the token of the daemon with the password command first.
+
+const mpd_version = "0.23.0"
+
+// error codes of ACK responses
+const (
+	ack_error_arg = 2
+	ack_error_password = 3
+	ack_error_permission = 4
+	ack_error_unknown = 5
+	ack_error_no_exist = 50
+	ack_error_system = 52
+)
+
+var mpd_commands = []string{
+	"add", "close", "commands", "currentsong", "find", "idle", "listplaylists",
+	"load", "next", "noidle", "password", "pause", "ping", "play", "playid",
+	"playlistinfo", "previous", "search", "setvol", "status", "stop",
+}
+
+type mpd_error struct {
+	code int
+	message string
+}
+
+func (e *mpd_error) Error() string {
+	return e.message
+}
+
+func new_mpd_error(code int, format string, a ...any) error {
+	return &mpd_error{ code: code, message: fmt.Sprintf(format, a...) }
+}
+
+type mpd_conn struct {
+	d *Daemon
+	m *MusicManager
+	conn net.Conn
+	w *bufio.Writer
+	// lines sent by the client, read in the background so idle can wait for
+	// noidle and events at the same time
+	lines chan string
+	done chan struct{}
+	// changes since the connection started, kept until idle reports them
+	events chan Event
+	changed []string
+	authorized bool
+}
+
+func start_mpd(d *Daemon, m *MusicManager) {
+	if d.config.MpdAddr == "" {
+		return
+	}
+	listener, err := net.Listen("tcp", d.config.MpdAddr)
+	if err != nil {
+		logger(log_mpd).Error("cannot listen", "addr", d.config.MpdAddr, "err", err)
+		return
+	}
+	logger(log_mpd).Info("serving", "addr", listener.Addr().String())
+	d.mpd = listener
+	go serve_mpd(d, m, listener)
+}
+
+func serve_mpd(d *Daemon, m *MusicManager, listener net.Listener) {
+	for {
+		conn, err := listener.Accept()
+		if errors.Is(err, net.ErrClosed) {
+			return
+		}
+		if err != nil {
+			continue
+		}
+		c := &mpd_conn{
+			d: d,
+			m: m,
+			conn: conn,
+			w: bufio.NewWriter(conn),
+			lines: make(chan string),
+			done: make(chan struct{}),
+			authorized: !d.config.RpcAuth,
+		}
+		go c.serve()
+	}
+}
+
+func (c *mpd_conn) read_lines() {
+	defer close(c.lines)
+	scanner := bufio.NewScanner(c.conn)
+	for scanner.Scan() {
+		select {
+		case c.lines <- scanner.Text():
+		case <-c.done:
+			return
+		}
+	}
+}
+
+func (c *mpd_conn) serve() {
+	defer c.conn.Close()
+	defer close(c.done)
+	c.events = c.m.events.subscribe()
+	defer c.m.events.unsubscribe(c.events)
+	go c.read_lines()
+	fmt.Fprintf(c.w, "OK MPD %s\n", mpd_version)
+	c.w.Flush()
+	var list []string
+	in_list, list_ok := false, false
+	for line := range c.lines {
+		if in_list {
+			if line == "command_list_end" {
+				in_list = false
+				if !c.run_list(list, list_ok) {
+					return
+				}
+			} else {
+				list = append(list, line)
+			}
+			continue
+		}
+		switch line {
+		case "command_list_begin", "command_list_ok_begin":
+			in_list, list_ok, list = true, line == "command_list_ok_begin", nil
+			continue
+		// sent as idle returned, mpd does not answer it
+		case "noidle":
+			continue
+		}
+		if !c.run_list([]string{line}, false) {
+			return
+		}
+	}
+}
+
+// runs the commands, stopping at the first failure. Returns false when the
+// client closed the connection.
+func (c *mpd_conn) run_list(lines []string, list_ok bool) bool {
+	defer c.w.Flush()
+	for i, line := range lines {
+		args, err := parse_mpd_line(line)
+		name := ""
+		if err == nil {
+			name = args[0]
+			if name == "close" {
+				return false
+			}
+			err = c.run(name, args[1:])
+		}
+		if err != nil {
+			code, message := mpd_ack(err)
+			fmt.Fprintf(c.w, "ACK [%d@%d] {%s} %s\n", code, i, name, message)
+			return true
+		}
+		if list_ok {
+			fmt.Fprintf(c.w, "list_OK\n")
+		}
+	}
+	fmt.Fprintf(c.w, "OK\n")
+	return true
+}
+
+func mpd_ack(err error) (int, string) {
+	var mpd_err *mpd_error
+	if errors.As(err, &mpd_err) {
+		return mpd_err.code, mpd_err.message
+	}
+	rpc_err := as_rpc_error(err)
+	switch rpc_err.Code {
+	case code_not_found, code_empty:
+		return ack_error_no_exist, rpc_err.Message
+	case code_invalid:
+		return ack_error_arg, rpc_err.Message
+	}
+	return ack_error_system, rpc_err.Message
+}
+
+// splits a command line into its words, arguments can be quoted with
+// backslash escapes inside the quotes.
+func parse_mpd_line(line string) ([]string, error) {
+	args := []string{}
+	for i := 0; i < len(line); {
+		if line[i] == ' ' || line[i] == '\t' {
+			i++
+			continue
+		}
+		if line[i] != '"' {
+			end := strings.IndexAny(line[i:], " \t")
+			if end == -1 {
+				end = len(line) - i
+			}
+			args = append(args, line[i:i+end])
+			i += end
+			continue
+		}
+		var arg strings.Builder
+		i++
+		for ; i < len(line) && line[i] != '"'; i++ {
+			if line[i] == '\\' && i+1 < len(line) {
+				i++
+			}
+			arg.WriteByte(line[i])
+		}
+		if i >= len(line) {
+			return nil, new_mpd_error(ack_error_arg, "Missing closing '\"'")
+		}
+		args = append(args, arg.String())
+		i++
+	}
+	if len(args) == 0 {
+		return nil, new_mpd_error(ack_error_unknown, "No command given")
+	}
+	return args, nil
+}
+
+func (c *mpd_conn) run(name string, args []string) error {
+	if !c.authorized && name != "password" && name != "ping" {
+		return new_mpd_error(ack_error_permission, "you don't have permission for \"%s\"", name)
+	}
+	m := c.m
+	var reply PlayerReply
+	switch name {
+	case "ping":
+		return nil
+	case "password":
+		if len(args) != 1 {
+			return new_mpd_error(ack_error_arg, "wrong number of arguments for \"%s\"", name)
+		}
+		if subtle.ConstantTimeCompare([]byte(args[0]), []byte(c.d.token)) != 1 {
+			return new_mpd_error(ack_error_password, "incorrect password")
+		}
+		c.authorized = true
+		return nil
+	case "commands":
+		for _, command := range mpd_commands {
+			fmt.Fprintf(c.w, "command: %s\n", command)
+		}
+		return nil
+	case "status":
+		return c.status()
+	case "currentsong":
+		var status Status
+		m.Status("", &status)
+		if status.Song != nil {
+			c.write_song(*status.Song, status.Index)
+		}
+		return nil
+	case "play":
+		if len(args) == 0 {
+			return m.Play("", &reply)
+		}
+		pos, err := strconv.Atoi(args[0])
+		if err != nil {
+			return new_mpd_error(ack_error_arg, "Integer expected: %s", args[0])
+		}
+		return m.Jump(pos, &reply)
+	case "playid":
+		if len(args) == 0 {
+			return m.Play("", &reply)
+		}
+		id, err := strconv.Atoi(args[0])
+		if err != nil {
+			return new_mpd_error(ack_error_arg, "Integer expected: %s", args[0])
+		}
+		var playlist PlaylistReply
+		m.Playlist("", &playlist)
+		for i, song := range playlist.Songs {
+			if song.Id == id {
+				return m.Jump(i, &reply)
+			}
+		}
+		return new_mpd_error(ack_error_no_exist, "No such song")
+	case "pause":
+		var status Status
+		m.Status("", &status)
+		if len(args) > 0 && (args[0] == "1") == status.Paused {
+			return nil
+		}
+		return m.Toggle("", &reply)
+	case "stop":
+		return m.Stop("", &reply)
+	case "next":
+		return m.Next("", &reply)
+	case "previous":
+		return m.Previous("", &reply)
+	case "setvol":
+		if len(args) != 1 {
+			return new_mpd_error(ack_error_arg, "wrong number of arguments for \"%s\"", name)
+		}
+		volume, err := strconv.Atoi(args[0])
+		if err != nil || volume < 0 || volume > 100 {
+			return new_mpd_error(ack_error_arg, "Invalid volume value")
+		}
+		var status Status
+		m.Status("", &status)
+		return m.Volume(from_linear_volume(float64(volume) / 100) - status.Volume, &reply)
+	case "playlistinfo":
+		var playlist PlaylistReply
+		m.Playlist("", &playlist)
+		for i, song := range playlist.Songs {
+			c.write_song(song, i)
+		}
+		return nil
+	case "listplaylists":
+		var reply PlaylistsReply
+		if err := m.Playlists("", &reply); err != nil {
+			return err
+		}
+		for _, playlist := range reply.Playlists {
+			fmt.Fprintf(c.w, "playlist: %s\n", playlist.Name)
+		}
+		return nil
+	case "load":
+		if len(args) < 1 {
+			return new_mpd_error(ack_error_arg, "wrong number of arguments for \"%s\"", name)
+		}
+		m.mu.Lock()
+		defer m.mu.Unlock()
+		playlist, err := get_playlist(m.db, args[0])
+		if err != nil {
+			return new_mpd_error(ack_error_no_exist, "No such playlist")
+		}
+		if playlist.length() == 0 {
+			return nil
+		}
+		// appended to the queue like mpd does, which is then a list of its
+		// own and the stored playlists are left alone
+		m.playlist.add(playlist.songs)
+		if m.playlist.name != "Unlisted" {
+			m.playlist.id = 0
+			m.playlist.name = "Unlisted"
+			m.emit(event_playlist_switched)
+		}
+		return nil
+	case "add":
+		if len(args) != 1 {
+			return new_mpd_error(ack_error_arg, "wrong number of arguments for \"%s\"", name)
+		}
+		song, err := get_song_by_path(m.db, args[0])
+		if err != nil {
+			return new_mpd_error(ack_error_no_exist, "No such song")
+		}
+		var change SongsChange
+		return m.Add([]int{song.id}, &change)
+	case "search", "find":
+		return c.search(args, name == "search")
+	case "idle":
+		return c.idle(args)
+	}
+	return new_mpd_error(ack_error_unknown, "unknown command \"%s\"", name)
+}
+
+func to_mpd_volume(volume float64) int {
+	return min(max(int(math.Round(100 * linear_volume(volume))), 0), 100)
+}
+
+// changes whenever the songs of the queue change, so clients know when to
+// fetch it again.
+func playlist_version(playlist PlaylistReply) uint32 {
+	hash := fnv.New32a()
+	fmt.Fprintf(hash, "%d", playlist.Id)
+	for _, song := range playlist.Songs {
+		fmt.Fprintf(hash, ",%d", song.Id)
+	}
+	return hash.Sum32()
+}
+
+func (c *mpd_conn) status() error {
+	var status Status
+	c.m.Status("", &status)
+	var playlist PlaylistReply
+	c.m.Playlist("", &playlist)
+	state := "stop"
+	if status.Playing && status.Paused {
+		state = "pause"
+	} else if status.Playing {
+		state = "play"
+	}
+	repeat := 0
+	if status.Loop {
+		repeat = 1
+	}
+	fmt.Fprintf(c.w, "volume: %d\n", to_mpd_volume(status.Volume))
+	fmt.Fprintf(c.w, "repeat: %d\nrandom: 0\nsingle: 0\nconsume: 0\n", repeat)
+	fmt.Fprintf(c.w, "playlist: %d\n", playlist_version(playlist))
+	fmt.Fprintf(c.w, "playlistlength: %d\n", status.Length)
+	fmt.Fprintf(c.w, "state: %s\n", state)
+	if status.Song != nil {
+		fmt.Fprintf(c.w, "song: %d\nsongid: %d\n", status.Index, status.Song.Id)
+	}
+	if status.Playing {
+		fmt.Fprintf(c.w, "time: %d:%d\n", int(status.Position), int(math.Round(status.Duration)))
+		fmt.Fprintf(c.w, "elapsed: %.3f\nduration: %.3f\n", status.Position, status.Duration)
+	}
+	return nil
+}
+
+func (c *mpd_conn) write_song(song Song, pos int) {
+	fmt.Fprintf(c.w, "file: %s\nTitle: %s\n", song.Path, song.Title)
+	if pos >= 0 {
+		fmt.Fprintf(c.w, "Pos: %d\nId: %d\n", pos, song.Id)
+	}
+}
+
+// search matches parts of the tags ignoring case, find matches them exactly.
+func (c *mpd_conn) search(args []string, partial bool) error {
+	if len(args) == 0 || len(args)%2 != 0 {
+		return new_mpd_error(ack_error_arg, "incorrect arguments")
+	}
+	var library LibraryReply
+	c.m.List("", &library)
+	for _, song := range library.Songs {
+		matches := true
+		for i := 0; i < len(args); i += 2 {
+			values := []string{}
+			switch strings.ToLower(args[i]) {
+			case "title":
+				values = append(values, song.Title)
+			case "file":
+				values = append(values, song.Path)
+			case "any":
+				values = append(values, song.Title, song.Path)
+			default:
+				return new_mpd_error(ack_error_arg, "unknown tag type \"%s\"", args[i])
+			}
+			matches = matches && slices.ContainsFunc(values, func(value string) bool {
+				if partial {
+					return strings.Contains(strings.ToLower(value), strings.ToLower(args[i+1]))
+				}
+				return value == args[i+1]
+			})
+		}
+		if matches {
+			c.write_song(song, -1)
+		}
+	}
+	return nil
+}
+
+func mpd_subsystem(event string) string {
+	switch event {
+	case event_track_started, event_track_ended, event_paused, event_resumed, event_stopped:
+		return "player"
+	case event_volume_changed:
+		return "mixer"
+	case event_playlist_switched:
+		return "playlist"
+	case event_library_synced:
+		return "database"
+	}
+	return ""
+}
+
+func (c *mpd_conn) add_change(event Event) {
+	subsystem := mpd_subsystem(event.Type)
+	if subsystem != "" && !slices.Contains(c.changed, subsystem) {
+		c.changed = append(c.changed, subsystem)
+	}
+}
+
+// reports the changes of the subsystems, any subsystem by default, since the
+// last idle. Waits for one when there are none until the client sends noidle.
+func (c *mpd_conn) idle(subsystems []string) error {
+	c.w.Flush()
+	for {
+		for pending := true; pending; {
+			select {
+			case event := <-c.events:
+				c.add_change(event)
+			default:
+				pending = false
+			}
+		}
+		reported := false
+		c.changed = slices.DeleteFunc(c.changed, func(subsystem string) bool {
+			if len(subsystems) > 0 && !slices.Contains(subsystems, subsystem) {
+				return false
+			}
+			fmt.Fprintf(c.w, "changed: %s\n", subsystem)
+			reported = true
+			return true
+		})
+		if reported {
+			return nil
+		}
+		select {
+		case line, ok := <-c.lines:
+			if !ok || line == "noidle" {
+				return nil
+			}
+			return new_mpd_error(ack_error_arg, "only noidle is allowed while idle")
+		case event := <-c.events:
+			c.add_change(event)
+		}
+	}
+}
@@ -0,0 +1,197 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+)
+
+type mpd_client struct {
+	t *testing.T
+	conn net.Conn
+	reader *bufio.Reader
+}
+
+func start_test_mpd(t *testing.T, td *test_daemon) net.Listener {
+	t.Helper()
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { listener.Close() })
+	go serve_mpd(td.daemon, td.manager, listener)
+	return listener
+}
+
+func dial_mpd(t *testing.T, listener net.Listener) *mpd_client {
+	t.Helper()
+	conn, err := net.Dial("tcp", listener.Addr().String())
+	if err != nil {
+		t.Fatalf("dial: %v", err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	c := &mpd_client{ t: t, conn: conn, reader: bufio.NewReader(conn) }
+	if line := c.line(); line != "OK MPD "+mpd_version {
+		t.Fatalf("greeting: got %q", line)
+	}
+	return c
+}
+
+func (c *mpd_client) line() string {
+	c.t.Helper()
+	line, err := c.reader.ReadString('\n')
+	if err != nil {
+		c.t.Fatalf("reading: %v", err)
+	}
+	return strings.TrimSuffix(line, "\n")
+}
+
+// sends the lines and returns the response up to OK or ACK, and that last line.
+func (c *mpd_client) send(lines ...string) ([]string, string) {
+	c.t.Helper()
+	for _, line := range lines {
+		fmt.Fprintf(c.conn, "%s\n", line)
+	}
+	response := []string{}
+	for {
+		line := c.line()
+		if line == "OK" || strings.HasPrefix(line, "ACK ") {
+			return response, line
+		}
+		response = append(response, line)
+	}
+}
+
+// sends the command expecting OK and the response to contain the lines.
+func (c *mpd_client) expect(command string, want ...string) []string {
+	c.t.Helper()
+	response, end := c.send(command)
+	if end != "OK" {
+		c.t.Fatalf("%s: got %s", command, end)
+	}
+	for _, line := range want {
+		if !slices.Contains(response, line) {
+			c.t.Errorf("%s: response %q does not contain %q", command, response, line)
+		}
+	}
+	return response
+}
+
+func (c *mpd_client) expect_ack(command string, want string) {
+	c.t.Helper()
+	if _, end := c.send(command); !strings.HasPrefix(end, want) {
+		c.t.Errorf("%s: got %q, want %q", command, end, want)
+	}
+}
+
+func TestParseMpdLine(t *testing.T) {
+	args, err := parse_mpd_line(`add  "a \"b\" \\c" d`)
+	if err != nil || !slices.Equal(args, []string{"add", `a "b" \c`, "d"}) {
+		t.Errorf("parse_mpd_line = %q, %v", args, err)
+	}
+	if _, err := parse_mpd_line(`add "a`); err == nil {
+		t.Errorf("parse_mpd_line: unclosed quote accepted")
+	}
+	if _, err := parse_mpd_line(" "); err == nil {
+		t.Errorf("parse_mpd_line: empty line accepted")
+	}
+}
+
+func TestMpdProtocol(t *testing.T) {
+	music_dir, config := setup_test_env(t)
+	config.Loop = true
+	run_cmd(config, "sync")
+	run_cmd(config, "create", "mix")
+	run_cmd(config, "create", "best")
+	td := start_test_daemon(t, config)
+	two := filepath.Join(music_dir, "a", "two.wav")
+	if song, err := get_song_by_path(td.manager.db, two); err != nil {
+		t.Fatalf("get_song_by_path: %v", err)
+	} else {
+		td.manager.edit_playlist("best", []int{ song.id }, false)
+	}
+	c := dial_mpd(t, start_test_mpd(t, td))
+
+	c.expect("ping")
+	c.expect_ack("status", "ACK [4@0] {status}")
+	c.expect_ack("password nope", "ACK [3@0] {password}")
+	c.expect("password " + td.daemon.token)
+
+	c.expect("listplaylists", "playlist: mix", "playlist: best")
+	one := filepath.Join(music_dir, "a", "one.wav")
+	c.expect("search title ON", "file: "+one, "Title: one")
+	if response := c.expect("find title on"); len(response) != 0 {
+		t.Errorf("find title on: got %q, want nothing", response)
+	}
+	c.expect("find any one", "Title: one")
+	c.expect_ack("search artist x", "ACK [2@0] {search}")
+
+	// load appends to the queue, all songs and best are a list of their own
+	c.expect("load best")
+	c.expect("status", "playlistlength: 4")
+	if name, _, _, _, _ := td.state(); name != "Unlisted" {
+		t.Errorf("queue after load = %q, want Unlisted", name)
+	}
+	// a stored playlist in the queue is left alone by load
+	td.manager.Play("mix", &PlayerReply{})
+	c.expect(`add "` + one + `"`)
+	c.expect_ack("add nope.wav", "ACK [50@0] {add}")
+	c.expect_ack("load nope", "ACK [50@0] {load}")
+	c.expect("load best")
+	c.expect("playlistinfo", "file: "+one, "Pos: 0", "file: "+two, "Pos: 1")
+	c.expect("status", "state: stop", "playlistlength: 2", "repeat: 1")
+	if playlist, _ := get_playlist(td.manager.db, "mix"); playlist.length() != 1 {
+		t.Errorf("mix has %d song(s), want 1", playlist.length())
+	}
+
+	c.expect("play 0")
+	c.expect("status", "state: play", "song: 0")
+	c.expect("currentsong", "Title: one", "Pos: 0")
+	c.expect("setvol 50")
+	c.expect("status", "volume: 50")
+	c.expect("pause 1")
+	c.expect("status", "state: pause")
+	c.expect_ack("play 5", "ACK [2@0] {play}")
+	c.expect_ack("bogus", `ACK [5@0] {bogus} unknown command "bogus"`)
+
+	// reports the changes since the connection started at once
+	c.expect("idle", "changed: player", "changed: playlist", "changed: mixer")
+
+	// the subsystems changed by another client wake up idle
+	other := dial_mpd(t, start_test_mpd(t, td))
+	other.expect("password " + td.daemon.token)
+	fmt.Fprintf(c.conn, "idle player\n")
+	other.expect("pause 0")
+	if response, end := c.send(); end != "OK" || !slices.Contains(response, "changed: player") {
+		t.Errorf("idle player: got %q %s", response, end)
+	}
+	fmt.Fprintf(c.conn, "idle mixer\n")
+	other.expect("setvol 25")
+	if response, end := c.send(); end != "OK" || !slices.Equal(response, []string{"changed: mixer"}) {
+		t.Errorf("idle mixer: got %q %s", response, end)
+	}
+	fmt.Fprintf(c.conn, "idle database\n")
+	if response, end := c.send("noidle"); end != "OK" || len(response) != 0 {
+		t.Errorf("noidle: got %q %s", response, end)
+	}
+	// a noidle after idle returned gets no response
+	fmt.Fprintf(c.conn, "noidle\n")
+
+	response, end := c.send("command_list_ok_begin", "ping", "status", "command_list_end")
+	if end != "OK" || response[0] != "list_OK" || response[len(response)-1] != "list_OK" {
+		t.Errorf("command list: got %q %s", response, end)
+	}
+	if _, end := c.send("command_list_begin", "ping", "bogus", "command_list_end"); !strings.HasPrefix(end, "ACK [5@1] {bogus}") {
+		t.Errorf("failing command list: got %s", end)
+	}
+	c.expect("stop")
+	c.expect("status", "state: stop")
+	fmt.Fprintf(c.conn, "close\n")
+	if _, err := c.reader.ReadString('\n'); err == nil {
+		t.Errorf("close: connection still open")
+	}
+}
@@ -0,0 +1,339 @@
+package main
+
+import (
+	"fmt"
+	"maps"
+	"slices"
+
+	"github.com/godbus/dbus/v5"
+)
+
+// The MPRIS2 interface (https://specifications.freedesktop.org/mpris-spec/latest/)
+// registered on the session bus when mpris is set, so media keys, desktop
+// widgets and playerctl can control the daemon.
+
+const (
+	mpris_name = "org.mpris.MediaPlayer2.apollo"
+	mpris_path = dbus.ObjectPath("/org/mpris/MediaPlayer2")
+	mpris_root = "org.mpris.MediaPlayer2"
+	mpris_player = "org.mpris.MediaPlayer2.Player"
+	dbus_properties = "org.freedesktop.DBus.Properties"
+	// positions and lengths of mpris are in microseconds
+	mpris_second = 1e6
+)
+
+const mpris_introspection = `<node>
+  <interface name="org.freedesktop.DBus.Introspectable">
+    <method name="Introspect"><arg name="xml" type="s" direction="out"/></method>
+  </interface>
+  <interface name="org.freedesktop.DBus.Properties">
+    <method name="Get">
+      <arg name="interface" type="s" direction="in"/>
+      <arg name="property" type="s" direction="in"/>
+      <arg name="value" type="v" direction="out"/>
+    </method>
+    <method name="GetAll">
+      <arg name="interface" type="s" direction="in"/>
+      <arg name="properties" type="a{sv}" direction="out"/>
+    </method>
+    <method name="Set">
+      <arg name="interface" type="s" direction="in"/>
+      <arg name="property" type="s" direction="in"/>
+      <arg name="value" type="v" direction="in"/>
+    </method>
+    <signal name="PropertiesChanged">
+      <arg name="interface" type="s"/>
+      <arg name="changed" type="a{sv}"/>
+      <arg name="invalidated" type="as"/>
+    </signal>
+  </interface>
+  <interface name="org.mpris.MediaPlayer2">
+    <method name="Raise"/>
+    <method name="Quit"/>
+    <property name="CanQuit" type="b" access="read"/>
+    <property name="CanRaise" type="b" access="read"/>
+    <property name="HasTrackList" type="b" access="read"/>
+    <property name="Identity" type="s" access="read"/>
+    <property name="SupportedUriSchemes" type="as" access="read"/>
+    <property name="SupportedMimeTypes" type="as" access="read"/>
+  </interface>
+  <interface name="org.mpris.MediaPlayer2.Player">
+    <method name="Next"/>
+    <method name="Previous"/>
+    <method name="Pause"/>
+    <method name="PlayPause"/>
+    <method name="Stop"/>
+    <method name="Play"/>
+    <method name="Seek"><arg name="offset" type="x" direction="in"/></method>
+    <method name="SetPosition">
+      <arg name="track" type="o" direction="in"/>
+      <arg name="position" type="x" direction="in"/>
+    </method>
+    <method name="OpenUri"><arg name="uri" type="s" direction="in"/></method>
+    <signal name="Seeked"><arg name="position" type="x"/></signal>
+    <property name="PlaybackStatus" type="s" access="read"/>
+    <property name="LoopStatus" type="s" access="read"/>
+    <property name="Rate" type="d" access="read"/>
+    <property name="Shuffle" type="b" access="read"/>
+    <property name="Metadata" type="a{sv}" access="read"/>
+    <property name="Volume" type="d" access="readwrite"/>
+    <property name="Position" type="x" access="read"/>
+    <property name="MinimumRate" type="d" access="read"/>
+    <property name="MaximumRate" type="d" access="read"/>
+    <property name="CanGoNext" type="b" access="read"/>
+    <property name="CanGoPrevious" type="b" access="read"/>
+    <property name="CanPlay" type="b" access="read"/>
+    <property name="CanPause" type="b" access="read"/>
+    <property name="CanSeek" type="b" access="read"/>
+    <property name="CanControl" type="b" access="read"/>
+  </interface>
+</node>`
+
+// player properties announced with PropertiesChanged, the position is not
+// announced as clients advance it themselves.
+var mpris_changing = []string{
+	"PlaybackStatus", "LoopStatus", "Metadata", "Volume",
+	"CanGoNext", "CanGoPrevious", "CanPlay", "CanPause", "CanSeek",
+}
+
+func start_mpris(d *Daemon, m *MusicManager) {
+	if !d.config.Mpris {
+		return
+	}
+	conn, err := dbus.ConnectSessionBus()
+	if err != nil {
+		logger(log_mpris).Error("cannot connect to the session bus", "err", err)
+		return
+	}
+	if err := serve_mpris(conn, m); err != nil {
+		logger(log_mpris).Error("cannot register", "name", mpris_name, "err", err)
+		conn.Close()
+		return
+	}
+	logger(log_mpris).Info("registered on the session bus", "name", mpris_name)
+	d.mpris = conn
+}
+
+// exports the interfaces on conn and announces the changes of the player
+// until conn is closed.
+func serve_mpris(conn *dbus.Conn, m *MusicManager) error {
+	tables := map[string]map[string]any{
+		"org.freedesktop.DBus.Introspectable": {
+			"Introspect": func() (string, *dbus.Error) {
+				return mpris_introspection, nil
+			},
+		},
+		dbus_properties: mpris_properties(m),
+		mpris_root: {
+			"Raise": func() *dbus.Error { return nil },
+			"Quit": func() *dbus.Error { return nil },
+		},
+		mpris_player: mpris_methods(conn, m),
+	}
+	for iface, methods := range tables {
+		if err := conn.ExportMethodTable(methods, mpris_path, iface); err != nil {
+			return err
+		}
+	}
+	reply, err := conn.RequestName(mpris_name, dbus.NameFlagDoNotQueue)
+	if err != nil {
+		return err
+	}
+	if reply != dbus.RequestNameReplyPrimaryOwner {
+		return fmt.Errorf("the name is already taken")
+	}
+	events := m.events.subscribe()
+	go func() {
+		defer m.events.unsubscribe(events)
+		for {
+			select {
+			case <-conn.Context().Done():
+				return
+			case event := <-events:
+				properties := mpris_player_properties(event.Status)
+				changed := map[string]dbus.Variant{}
+				for _, name := range mpris_changing {
+					changed[name] = properties[name]
+				}
+				conn.Emit(mpris_path, dbus_properties+".PropertiesChanged", mpris_player, changed, []string{})
+			}
+		}
+	}()
+	return nil
+}
+
+func mpris_track_id(song *Song) dbus.ObjectPath {
+	if song == nil {
+		return "/org/mpris/MediaPlayer2/TrackList/NoTrack"
+	}
+	return dbus.ObjectPath(fmt.Sprintf("/org/mpris/MediaPlayer2/apollo/track/%d", song.Id))
+}
+
+func mpris_root_properties() map[string]dbus.Variant {
+	types := slices.Sorted(maps.Values(audio_types))
+	return map[string]dbus.Variant{
+		"CanQuit": dbus.MakeVariant(false),
+		"CanRaise": dbus.MakeVariant(false),
+		"HasTrackList": dbus.MakeVariant(false),
+		"Identity": dbus.MakeVariant("Apollo"),
+		"SupportedUriSchemes": dbus.MakeVariant([]string{"file"}),
+		"SupportedMimeTypes": dbus.MakeVariant(types),
+	}
+}
+
+func mpris_player_properties(status Status) map[string]dbus.Variant {
+	playback := "Stopped"
+	if status.Playing && status.Paused {
+		playback = "Paused"
+	} else if status.Playing {
+		playback = "Playing"
+	}
+	loop := "None"
+	if status.Loop {
+		loop = "Playlist"
+	}
+	metadata := map[string]dbus.Variant{
+		"mpris:trackid": dbus.MakeVariant(mpris_track_id(status.Song)),
+	}
+	if status.Song != nil {
+		metadata["xesam:title"] = dbus.MakeVariant(status.Song.Title)
+		metadata["xesam:url"] = dbus.MakeVariant("file://" + status.Song.Path)
+	}
+	if status.Duration > 0 {
+		metadata["mpris:length"] = dbus.MakeVariant(int64(status.Duration * mpris_second))
+	}
+	has_songs := status.Length > 0
+	return map[string]dbus.Variant{
+		"PlaybackStatus": dbus.MakeVariant(playback),
+		"LoopStatus": dbus.MakeVariant(loop),
+		"Rate": dbus.MakeVariant(1.0),
+		"Shuffle": dbus.MakeVariant(false),
+		"Metadata": dbus.MakeVariant(metadata),
+		"Volume": dbus.MakeVariant(linear_volume(status.Volume)),
+		"Position": dbus.MakeVariant(int64(status.Position * mpris_second)),
+		"MinimumRate": dbus.MakeVariant(1.0),
+		"MaximumRate": dbus.MakeVariant(1.0),
+		"CanGoNext": dbus.MakeVariant(has_songs),
+		"CanGoPrevious": dbus.MakeVariant(has_songs),
+		"CanPlay": dbus.MakeVariant(has_songs),
+		"CanPause": dbus.MakeVariant(has_songs),
+		"CanSeek": dbus.MakeVariant(status.Playing),
+		"CanControl": dbus.MakeVariant(true),
+	}
+}
+
+func mpris_interface_properties(m *MusicManager, iface string) (map[string]dbus.Variant, *dbus.Error) {
+	switch iface {
+	case mpris_root:
+		return mpris_root_properties(), nil
+	case mpris_player:
+		var status Status
+		m.Status("", &status)
+		return mpris_player_properties(status), nil
+	}
+	return nil, dbus.NewError("org.freedesktop.DBus.Error.UnknownInterface", []any{iface})
+}
+
+func mpris_properties(m *MusicManager) map[string]any {
+	return map[string]any{
+		"Get": func(iface string, name string) (dbus.Variant, *dbus.Error) {
+			properties, err := mpris_interface_properties(m, iface)
+			if err != nil {
+				return dbus.Variant{}, err
+			}
+			value, ok := properties[name]
+			if !ok {
+				return dbus.Variant{}, dbus.NewError("org.freedesktop.DBus.Error.UnknownProperty", []any{name})
+			}
+			return value, nil
+		},
+		"GetAll": func(iface string) (map[string]dbus.Variant, *dbus.Error) {
+			return mpris_interface_properties(m, iface)
+		},
+		"Set": func(iface string, name string, value dbus.Variant) *dbus.Error {
+			if iface != mpris_player || name != "Volume" {
+				return dbus.NewError("org.freedesktop.DBus.Error.PropertyReadOnly", []any{name})
+			}
+			volume, ok := value.Value().(float64)
+			if !ok {
+				return dbus.NewError("org.freedesktop.DBus.Error.InvalidArgs", []any{"Volume is a double"})
+			}
+			var status Status
+			m.Status("", &status)
+			var reply PlayerReply
+			return mpris_error(m.Volume(from_linear_volume(volume) - status.Volume, &reply))
+		},
+	}
+}
+
+func mpris_error(err error) *dbus.Error {
+	if err == nil {
+		return nil
+	}
+	return dbus.MakeFailedError(err)
+}
+
+func mpris_methods(conn *dbus.Conn, m *MusicManager) map[string]any {
+	call := func(method func(string, *PlayerReply) error) *dbus.Error {
+		var reply PlayerReply
+		return mpris_error(method("", &reply))
+	}
+	status := func() Status {
+		var status Status
+		m.Status("", &status)
+		return status
+	}
+	seek := func(offset float64) *dbus.Error {
+		var reply PlayerReply
+		if err := m.Seek(offset, &reply); err != nil {
+			return mpris_error(err)
+		}
+		if reply.Action == action_seeked {
+			conn.Emit(mpris_path, mpris_player+".Seeked", int64(reply.Status.Position * mpris_second))
+		}
+		return nil
+	}
+	return map[string]any{
+		"Next": func() *dbus.Error {
+			return call(m.Next)
+		},
+		"Previous": func() *dbus.Error {
+			return call(m.Previous)
+		},
+		"Pause": func() *dbus.Error {
+			if s := status(); s.Playing && !s.Paused {
+				return call(m.Toggle)
+			}
+			return nil
+		},
+		"Play": func() *dbus.Error {
+			if s := status(); s.Playing && s.Paused {
+				return call(m.Toggle)
+			}
+			return call(m.Play)
+		},
+		"PlayPause": func() *dbus.Error {
+			if status().Playing {
+				return call(m.Toggle)
+			}
+			return call(m.Play)
+		},
+		"Stop": func() *dbus.Error {
+			return call(m.Stop)
+		},
+		"Seek": func(offset int64) *dbus.Error {
+			return seek(float64(offset) / mpris_second)
+		},
+		// ignored when the track is no longer the current one
+		"SetPosition": func(track dbus.ObjectPath, position int64) *dbus.Error {
+			s := status()
+			if track != mpris_track_id(s.Song) {
+				return nil
+			}
+			return seek(float64(position) / mpris_second - s.Position)
+		},
+		"OpenUri": func(uri string) *dbus.Error {
+			return dbus.NewError("org.freedesktop.DBus.Error.NotSupported", []any{"opening uris is not supported"})
+		},
+	}
+}
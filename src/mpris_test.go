@@ -0,0 +1,147 @@
+package main
+
+import (
+	"bufio"
+	"os/exec"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/godbus/dbus/v5"
+)
+
+// starts a private session bus and returns its address.
+func start_test_bus(t *testing.T) string {
+	t.Helper()
+	if _, err := exec.LookPath("dbus-daemon"); err != nil {
+		t.Skip("dbus-daemon is not installed")
+	}
+	cmd := exec.Command("dbus-daemon", "--session", "--nofork", "--nopidfile", "--print-address")
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := cmd.Start(); err != nil {
+		t.Fatalf("starting dbus-daemon: %v", err)
+	}
+	t.Cleanup(func() {
+		cmd.Process.Kill()
+		cmd.Wait()
+	})
+	address, err := bufio.NewReader(stdout).ReadString('\n')
+	if err != nil {
+		t.Fatalf("reading the address of dbus-daemon: %v", err)
+	}
+	return strings.TrimSpace(address)
+}
+
+func connect_test_bus(t *testing.T, address string) *dbus.Conn {
+	t.Helper()
+	conn, err := dbus.Connect(address)
+	if err != nil {
+		t.Fatalf("connecting to %s: %v", address, err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	return conn
+}
+
+func get_mpris_property(t *testing.T, player dbus.BusObject, name string) any {
+	t.Helper()
+	value, err := player.GetProperty(mpris_player + "." + name)
+	if err != nil {
+		t.Fatalf("getting %s: %v", name, err)
+	}
+	return value.Value()
+}
+
+// waits for PropertiesChanged to announce the playback status.
+func next_playback_status(t *testing.T, signals chan *dbus.Signal, want string) {
+	t.Helper()
+	timeout := time.After(2 * time.Second)
+	for {
+		select {
+		case signal := <-signals:
+			if signal.Name != dbus_properties+".PropertiesChanged" {
+				continue
+			}
+			changed := signal.Body[1].(map[string]dbus.Variant)
+			if changed["PlaybackStatus"].Value() == want {
+				return
+			}
+		case <-timeout:
+			t.Fatalf("no PropertiesChanged with PlaybackStatus %s", want)
+		}
+	}
+}
+
+func TestMpris(t *testing.T) {
+	address := start_test_bus(t)
+	_, config := setup_test_env(t)
+	config.Loop = true
+	run_cmd(config, "sync")
+	td := start_test_daemon(t, config)
+	if err := serve_mpris(connect_test_bus(t, address), td.manager); err != nil {
+		t.Fatalf("serve_mpris: %v", err)
+	}
+
+	client := connect_test_bus(t, address)
+	if err := client.AddMatchSignal(dbus.WithMatchObjectPath(mpris_path)); err != nil {
+		t.Fatal(err)
+	}
+	signals := make(chan *dbus.Signal, 64)
+	client.Signal(signals)
+	player := client.Object(mpris_name, mpris_path)
+
+	if status := get_mpris_property(t, player, "PlaybackStatus"); status != "Stopped" {
+		t.Errorf("PlaybackStatus = %v, want Stopped", status)
+	}
+	identity, err := player.GetProperty(mpris_root + ".Identity")
+	if err != nil || identity.Value() != "Apollo" {
+		t.Errorf("Identity = %v, %v", identity, err)
+	}
+
+	if err := player.Call(mpris_player+".PlayPause", 0).Err; err != nil {
+		t.Fatalf("PlayPause: %v", err)
+	}
+	next_playback_status(t, signals, "Playing")
+	metadata := get_mpris_property(t, player, "Metadata").(map[string]dbus.Variant)
+	if title, _ := metadata["xesam:title"].Value().(string); title == "" {
+		t.Errorf("Metadata has no title: %v", metadata)
+	}
+	if loop := get_mpris_property(t, player, "LoopStatus"); loop != "Playlist" {
+		t.Errorf("LoopStatus = %v, want Playlist", loop)
+	}
+
+	if err := player.Call(mpris_player+".PlayPause", 0).Err; err != nil {
+		t.Fatalf("PlayPause: %v", err)
+	}
+	next_playback_status(t, signals, "Paused")
+	// paused the position stays where the seek left it
+	if err := player.Call(mpris_player+".Seek", 0, int64(100000)).Err; err != nil {
+		t.Fatalf("Seek: %v", err)
+	}
+	if position := get_mpris_property(t, player, "Position").(int64); position < 100000 {
+		t.Errorf("Position = %d after seeking 100ms", position)
+	}
+
+	if err := player.SetProperty(mpris_player+".Volume", dbus.MakeVariant(0.5)); err != nil {
+		t.Fatalf("setting Volume: %v", err)
+	}
+	if volume := get_mpris_property(t, player, "Volume"); volume != 0.5 {
+		t.Errorf("Volume = %v, want 0.5", volume)
+	}
+	if err := player.SetProperty(mpris_player+".Rate", dbus.MakeVariant(2.0)); err == nil {
+		t.Errorf("setting Rate: want an error")
+	}
+
+	if err := player.Call(mpris_player+".Next", 0).Err; err != nil {
+		t.Fatalf("Next: %v", err)
+	}
+	if err := player.Call(mpris_player+".Stop", 0).Err; err != nil {
+		t.Fatalf("Stop: %v", err)
+	}
+	next_playback_status(t, signals, "Stopped")
+	if _, _, _, playing, _ := td.state(); playing {
+		t.Errorf("still playing after Stop")
+	}
+}
@@ -0,0 +1,213 @@
+package main
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/gopxl/beep"
+	"github.com/gopxl/beep/speaker"
+)
+
+// every song is resampled to the rate of the output
+const output_rate beep.SampleRate = 44100
+
+// Output is where the samples of the playing songs go. Streamers added with
+// Play must only be modified while the output is locked.
+type Output interface {
+	Play(s beep.Streamer)
+	Clear()
+	Lock()
+	Unlock()
+	Close() error
+}
+
+func new_output(config *Config) (Output, error) {
+	switch config.Output {
+	case "speaker":
+		return new_speaker_output()
+	case "null":
+		return new_paced_output(config.OutputSpeed, nil), nil
+	case "wav":
+		return new_wav_output(config.OutputFile, config.OutputSpeed)
+	}
+	return nil, fmt.Errorf("unknown output '%s'", config.Output)
+}
+
+type speaker_output struct{}
+
+func new_speaker_output() (Output, error) {
+	err := speaker.Init(output_rate, output_rate.N(time.Second/10))
+	if err != nil {
+		return nil, err
+	}
+	return speaker_output{}, nil
+}
+
+func (speaker_output) Play(s beep.Streamer) { speaker.Play(s) }
+func (speaker_output) Clear() { speaker.Clear() }
+func (speaker_output) Lock() { speaker.Lock() }
+func (speaker_output) Unlock() { speaker.Unlock() }
+func (speaker_output) Close() error {
+	speaker.Close()
+	return nil
+}
+
+// consumes samples like a sound card would, speed times faster than real
+// time, handing them to write when it is set.
+type paced_output struct {
+	mu sync.Mutex
+	mixer beep.Mixer
+	speed float64
+	write func(samples [][2]float64) error
+	done chan struct{}
+	closed sync.Once
+}
+
+const paced_tick = 10 * time.Millisecond
+
+func new_paced_output(speed float64, write func(samples [][2]float64) error) *paced_output {
+	if speed <= 0 {
+		speed = 1
+	}
+	o := &paced_output{
+		speed: speed,
+		write: write,
+		done: make(chan struct{}),
+	}
+	go o.run()
+	return o
+}
+
+func (o *paced_output) run() {
+	n := int(float64(output_rate.N(paced_tick)) * o.speed)
+	samples := make([][2]float64, max(n, 1))
+	ticker := time.NewTicker(paced_tick)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-o.done:
+			return
+		case <-ticker.C:
+		}
+		o.mu.Lock()
+		if stopped(o.done) {
+			o.mu.Unlock()
+			return
+		}
+		// nothing is written while idle, only while something is playing
+		if o.mixer.Len() > 0 {
+			o.mixer.Stream(samples)
+			if o.write != nil {
+				if err := o.write(samples); err != nil {
+					logger(log_player).Error("cannot write the output", "err", err)
+				}
+			}
+		}
+		o.mu.Unlock()
+	}
+}
+
+func (o *paced_output) Play(s beep.Streamer) {
+	o.mu.Lock()
+	o.mixer.Add(s)
+	o.mu.Unlock()
+}
+
+func (o *paced_output) Clear() {
+	o.mu.Lock()
+	o.mixer.Clear()
+	o.mu.Unlock()
+}
+
+func (o *paced_output) Lock() { o.mu.Lock() }
+func (o *paced_output) Unlock() { o.mu.Unlock() }
+
+func (o *paced_output) Close() error {
+	o.closed.Do(func() { close(o.done) })
+	return nil
+}
+
+// writes everything played to a 16 bit stereo wav file.
+type wav_output struct {
+	*paced_output
+	file *os.File
+	size uint32
+	buf []byte
+}
+
+func new_wav_output(path string, speed float64) (Output, error) {
+	file, err := os.Create(path)
+	if err != nil {
+		return nil, err
+	}
+	o := &wav_output{ file: file }
+	if err = o.write_header(); err != nil {
+		file.Close()
+		return nil, err
+	}
+	o.paced_output = new_paced_output(speed, o.write)
+	return o, nil
+}
+
+func (o *wav_output) write_header() error {
+	_, err := o.file.Seek(0, 0)
+	if err != nil {
+		return err
+	}
+	if err = write_wav_header(o.file, o.size); err != nil {
+		return err
+	}
+	_, err = o.file.Seek(0, 2)
+	return err
+}
+
+// the header is updated after every write so the file stays valid even if
+// the daemon does not exit cleanly.
+func (o *wav_output) write(samples [][2]float64) error {
+	o.buf = append_pcm(o.buf[:0], samples)
+	_, err := o.file.Write(o.buf)
+	if err != nil {
+		return err
+	}
+	o.size += uint32(len(o.buf))
+	return o.write_header()
+}
+
+// header of a 16 bit stereo wav with size bytes of samples.
+func write_wav_header(w io.Writer, size uint32) error {
+	header := []any{
+		[4]byte{'R', 'I', 'F', 'F'}, uint32(36 + size),
+		[4]byte{'W', 'A', 'V', 'E'},
+		[4]byte{'f', 'm', 't', ' '}, uint32(16),
+		uint16(1), uint16(2), uint32(output_rate), uint32(output_rate) * 4, uint16(4), uint16(16),
+		[4]byte{'d', 'a', 't', 'a'}, size,
+	}
+	for _, v := range header {
+		if err := binary.Write(w, binary.LittleEndian, v); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// appends the samples as 16 bit little endian pcm.
+func append_pcm(buf []byte, samples [][2]float64) []byte {
+	for _, sample := range samples {
+		for _, v := range sample {
+			v = min(max(v, -1), 1)
+			buf = binary.LittleEndian.AppendUint16(buf, uint16(int16(v * (1<<15 - 1))))
+		}
+	}
+	return buf
+}
+
+func (o *wav_output) Close() error {
+	o.paced_output.Close()
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	return o.file.Close()
+}
@@ -0,0 +1,63 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/gopxl/beep"
+	"github.com/gopxl/beep/generators"
+	"github.com/gopxl/beep/wav"
+)
+
+func TestWavOutput(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "output.wav")
+	output, err := new_wav_output(path, 10)
+	if err != nil {
+		t.Fatalf("new_wav_output: %v", err)
+	}
+	tone, err := generators.SineTone(output_rate, 440)
+	if err != nil {
+		t.Fatalf("sine tone: %v", err)
+	}
+	done := make(chan struct{})
+	output.Play(beep.Seq(beep.Take(output_rate.N(time.Second), tone), beep.Callback(func() {
+		close(done)
+	})))
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatalf("output did not consume the tone")
+	}
+	output.Close()
+
+	file, err := os.Open(path)
+	if err != nil {
+		t.Fatalf("opening output: %v", err)
+	}
+	defer file.Close()
+	streamer, format, err := wav.Decode(file)
+	if err != nil {
+		t.Fatalf("decoding output: %v", err)
+	}
+	if format.SampleRate != output_rate || format.NumChannels != 2 {
+		t.Errorf("format = %+v", format)
+	}
+	// the last tick is padded with silence
+	if streamer.Len() < output_rate.N(time.Second) {
+		t.Errorf("output has %d samples, want at least %d", streamer.Len(), output_rate.N(time.Second))
+	}
+}
+
+func TestNullOutputIdle(t *testing.T) {
+	output := new_paced_output(1, nil)
+	defer output.Close()
+	output.Play(beep.Silence(10))
+	time.Sleep(50 * time.Millisecond)
+	output.Lock()
+	defer output.Unlock()
+	if output.mixer.Len() != 0 {
+		t.Errorf("mixer still has %d streamer(s)", output.mixer.Len())
+	}
+}
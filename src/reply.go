@@ -0,0 +1,189 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/rpc"
+	"slices"
+	"strings"
+	"time"
+)
+
+// Replies of the MusicManager methods, formatting them is up to the client.
+// The json tags are what `apollo --json` prints.
+
+type Song struct {
+	Id int `json:"id"`
+	Title string `json:"title"`
+	Path string `json:"path"`
+}
+
+type Status struct {
+	PlaylistId int `json:"playlist_id"`
+	Playlist string `json:"playlist"`
+	Length int `json:"length"`
+	Index int `json:"index"`
+	// nil when the playlist is empty
+	Song *Song `json:"song"`
+	Playing bool `json:"playing"`
+	Paused bool `json:"paused"`
+	Volume float64 `json:"volume"`
+	Loop bool `json:"loop"`
+	// seconds into the song and its length, 0 when stopped
+	Position float64 `json:"position"`
+	Duration float64 `json:"duration"`
+}
+
+// actions of PlayerReply
+const (
+	action_started = "started"
+	action_resumed = "resumed"
+	action_paused = "paused"
+	action_stopped = "stopped"
+	action_skipped = "skipped"
+	action_selected = "selected"
+	action_volume = "volume"
+	action_seeked = "seeked"
+	action_already_playing = "already_playing"
+	action_not_playing = "not_playing"
+)
+
+// what a player command did and the state it left the player in.
+type PlayerReply struct {
+	Action string `json:"action"`
+	// the playlist was switched before playing
+	Switched bool `json:"switched,omitempty"`
+	// steps the volume changed by
+	Change float64 `json:"change,omitempty"`
+	Status Status `json:"status"`
+}
+
+type PlaylistReply struct {
+	Id int `json:"id"`
+	Name string `json:"name"`
+	Current int `json:"current"`
+	Songs []Song `json:"songs"`
+}
+
+type PlaylistSummary struct {
+	Id int `json:"id"`
+	Name string `json:"name"`
+	Count int `json:"count"`
+}
+
+type PlaylistsReply struct {
+	Playlists []PlaylistSummary `json:"playlists"`
+}
+
+type LibraryReply struct {
+	Songs []Song `json:"songs"`
+}
+
+type SyncReply struct {
+	Dir string `json:"dir"`
+	// dir is the configured music_dir
+	Default bool `json:"default"`
+	Added int `json:"added"`
+}
+
+type CleanReply struct {
+	Removed int `json:"removed"`
+}
+
+// a song that failed to play, with the error and when it last did
+type BrokenSong struct {
+	Id int `json:"id"`
+	Title string `json:"title"`
+	Path string `json:"path"`
+	Error string `json:"error"`
+	Time time.Time `json:"time"`
+}
+
+type BrokenReply struct {
+	Songs []BrokenSong `json:"songs"`
+}
+
+// result of create and delete
+type PlaylistChange struct {
+	Name string `json:"name"`
+	Changed bool `json:"changed"`
+}
+
+// result of add and remove
+type SongsChange struct {
+	Playlist string `json:"playlist"`
+	Ids []int `json:"ids"`
+}
+
+// Error codes, sent by net/rpc as the prefix of the error message since only
+// the message goes over the wire.
+const (
+	code_not_found = "not_found"
+	code_invalid = "invalid_argument"
+	code_empty = "empty"
+	code_internal = "internal"
+	code_unauthorized = "unauthorized"
+	// no daemon to send the command to
+	code_not_running = "not_running"
+	// the call never got a reply from the daemon
+	code_rpc = "rpc_failure"
+)
+
+// exit statuses of the cli
+const (
+	exit_ok = 0
+	exit_failure = 1
+	// a wrong command line or argument
+	exit_invalid = 2
+	exit_not_running = 3
+	exit_not_found = 4
+	// the daemon could not be reached or refused the command
+	exit_rpc = 5
+)
+
+var error_codes = []string{
+	code_not_found, code_invalid, code_empty, code_internal,
+	code_unauthorized, code_not_running, code_rpc,
+}
+
+type RpcError struct {
+	Code string `json:"code"`
+	Message string `json:"message"`
+}
+
+func (e *RpcError) Error() string {
+	return fmt.Sprintf("%s: %s", e.Code, e.Message)
+}
+
+func new_rpc_error(code string, format string, a ...any) error {
+	return &RpcError{ Code: code, Message: fmt.Sprintf(format, a...) }
+}
+
+// recovers the code of an error returned by a call to the daemon.
+func as_rpc_error(err error) *RpcError {
+	var rpc_err *RpcError
+	if errors.As(err, &rpc_err) {
+		return rpc_err
+	}
+	var server_err rpc.ServerError
+	if errors.As(err, &server_err) {
+		code, message, found := strings.Cut(string(server_err), ": ")
+		if found && slices.Contains(error_codes, code) {
+			return &RpcError{ Code: code, Message: message }
+		}
+		return &RpcError{ Code: code_internal, Message: string(server_err) }
+	}
+	return &RpcError{ Code: code_rpc, Message: err.Error() }
+}
+
+func to_song(music Music) Song {
+	return Song{ Id: music.id, Title: music.title, Path: music.path }
+}
+
+func to_songs(musics []Music) []Song {
+	songs := []Song{}
+	for _, music := range musics {
+		songs = append(songs, to_song(music))
+	}
+	return songs
+}
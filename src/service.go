@@ -0,0 +1,174 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+)
+
+// running under systemd: `apollo start --foreground` tells it when the daemon
+// is ready, takes the control socket from a socket unit and
+// `apollo service install` writes the user units.
+
+// the first file descriptor passed by socket activation
+const sd_listen_fds_start = 3
+
+// sends state to the service manager, nothing happens when apollo is not run
+// by systemd.
+func sd_notify(state string) error {
+	addr := os.Getenv("NOTIFY_SOCKET")
+	if addr == "" {
+		return nil
+	}
+	// abstract socket
+	if strings.HasPrefix(addr, "@") {
+		addr = "\x00" + addr[1:]
+	}
+	conn, err := net.DialUnix("unixgram", nil, &net.UnixAddr{ Name: addr, Net: "unixgram" })
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	_, err = conn.Write([]byte(state))
+	return err
+}
+
+// tells the service manager why the daemon failed to start.
+func sd_notify_error(err error) error {
+	state := "STATUS=" + strings.ReplaceAll(err.Error(), "\n", " ")
+	var errno syscall.Errno
+	if errors.As(err, &errno) {
+		state += "\nERRNO=" + strconv.Itoa(int(errno))
+	}
+	return sd_notify(state)
+}
+
+// the control socket passed by systemd starting the daemon for a socket
+// unit, nil without one.
+func activated_listener(first_fd int) (net.Listener, error) {
+	pid, err := strconv.Atoi(os.Getenv("LISTEN_PID"))
+	if err != nil || pid != os.Getpid() {
+		return nil, nil
+	}
+	fds, err := strconv.Atoi(os.Getenv("LISTEN_FDS"))
+	if err != nil || fds < 1 {
+		return nil, nil
+	}
+	// the children of the daemon are not activated
+	os.Unsetenv("LISTEN_PID")
+	os.Unsetenv("LISTEN_FDS")
+	os.Unsetenv("LISTEN_FDNAMES")
+	file := os.NewFile(uintptr(first_fd), "apollo.sock")
+	defer file.Close()
+	listener, err := net.FileListener(file)
+	if err != nil {
+		return nil, fmt.Errorf("cannot use the activated socket: %v", err)
+	}
+	return listener, nil
+}
+
+const service_unit = `[Unit]
+Description=Apollo music player
+Documentation=man:apollo(1)
+
+[Service]
+Type=notify
+ExecStart=%s start --foreground
+Restart=on-failure
+
+[Install]
+WantedBy=default.target
+`
+
+const socket_unit = `[Unit]
+Description=Apollo music player control socket
+
+[Socket]
+ListenStream=%s
+SocketMode=0600
+DirectoryMode=0700
+
+[Install]
+WantedBy=sockets.target
+`
+
+// the ListenStream of the socket unit: systemd takes a path, a port or a
+// numeric address, so the host of a tcp address is resolved.
+func listen_stream(config *Config) (string, error) {
+	if config.RpcNetwork != "tcp" {
+		return config.RpcAddr, nil
+	}
+	host, port, err := net.SplitHostPort(config.RpcAddr)
+	if err != nil {
+		return "", new_rpc_error(code_invalid, "invalid rpc address %s: %v", config.RpcAddr, err)
+	}
+	if _, err := strconv.Atoi(port); err != nil {
+		number, err := net.LookupPort("tcp", port)
+		if err != nil {
+			return "", new_rpc_error(code_invalid, "cannot resolve the port of %s: %v", config.RpcAddr, err)
+		}
+		port = strconv.Itoa(number)
+	}
+	// all the interfaces
+	if host == "" {
+		return port, nil
+	}
+	if net.ParseIP(host) != nil {
+		return net.JoinHostPort(host, port), nil
+	}
+	ips, err := net.LookupIP(host)
+	if err != nil || len(ips) == 0 {
+		return "", new_rpc_error(code_invalid, "cannot resolve the host of %s for the socket unit: %v", config.RpcAddr, err)
+	}
+	// the first ipv4 address, localhost is 127.0.0.1 rather than ::1
+	ip := ips[0]
+	for _, candidate := range ips {
+		if candidate.To4() != nil {
+			ip = candidate
+			break
+		}
+	}
+	return net.JoinHostPort(ip.String(), port), nil
+}
+
+// writes apollo.service and apollo.socket for the daemon of config.
+func install_service(w io.Writer, config *Config) error {
+	executable, err := os.Executable()
+	if err != nil {
+		return new_rpc_error(code_internal, "cannot find the apollo executable: %v", err)
+	}
+	stream, err := listen_stream(config)
+	if err != nil {
+		return err
+	}
+	user_config, err := os.UserConfigDir()
+	if err != nil {
+		return new_rpc_error(code_internal, "cannot find the config directory: %v", err)
+	}
+	dirpath := filepath.Join(user_config, "systemd", "user")
+	if err := os.MkdirAll(dirpath, 0755); err != nil {
+		return new_rpc_error(code_internal, "cannot create %s: %v", dirpath, err)
+	}
+	units := map[string]string{
+		"apollo.service": fmt.Sprintf(service_unit, executable),
+		"apollo.socket": fmt.Sprintf(socket_unit, stream),
+	}
+	for name, unit := range units {
+		path := filepath.Join(dirpath, name)
+		if err := os.WriteFile(path, []byte(unit), 0644); err != nil {
+			return new_rpc_error(code_internal, "cannot write %s: %v", path, err)
+		}
+	}
+	if !config.quiet {
+		fmt.Fprintf(w, "Apollo: Installed apollo.service and apollo.socket in %s\n", dirpath)
+		fmt.Fprintf(w, "Start the daemon with the first command: systemctl --user daemon-reload && systemctl --user enable --now apollo.socket\n")
+		fmt.Fprintf(w, "Or at login: systemctl --user daemon-reload && systemctl --user enable --now apollo.service\n")
+	}
+	return nil
+}
@@ -0,0 +1,169 @@
+package main
+
+import (
+	"bytes"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+)
+
+func TestSdNotify(t *testing.T) {
+	if err := sd_notify("READY=1"); err != nil {
+		t.Errorf("sd_notify without NOTIFY_SOCKET: %v", err)
+	}
+	path := filepath.Join(t.TempDir(), "notify")
+	conn, err := net.ListenUnixgram("unixgram", &net.UnixAddr{ Name: path, Net: "unixgram" })
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	t.Setenv("NOTIFY_SOCKET", path)
+	if err := sd_notify("READY=1"); err != nil {
+		t.Fatalf("sd_notify: %v", err)
+	}
+	buf := make([]byte, 64)
+	conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	n, err := conn.Read(buf)
+	if err != nil || string(buf[:n]) != "READY=1" {
+		t.Errorf("read %q, %v", buf[:n], err)
+	}
+}
+
+func TestStartRpcError(t *testing.T) {
+	dir := t.TempDir()
+	conn, err := net.ListenUnixgram("unixgram", &net.UnixAddr{ Name: filepath.Join(dir, "notify"), Net: "unixgram" })
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	t.Setenv("NOTIFY_SOCKET", filepath.Join(dir, "notify"))
+	// another daemon holds the socket
+	addr := filepath.Join(dir, "apollo.sock")
+	socket, err := net.Listen("unix", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer socket.Close()
+	d := &Daemon{ network: "unix", config: &Config{ RpcAddr: addr } }
+	if err := start_rpc(d, nil); err == nil {
+		t.Fatalf("start_rpc listened on a socket in use")
+	}
+	buf := make([]byte, 256)
+	conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	n, err := conn.Read(buf)
+	want := "ERRNO=" + strconv.Itoa(int(syscall.EADDRINUSE))
+	if err != nil || !strings.HasPrefix(string(buf[:n]), "STATUS=Apollo is already listening") || !strings.HasSuffix(string(buf[:n]), want) {
+		t.Errorf("read %q, %v", buf[:n], err)
+	}
+}
+
+func TestActivatedListener(t *testing.T) {
+	if listener, err := activated_listener(sd_listen_fds_start); listener != nil || err != nil {
+		t.Fatalf("activated without LISTEN_FDS: %v, %v", listener, err)
+	}
+	path := filepath.Join(t.TempDir(), "apollo.sock")
+	socket, err := net.Listen("unix", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer socket.Close()
+	// a copy of the socket stands for the one passed by systemd, owned by
+	// activated_listener like fd 3 would be
+	file, err := socket.(*net.UnixListener).File()
+	if err != nil {
+		t.Fatal(err)
+	}
+	fd, err := syscall.Dup(int(file.Fd()))
+	file.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("LISTEN_PID", strconv.Itoa(os.Getpid()))
+	t.Setenv("LISTEN_FDS", "1")
+	listener, err := activated_listener(fd)
+	if err != nil || listener == nil {
+		t.Fatalf("activated_listener = %v, %v", listener, err)
+	}
+	defer listener.Close()
+	if os.Getenv("LISTEN_FDS") != "" {
+		t.Errorf("LISTEN_FDS is still set")
+	}
+	go func() {
+		if conn, err := net.Dial("unix", path); err == nil {
+			conn.Close()
+		}
+	}()
+	if conn, err := listener.Accept(); err != nil {
+		t.Errorf("accept: %v", err)
+	} else {
+		conn.Close()
+	}
+}
+
+func TestServiceInstall(t *testing.T) {
+	_, config := setup_test_env(t)
+	var out bytes.Buffer
+	if err := install_service(&out, config); err != nil {
+		t.Fatalf("install_service: %v", err)
+	}
+	dirpath := filepath.Join(os.Getenv("XDG_CONFIG_HOME"), "systemd", "user")
+	service, _ := os.ReadFile(filepath.Join(dirpath, "apollo.service"))
+	if !strings.Contains(string(service), "Type=notify\n") || !strings.Contains(string(service), " start --foreground\n") {
+		t.Errorf("apollo.service:\n%s", service)
+	}
+	socket, _ := os.ReadFile(filepath.Join(dirpath, "apollo.socket"))
+	if !strings.Contains(string(socket), "ListenStream=" + config.RpcAddr + "\n") {
+		t.Errorf("apollo.socket:\n%s", socket)
+	}
+	if !strings.Contains(out.String(), "enable --now apollo.socket") {
+		t.Errorf("output: %q", out.String())
+	}
+
+	// a tcp address is numeric in the unit
+	config.RpcNetwork, config.RpcAddr = "tcp", "localhost:42069"
+	if err := install_service(&out, config); err != nil {
+		t.Fatalf("install_service over tcp: %v", err)
+	}
+	socket, _ = os.ReadFile(filepath.Join(dirpath, "apollo.socket"))
+	if !strings.Contains(string(socket), "ListenStream=127.0.0.1:42069\n") {
+		t.Errorf("apollo.socket over tcp:\n%s", socket)
+	}
+}
+
+func TestListenStream(t *testing.T) {
+	for addr, want := range map[string]string{
+		"localhost:42069": "127.0.0.1:42069",
+		":42069": "42069",
+		"[::1]:6600": "[::1]:6600",
+		"10.0.0.2:5000": "10.0.0.2:5000",
+	} {
+		stream, err := listen_stream(&Config{ RpcNetwork: "tcp", RpcAddr: addr })
+		if err != nil || stream != want {
+			t.Errorf("%s: %q, %v, want %q", addr, stream, err, want)
+		}
+	}
+	if stream, _ := listen_stream(&Config{ RpcNetwork: "unix", RpcAddr: "/run/apollo.sock" }); stream != "/run/apollo.sock" {
+		t.Errorf("unix: %q", stream)
+	}
+	if _, err := listen_stream(&Config{ RpcNetwork: "tcp", RpcAddr: "localhost" }); err == nil {
+		t.Errorf("listen_stream without a port")
+	}
+}
+
+func TestShutdown(t *testing.T) {
+	_, config := setup_test_env(t)
+	td := start_test_daemon(t, config)
+	expect_output(t, config, "Playlist: [0] All Songs", "playlist")
+	td.daemon.shutdown()
+	if _, err := dial_rpc(config); err == nil {
+		t.Errorf("the daemon still accepts connections after shutdown")
+	}
+	if _, err := os.Stat(config.path); err != nil {
+		t.Errorf("config not saved: %v", err)
+	}
+}
@@ -0,0 +1,139 @@
+package main
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/gopxl/beep"
+)
+
+// the session is where the player is: saved to session.json in the state dir
+// on every change and when the daemon stops, restored by
+// `apollo start --resume`.
+type Session struct {
+	Playlist string `json:"playlist"`
+	// the songs of the "Unlisted" playlist, the others are read from the db
+	Songs []Song `json:"songs,omitempty"`
+	Index int `json:"index"`
+	// seconds into the song
+	Position float64 `json:"position"`
+	Volume float64 `json:"volume"`
+	Playing bool `json:"playing"`
+	Paused bool `json:"paused"`
+}
+
+func session_filepath(config *Config) string {
+	return filepath.Join(config.StateDir, "session.json")
+}
+
+// must be called with m.mu held
+func (m *MusicManager) session() Session {
+	status := m.status()
+	session := Session{
+		Playlist: status.Playlist,
+		Index: status.Index,
+		Position: status.Position,
+		Volume: status.Volume,
+		Playing: status.Playing,
+		Paused: status.Paused,
+	}
+	if m.playlist.name == "Unlisted" {
+		session.Songs = to_songs(m.playlist.songs)
+	}
+	return session
+}
+
+// written to a temporary file first, a daemon killed while saving keeps the
+// previous session.
+func save_session(config *Config, session Session) error {
+	data, err := json.MarshalIndent(session, "", "  ")
+	if err != nil {
+		return err
+	}
+	path := session_filepath(config)
+	if err := os.WriteFile(path + ".tmp", data, 0644); err != nil {
+		return err
+	}
+	return os.Rename(path + ".tmp", path)
+}
+
+func load_session(config *Config) (Session, error) {
+	var session Session
+	data, err := os.ReadFile(session_filepath(config))
+	if err != nil {
+		return session, err
+	}
+	err = json.Unmarshal(data, &session)
+	return session, err
+}
+
+// saves the session after every event until the daemon shuts down, which
+// saves it a last time.
+func (m *MusicManager) keep_session() {
+	for range m.events.subscribe() {
+		m.mu.Lock()
+		if m.closed {
+			m.mu.Unlock()
+			return
+		}
+		session := m.session()
+		m.mu.Unlock()
+		if err := save_session(m.config, session); err != nil {
+			logger(log_player).Error("cannot save the session", "err", err)
+		}
+	}
+}
+
+// puts the player back where the session left off, the songs of a playlist
+// are the ones in the db now.
+func (m *MusicManager) restore(session Session) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	playlist := Playlist{ id: 0, name: session.Playlist, songs: []Music{} }
+	switch session.Playlist {
+	case "Unlisted":
+		for _, song := range session.Songs {
+			playlist.songs = append(playlist.songs, Music{ song.Id, song.Title, song.Path })
+		}
+	case "All Songs":
+		playlist.songs = get_all_songs(m.db)
+	default:
+		var err error
+		playlist, err = get_playlist(m.db, session.Playlist)
+		if err != nil {
+			return new_rpc_error(code_not_found, "getting playlist '%s' from db: %v", session.Playlist, err)
+		}
+	}
+	m.stop_playlist()
+	m.playlist = playlist
+	m.current = session.Index
+	if m.current < 0 || m.current >= playlist.length() {
+		m.current = 0
+	}
+	m.volume = session.Volume
+	if session.Playing && playlist.length() > 0 {
+		m.resume_at = session.Position
+		m.start_playlist()
+		// read by play_song once m.mu is released
+		m.paused = session.Paused
+	}
+	return nil
+}
+
+// seeks the song just decoded to where the session left off, must be called
+// with m.mu held.
+func (m *MusicManager) seek_resumed(streamer beep.StreamSeeker, format beep.Format) {
+	if m.resume_at <= 0 {
+		return
+	}
+	position := format.SampleRate.N(time.Duration(m.resume_at * float64(time.Second)))
+	m.resume_at = 0
+	if position >= streamer.Len() {
+		return
+	}
+	if err := streamer.Seek(position); err != nil {
+		logger(log_player).Warn("cannot resume the song", "position", position, "err", err)
+	}
+}
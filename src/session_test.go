@@ -0,0 +1,95 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+// waits until the manager is playing a song, with its controls set
+func wait_song(t *testing.T, m *MusicManager) {
+	t.Helper()
+	for deadline := time.Now().Add(2 * time.Second); ; time.Sleep(5 * time.Millisecond) {
+		m.mu.Lock()
+		started := m.song != nil
+		m.mu.Unlock()
+		if started {
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("no song is playing")
+		}
+	}
+}
+
+func TestKeepSession(t *testing.T) {
+	m := new_test_manager(t, 3)
+	m.events = new_event_bus()
+	go m.keep_session()
+	var reply PlayerReply
+	m.Play("", &reply)
+	m.Jump(1, &reply)
+	// paused before the song ends
+	m.Toggle("", &reply)
+	wait_song(t, m)
+	// keep_session is subscribed once a change is on disk
+	for deadline := time.Now().Add(2 * time.Second); ; time.Sleep(5 * time.Millisecond) {
+		m.Volume(0, &reply)
+		if session, err := load_session(m.config); err == nil && session.Paused {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("the session was not saved")
+		}
+	}
+	m.Volume(-1, &reply)
+	for deadline := time.Now().Add(2 * time.Second); ; time.Sleep(5 * time.Millisecond) {
+		if session, _ := load_session(m.config); session.Volume == -1 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("the volume change was not saved")
+		}
+	}
+	m.shutdown(0)
+	session, err := load_session(m.config)
+	if err != nil {
+		t.Fatalf("load_session: %v", err)
+	}
+	if session.Playlist != "test" || session.Index != 1 || !session.Playing || !session.Paused || session.Volume != -1 {
+		t.Errorf("saved session: %+v", session)
+	}
+	// the events of the shutdown do not overwrite the session
+	time.Sleep(50 * time.Millisecond)
+	if after, _ := load_session(m.config); after.Playing != session.Playing {
+		t.Errorf("session after shutdown: %+v", after)
+	}
+}
+
+func TestRestore(t *testing.T) {
+	m := new_test_manager(t, 3)
+	t.Cleanup(func() { m.Stop("", &PlayerReply{}) })
+	err := m.restore(Session{ Playlist: "All Songs", Index: 2, Position: 0.25, Volume: -2, Playing: true, Paused: true })
+	if err != nil {
+		t.Fatalf("restore: %v", err)
+	}
+	wait_song(t, m)
+	var status Status
+	m.Status("", &status)
+	if status.Playlist != "All Songs" || status.Length != 3 || status.Index != 2 || !status.Playing || !status.Paused || status.Volume != -2 {
+		t.Errorf("restored status: %+v", status)
+	}
+	if status.Position < 0.24 || status.Position > 0.26 {
+		t.Errorf("restored at %vs, want 0.25s", status.Position)
+	}
+
+	songs := []Song{ { Id: 0, Title: "one", Path: m.playlist.songs[0].path } }
+	if err := m.restore(Session{ Playlist: "Unlisted", Songs: songs, Index: 5 }); err != nil {
+		t.Fatalf("restore unlisted: %v", err)
+	}
+	if m.Status("", &status); status.Playlist != "Unlisted" || status.Length != 1 || status.Index != 0 {
+		t.Errorf("restored unlisted status: %+v", status)
+	}
+	if err := m.restore(Session{ Playlist: "gone" }); err == nil {
+		t.Errorf("restored a deleted playlist")
+	}
+}
@@ -0,0 +1,335 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net/rpc"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/chzyer/readline"
+)
+
+// `apollo shell`, runs the commands of the cli on a single connection to the
+// daemon, with completion, a history kept in the state dir and the changes of
+// the player printed as they happen.
+
+var shell_commands = []string{
+	"add", "broken", "clean", "create", "delete", "exit", "help", "kill", "list",
+	"next", "play", "playlist", "playlists", "prev", "remove", "status", "stop",
+	"sync", "toggle", "vol",
+}
+
+func run_shell(config *Config) error {
+	client, err := dial_daemon(config)
+	if err != nil {
+		return err
+	}
+	defer client.Close()
+	return shell(config, client, &readline.Config{})
+}
+
+func shell(config *Config, client *rpc.Client, rl_config *readline.Config) error {
+	get_dir(config.StateDir, 0755, config.quiet)
+	rl_config.Prompt = "apollo> "
+	rl_config.HistoryFile = filepath.Join(config.StateDir, "shell_history")
+	rl_config.AutoComplete = &shell_completer{ client: client }
+	rl, err := readline.NewEx(rl_config)
+	if err != nil {
+		return new_rpc_error(code_internal, "cannot open the terminal: %v", err)
+	}
+	defer rl.Close()
+	w := rl.Stdout()
+
+	done := make(chan struct{})
+	defer close(done)
+	go notify_shell(w, client, done)
+	for {
+		line, err := rl.Readline()
+		if errors.Is(err, readline.ErrInterrupt) {
+			continue
+		}
+		if err != nil {
+			return nil
+		}
+		words, err := split_words(line)
+		if err != nil {
+			fmt.Fprintf(w, "ERROR: %v\n", err)
+			continue
+		}
+		if len(words) == 0 {
+			continue
+		}
+		switch words[0] {
+		case "exit", "quit":
+			return nil
+		case "help":
+			shell_help(w, words[1:])
+			continue
+		}
+		if !slices.Contains(shell_commands, words[0]) {
+			fmt.Fprintf(w, "ERROR: unknown command '%s', try help\n", words[0])
+			continue
+		}
+		// `COMMAND --help` is `help COMMAND`, as on the command line
+		if slices.Contains(words[1:], "--help") || slices.Contains(words[1:], "-h") {
+			shell_help(w, words[:1])
+			continue
+		}
+		cmd, args, err := parse_command(words, config)
+		var usage *usage_error
+		if errors.As(err, &usage) {
+			fmt.Fprintf(w, "ERROR: %s\nUSAGE: %s\n", usage.message, usage.usage)
+			continue
+		}
+		if cmd == "add" || cmd == "remove" {
+			args, err = resolve_titles(client, args)
+			if err != nil {
+				print_error(w, config, err)
+				continue
+			}
+		}
+		if err := run_command(w, client, config, cmd, args); err != nil {
+			print_error(w, config, err)
+		}
+		if cmd == "kill" {
+			return nil
+		}
+	}
+}
+
+func shell_help(w io.Writer, words []string) {
+	if len(words) > 0 {
+		if c := find_command(words[0]); c != nil && slices.Contains(shell_commands, c.name) {
+			print_command_help(w, c)
+			return
+		}
+		fmt.Fprintf(w, "ERROR: unknown command '%s', try help\n", words[0])
+		return
+	}
+	fmt.Fprintf(w, "COMMANDS:\n")
+	print_commands(w, shell_commands)
+	fmt.Fprintf(w, "  %-*s %s\n", help_width, "exit", "leave the shell")
+	fmt.Fprintf(w, "\nSongs can be given by title to add and remove, `help COMMAND` shows the usage of a command.\n")
+}
+
+// prints the changes of the player until done is closed.
+func notify_shell(w io.Writer, client *rpc.Client, done chan struct{}) {
+	seq := uint64(0)
+	for {
+		var event Event
+		err := client.Call("MusicManager.Wait", seq, &event)
+		select {
+		case <-done:
+			return
+		default:
+		}
+		if err != nil {
+			fmt.Fprintf(w, "Apollo Error: lost the daemon: %v\n", err)
+			return
+		}
+		seq = event.Seq
+		if message := format_event(event); message != "" {
+			fmt.Fprintf(w, "Apollo: %s\n", message)
+		}
+	}
+}
+
+func format_event(event Event) string {
+	status := event.Status
+	switch event.Type {
+	case event_track_started:
+		if event.Song != nil {
+			return "Now Playing: " + event.Song.Title
+		}
+	case event_paused:
+		return "Paused"
+	case event_resumed:
+		return "Resumed"
+	case event_track_skipped:
+		if event.Song != nil {
+			return fmt.Sprintf("Skipped %s: %s", event.Song.Title, event.Error)
+		}
+	case event_stopped:
+		return fmt.Sprintf("Stopped at index: %d", status.Index)
+	case event_playlist_switched:
+		return fmt.Sprintf("Switched to playlist '%s'", status.Playlist)
+	case event_library_synced:
+		if event.Sync != nil {
+			return fmt.Sprintf("Library synced, added %d song(s)", event.Sync.Added)
+		}
+	}
+	return ""
+}
+
+// songs can be given by title in the shell, titles are turned into ids.
+func resolve_titles(client *rpc.Client, args []any) ([]any, error) {
+	var library LibraryReply
+	resolved := []any{}
+	for _, arg := range args {
+		word := arg.(string)
+		if _, err := strconv.Atoi(word); err == nil {
+			resolved = append(resolved, word)
+			continue
+		}
+		if library.Songs == nil {
+			if err := client.Call("MusicManager.List", "", &library); err != nil {
+				return nil, err
+			}
+		}
+		i := slices.IndexFunc(library.Songs, func(song Song) bool {
+			return strings.EqualFold(song.Title, word)
+		})
+		if i == -1 {
+			return nil, new_rpc_error(code_not_found, "no song titled '%s'", word)
+		}
+		resolved = append(resolved, strconv.Itoa(library.Songs[i].Id))
+	}
+	return resolved, nil
+}
+
+// splits a line into words, quotes and backslashes keep spaces in a word.
+func split_words(line string) ([]string, error) {
+	words := []string{}
+	var word strings.Builder
+	in_word := false
+	var quote rune
+	escaped := false
+	for _, r := range line {
+		switch {
+		case escaped:
+			word.WriteRune(r)
+			escaped = false
+		case r == '\\':
+			escaped, in_word = true, true
+		case quote != 0 && r == quote:
+			quote = 0
+		case quote != 0:
+			word.WriteRune(r)
+		case r == '"' || r == '\'':
+			quote, in_word = r, true
+		case r == ' ' || r == '\t':
+			if in_word {
+				words = append(words, word.String())
+				word.Reset()
+				in_word = false
+			}
+		default:
+			word.WriteRune(r)
+			in_word = true
+		}
+	}
+	if quote != 0 {
+		return nil, fmt.Errorf("missing closing %c", quote)
+	}
+	if in_word {
+		words = append(words, word.String())
+	}
+	return words, nil
+}
+
+func escape_word(word string) string {
+	return strings.NewReplacer(`\`, `\\`, " ", `\ `, `"`, `\"`, "'", `\'`).Replace(word)
+}
+
+type shell_completer struct {
+	client *rpc.Client
+}
+
+// completes the word before the cursor, readline appends the returned
+// suffixes to the line.
+func (c *shell_completer) Do(line []rune, pos int) ([][]rune, int) {
+	before := string(line[:pos])
+	start := len(before)
+	for start > 0 && !(before[start-1] == ' ' && (start < 2 || before[start-2] != '\\')) {
+		start--
+	}
+	words, err := split_words(before[:start])
+	if err != nil {
+		return nil, 0
+	}
+	current := ""
+	if raw := before[start:]; raw != "" {
+		parts, err := split_words(raw)
+		if err != nil || len(parts) != 1 {
+			return nil, 0
+		}
+		current = parts[0]
+	}
+	suffixes := [][]rune{}
+	for _, candidate := range c.candidates(words, current) {
+		if !strings.HasPrefix(candidate, current) {
+			continue
+		}
+		suffix := escape_word(candidate[len(current):])
+		// directories are completed further
+		if !strings.HasSuffix(candidate, "/") {
+			suffix += " "
+		}
+		suffixes = append(suffixes, []rune(suffix))
+	}
+	return suffixes, len([]rune(before[start:]))
+}
+
+func (c *shell_completer) candidates(words []string, current string) []string {
+	if len(words) == 0 {
+		return shell_commands
+	}
+	candidates := []string{}
+	switch words[0] {
+	case "play", "delete":
+		if len(words) > 1 {
+			break
+		}
+		var reply PlaylistsReply
+		c.client.Call("MusicManager.Playlists", "", &reply)
+		for _, playlist := range reply.Playlists {
+			candidates = append(candidates, playlist.Name)
+		}
+	case "add":
+		var reply LibraryReply
+		c.client.Call("MusicManager.List", "", &reply)
+		for _, song := range reply.Songs {
+			candidates = append(candidates, song.Title)
+		}
+	case "remove":
+		var reply PlaylistReply
+		c.client.Call("MusicManager.Playlist", "", &reply)
+		for _, song := range reply.Songs {
+			candidates = append(candidates, song.Title)
+		}
+	case "sync":
+		if len(words) == 1 {
+			candidates = complete_dirs(current)
+		}
+	}
+	return candidates
+}
+
+// directories starting with path, ending with a slash. A leading ~/ is
+// expanded to the home directory.
+func complete_dirs(path string) []string {
+	if home, err := os.UserHomeDir(); err == nil && strings.HasPrefix(path, "~/") {
+		path = home + path[1:]
+	}
+	dir, prefix := filepath.Split(path)
+	read := dir
+	if read == "" {
+		read = "."
+	}
+	entries, err := os.ReadDir(read)
+	if err != nil {
+		return nil
+	}
+	dirs := []string{}
+	for _, entry := range entries {
+		if entry.IsDir() && strings.HasPrefix(entry.Name(), prefix) {
+			dirs = append(dirs, dir + entry.Name() + "/")
+		}
+	}
+	return dirs
+}
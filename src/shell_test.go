@@ -0,0 +1,161 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/chzyer/readline"
+)
+
+// a buffer written by the shell and its notifications at the same time.
+type locked_buffer struct {
+	mu sync.Mutex
+	buf bytes.Buffer
+}
+
+func (b *locked_buffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.Write(p)
+}
+
+func (b *locked_buffer) String() string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.String()
+}
+
+func TestSplitWords(t *testing.T) {
+	words, err := split_words(`play  my\ mix "two words" 'it''s' ""`)
+	want := []string{"play", "my mix", "two words", "its", ""}
+	if err != nil || !slices.Equal(words, want) {
+		t.Errorf("split_words = %q, %v, want %q", words, err, want)
+	}
+	if _, err := split_words(`play "mix`); err == nil {
+		t.Errorf("split_words: unclosed quote accepted")
+	}
+	if words, _ := split_words(escape_word(`a "b" \c`)); !slices.Equal(words, []string{`a "b" \c`}) {
+		t.Errorf("escape_word does not survive split_words: %q", words)
+	}
+}
+
+func TestShellCompletion(t *testing.T) {
+	_, config := setup_test_env(t)
+	run_cmd(config, "sync")
+	run_cmd(config, "create", "my mix")
+	start_test_daemon(t, config)
+	client, err := dial_daemon(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	completer := &shell_completer{ client: client }
+
+	complete := func(line string) []string {
+		suffixes, _ := completer.Do([]rune(line), len([]rune(line)))
+		completions := []string{}
+		for _, suffix := range suffixes {
+			completions = append(completions, line + string(suffix))
+		}
+		return completions
+	}
+	if got := complete("pla"); !slices.Equal(got, []string{"play ", "playlist ", "playlists "}) {
+		t.Errorf("pla: got %q", got)
+	}
+	if got := complete("play m"); !slices.Equal(got, []string{`play my\ mix `}) {
+		t.Errorf("play m: got %q", got)
+	}
+	if got := complete(`delete my\ `); !slices.Equal(got, []string{`delete my\ mix `}) {
+		t.Errorf("delete my\\ : got %q", got)
+	}
+	if got := complete("add t"); !slices.Equal(got, []string{"add two ", "add three "}) {
+		t.Errorf("add t: got %q", got)
+	}
+	dir := t.TempDir()
+	os.Mkdir(filepath.Join(dir, "albums"), 0755)
+	os.WriteFile(filepath.Join(dir, "about.txt"), nil, 0644)
+	if got := complete("sync " + dir + "/a"); !slices.Equal(got, []string{"sync " + dir + "/albums/"}) {
+		t.Errorf("sync: got %q", got)
+	}
+}
+
+func TestShell(t *testing.T) {
+	_, config := setup_test_env(t)
+	config.Loop = true
+	run_cmd(config, "sync")
+	td := start_test_daemon(t, config)
+	client, err := dial_daemon(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+
+	input, lines := io.Pipe()
+	var output locked_buffer
+	done := make(chan error)
+	go func() {
+		done <- shell(config, client, &readline.Config{
+			Stdin: input,
+			Stdout: &output,
+			FuncIsTerminal: func() bool { return false },
+		})
+	}()
+	expect := func(want string) {
+		t.Helper()
+		deadline := time.Now().Add(2 * time.Second)
+		for !strings.Contains(output.String(), want) {
+			if time.Now().After(deadline) {
+				t.Fatalf("output does not contain %q:\n%s", want, output.String())
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+	}
+	send := func(line string) {
+		fmt.Fprintf(lines, "%s\n", line)
+	}
+
+	send(`create "my mix"`)
+	expect("Successfully created playlist 'my mix'!")
+	send(`play my\ mix`)
+	expect("Can't play 'my mix', has 0 songs")
+	send("add one 3")
+	expect("Added 2 song(s) to 'my mix' playlist")
+	send("add nothing")
+	expect("Apollo Error: no song titled 'nothing'")
+	send("play")
+	expect("Apollo: Now Playing: one")
+	send("vol x")
+	expect("ERROR: invalid volume value 'x'")
+	send("bogus")
+	expect("ERROR: unknown command 'bogus', try help")
+	send("help")
+	expect("vol VALUE")
+	send("remove --help")
+	expect("USAGE: apollo remove SONG_ID...")
+	// stopped by another client
+	td.manager.Stop("", &PlayerReply{})
+	expect("Apollo: Stopped at index")
+	send("exit")
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Errorf("shell: %v", err)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatalf("exit did not end the shell")
+	}
+	lines.Close()
+
+	history, err := os.ReadFile(filepath.Join(config.StateDir, "shell_history"))
+	if err != nil || !strings.Contains(string(history), "add one 3") {
+		t.Errorf("history = %q, %v", history, err)
+	}
+}
@@ -0,0 +1,141 @@
+package main
+
+import (
+	"math"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/gopxl/beep"
+)
+
+// Audio served over http: the files of the library as they are, and what the
+// daemon is playing as an endless 16 bit stereo wav at /live.
+
+var audio_types = map[string]string{
+	".ogg": "audio/ogg",
+	".wav": "audio/wav",
+}
+
+// chunks a listener can fall behind before chunks are dropped for it
+const live_backlog = 64
+
+// hands the samples going to the output to the /live listeners.
+type live_stream struct {
+	mu sync.Mutex
+	listeners map[chan []byte]struct{}
+}
+
+func new_live_stream() *live_stream {
+	return &live_stream{ listeners: map[chan []byte]struct{}{} }
+}
+
+func (l *live_stream) listen() chan []byte {
+	ch := make(chan []byte, live_backlog)
+	l.mu.Lock()
+	l.listeners[ch] = struct{}{}
+	l.mu.Unlock()
+	return ch
+}
+
+func (l *live_stream) leave(ch chan []byte) {
+	l.mu.Lock()
+	delete(l.listeners, ch)
+	l.mu.Unlock()
+}
+
+// called from the output while it streams, so it never blocks.
+func (l *live_stream) publish(samples [][2]float64) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if len(l.listeners) == 0 || len(samples) == 0 {
+		return
+	}
+	chunk := append_pcm(nil, samples)
+	for ch := range l.listeners {
+		select {
+		case ch <- chunk:
+		default:
+		}
+	}
+}
+
+type live_tap struct {
+	beep.Streamer
+	live *live_stream
+}
+
+func (t live_tap) Stream(samples [][2]float64) (int, bool) {
+	n, ok := t.Streamer.Stream(samples)
+	t.live.publish(samples[:n])
+	return n, ok
+}
+
+// copies what s streams to the listeners.
+func (l *live_stream) tap(s beep.Streamer) beep.Streamer {
+	if l == nil {
+		return s
+	}
+	return live_tap{ Streamer: s, live: l }
+}
+
+func handle_song_stream(m *MusicManager) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		id, err := strconv.Atoi(r.PathValue("id"))
+		if err != nil {
+			write_http(w, nil, new_rpc_error(code_invalid, "'%s' is not a song id", r.PathValue("id")))
+			return
+		}
+		song, err := get_song_by_id(m.db, id)
+		if err != nil {
+			write_http(w, nil, new_rpc_error(code_not_found, "no song with id %d", id))
+			return
+		}
+		file, err := os.Open(song.path)
+		if err != nil {
+			write_http(w, nil, new_rpc_error(code_not_found, "file of song %d is missing: %v", id, err))
+			return
+		}
+		defer file.Close()
+		info, err := file.Stat()
+		if err != nil {
+			write_http(w, nil, new_rpc_error(code_internal, "%v", err))
+			return
+		}
+		if content_type, ok := audio_types[strings.ToLower(filepath.Ext(song.path))]; ok {
+			w.Header().Set("Content-Type", content_type)
+		}
+		// handles Range and conditional requests
+		http.ServeContent(w, r, filepath.Base(song.path), info.ModTime(), file)
+	}
+}
+
+func handle_live(m *MusicManager) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		ch := m.live.listen()
+		defer m.live.leave(ch)
+		w.Header().Set("Content-Type", "audio/wav")
+		w.Header().Set("Cache-Control", "no-store")
+		// the length is unknown, players read until the connection ends
+		if err := write_wav_header(w, math.MaxUint32 - 36); err != nil {
+			return
+		}
+		flusher, _ := w.(http.Flusher)
+		for {
+			if flusher != nil {
+				flusher.Flush()
+			}
+			select {
+			case <-r.Context().Done():
+				return
+			case chunk := <-ch:
+				if _, err := w.Write(chunk); err != nil {
+					return
+				}
+			}
+		}
+	}
+}
@@ -0,0 +1,619 @@
+package main
+
+import (
+	"fmt"
+	"net/rpc"
+	"strings"
+	"time"
+
+	"github.com/gdamore/tcell/v2"
+)
+
+// `apollo tui`, a full-screen client of the daemon over the rpc socket. It
+// follows the changes of the player with MusicManager.Wait.
+
+const (
+	pane_playlist = iota
+	pane_library
+	pane_playlists
+	pane_count
+)
+
+var pane_titles = [pane_count]string{ "Playlist", "Library", "Playlists" }
+
+var tui_help = []string{
+	"space   play or pause",
+	"s       stop",
+	"n b     next and previous song",
+	"+ -     volume up and down",
+	"← →     seek 5 seconds back and forward",
+	"tab     next pane, 1 2 3 jump to a pane",
+	"↑ ↓     move, also j k, pgup pgdn, home end",
+	"enter   play the song or playlist, add the library song",
+	"a       add the library song to the playlist",
+	"d       remove the song from the playlist, delete the playlist",
+	"/       search the library",
+	"c       create a playlist",
+	"S C     sync and clean the library",
+	"r       reload everything",
+	"K       kill the daemon",
+	"?       this help",
+	"q       quit",
+}
+
+var (
+	style_title = tcell.StyleDefault.Bold(true)
+	style_muted = tcell.StyleDefault.Foreground(tcell.ColorGray)
+	style_accent = tcell.StyleDefault.Foreground(tcell.ColorYellow)
+	style_cursor = tcell.StyleDefault.Reverse(true)
+	style_error = tcell.StyleDefault.Foreground(tcell.ColorRed)
+)
+
+type tui struct {
+	screen tcell.Screen
+	client *rpc.Client
+	status Status
+	// when status was received, the position is advanced from it while playing
+	status_time time.Time
+	playlist PlaylistReply
+	// songs of the library and the ones matching the search
+	songs []Song
+	library []Song
+	query string
+	playlists []PlaylistSummary
+	pane int
+	cursor [pane_count]int
+	offset [pane_count]int
+	help bool
+	// question asked on the last line, answer is called with what was typed
+	prompt string
+	input string
+	answer func(string)
+	// answered by a single key
+	confirm bool
+	message string
+	failed bool
+	quit bool
+}
+
+func run_tui(config *Config) error {
+	client, err := dial_daemon(config)
+	if err != nil {
+		return err
+	}
+	defer client.Close()
+	screen, err := tcell.NewScreen()
+	if err != nil {
+		return new_rpc_error(code_internal, "cannot open the terminal: %v", err)
+	}
+	if err := screen.Init(); err != nil {
+		return new_rpc_error(code_internal, "cannot open the terminal: %v", err)
+	}
+	defer screen.Fini()
+	return new_tui(screen, client).run()
+}
+
+func new_tui(screen tcell.Screen, client *rpc.Client) *tui {
+	return &tui{ screen: screen, client: client }
+}
+
+func (t *tui) run() error {
+	t.reload()
+	done := make(chan struct{})
+	defer close(done)
+	go t.watch(done)
+	for !t.quit {
+		t.render()
+		switch ev := t.screen.PollEvent().(type) {
+		case nil:
+			return nil
+		case *tcell.EventResize:
+			t.screen.Sync()
+		case *tcell.EventKey:
+			t.key(ev)
+		case *tcell.EventInterrupt:
+			switch data := ev.Data().(type) {
+			case Event:
+				t.update(data)
+			case error:
+				t.fail(fmt.Errorf("lost the daemon: %v", data))
+			}
+		}
+	}
+	return nil
+}
+
+// posts the changes of the player and a tick to advance the progress.
+func (t *tui) watch(done chan struct{}) {
+	go func() {
+		ticker := time.NewTicker(500 * time.Millisecond)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-done:
+				return
+			case <-ticker.C:
+				t.screen.PostEvent(tcell.NewEventInterrupt(nil))
+			}
+		}
+	}()
+	seq := uint64(0)
+	for {
+		var event Event
+		err := t.client.Call("MusicManager.Wait", seq, &event)
+		select {
+		case <-done:
+			return
+		default:
+		}
+		if err != nil {
+			t.screen.PostEvent(tcell.NewEventInterrupt(err))
+			return
+		}
+		seq = event.Seq
+		t.screen.PostEvent(tcell.NewEventInterrupt(event))
+	}
+}
+
+func (t *tui) update(event Event) {
+	// the event can be older than the reply to a call made meanwhile
+	var status Status
+	if !t.call("MusicManager.Status", "", &status) {
+		return
+	}
+	previous := t.status
+	t.set_status(status)
+	if previous.PlaylistId != t.status.PlaylistId || previous.Length != t.status.Length {
+		t.load_playlist()
+	}
+	if event.Type == event_library_synced {
+		t.load_library()
+	}
+}
+
+func (t *tui) set_status(status Status) {
+	t.status = status
+	t.status_time = time.Now()
+}
+
+func (t *tui) fail(err error) {
+	t.message = as_rpc_error(err).Message
+	t.failed = true
+}
+
+func (t *tui) inform(message string) {
+	t.message = message
+	t.failed = false
+}
+
+func (t *tui) call(method string, args any, reply any) bool {
+	if err := t.client.Call(method, args, reply); err != nil {
+		t.fail(err)
+		return false
+	}
+	return true
+}
+
+// calls a player method, cmd is the command of the cli to word the reply.
+func (t *tui) player(cmd string, method string, args any) {
+	var reply PlayerReply
+	if !t.call(method, args, &reply) {
+		return
+	}
+	t.inform(format_player(cmd, reply))
+	playlist_id := t.status.PlaylistId
+	t.set_status(reply.Status)
+	if reply.Switched || playlist_id != t.status.PlaylistId {
+		t.load_playlist()
+	}
+}
+
+func (t *tui) reload() {
+	var status Status
+	if t.call("MusicManager.Status", "", &status) {
+		t.set_status(status)
+	}
+	t.load_playlist()
+	t.load_library()
+	t.load_playlists()
+}
+
+func (t *tui) load_playlist() {
+	var playlist PlaylistReply
+	if t.call("MusicManager.Playlist", "", &playlist) {
+		t.playlist = playlist
+	}
+	t.clamp(pane_playlist)
+}
+
+func (t *tui) load_library() {
+	var library LibraryReply
+	if t.call("MusicManager.List", "", &library) {
+		t.songs = library.Songs
+	}
+	t.search(t.query)
+}
+
+func (t *tui) load_playlists() {
+	var reply PlaylistsReply
+	if t.call("MusicManager.Playlists", "", &reply) {
+		t.playlists = reply.Playlists
+	}
+	t.clamp(pane_playlists)
+}
+
+func (t *tui) search(query string) {
+	t.query = query
+	t.library = []Song{}
+	for _, song := range t.songs {
+		if strings.Contains(strings.ToLower(song.Title), strings.ToLower(query)) {
+			t.library = append(t.library, song)
+		}
+	}
+	t.clamp(pane_library)
+}
+
+func (t *tui) pane_length(pane int) int {
+	switch pane {
+	case pane_playlist:
+		return len(t.playlist.Songs)
+	case pane_library:
+		return len(t.library)
+	}
+	return len(t.playlists)
+}
+
+func (t *tui) move(delta int) {
+	t.cursor[t.pane] += delta
+	t.clamp(t.pane)
+}
+
+// keeps the cursor of pane on an item after its list changed
+func (t *tui) clamp(pane int) {
+	length := t.pane_length(pane)
+	t.cursor[pane] = max(min(t.cursor[pane], length - 1), 0)
+}
+
+func (t *tui) ask(prompt string, input string, answer func(string)) {
+	t.prompt, t.input, t.answer, t.confirm = prompt, input, answer, false
+}
+
+// asks a yes or no question, yes is called when it is answered with y.
+func (t *tui) ask_yes(prompt string, yes func()) {
+	t.ask(prompt + " (y/n) ", "", func(answer string) {
+		if answer == "y" {
+			yes()
+		}
+	})
+	t.confirm = true
+}
+
+func (t *tui) prompt_key(ev *tcell.EventKey) {
+	switch ev.Key() {
+	case tcell.KeyEscape, tcell.KeyCtrlC:
+		t.prompt = ""
+	case tcell.KeyEnter:
+		t.prompt = ""
+		t.answer(t.input)
+	case tcell.KeyBackspace, tcell.KeyBackspace2:
+		if runes := []rune(t.input); len(runes) > 0 {
+			t.input = string(runes[:len(runes)-1])
+		}
+	case tcell.KeyRune:
+		t.input += string(ev.Rune())
+		if t.confirm {
+			t.prompt = ""
+			t.answer(t.input)
+		}
+	}
+}
+
+func (t *tui) key(ev *tcell.EventKey) {
+	if t.prompt != "" {
+		t.prompt_key(ev)
+		return
+	}
+	_, height := t.screen.Size()
+	page := max(height - 8, 1)
+	switch ev.Key() {
+	case tcell.KeyCtrlC:
+		t.quit = true
+	case tcell.KeyTab:
+		t.pane = (t.pane + 1) % pane_count
+	case tcell.KeyBacktab:
+		t.pane = (t.pane + pane_count - 1) % pane_count
+	case tcell.KeyUp:
+		t.move(-1)
+	case tcell.KeyDown:
+		t.move(1)
+	case tcell.KeyPgUp:
+		t.move(-page)
+	case tcell.KeyPgDn:
+		t.move(page)
+	case tcell.KeyHome:
+		t.move(-t.pane_length(t.pane))
+	case tcell.KeyEnd:
+		t.move(t.pane_length(t.pane))
+	case tcell.KeyLeft:
+		t.player("seek", "MusicManager.Seek", -5.0)
+	case tcell.KeyRight:
+		t.player("seek", "MusicManager.Seek", 5.0)
+	case tcell.KeyEnter:
+		t.activate()
+	case tcell.KeyDelete:
+		t.remove()
+	case tcell.KeyEscape:
+		t.help = false
+	case tcell.KeyRune:
+		t.rune_key(ev.Rune())
+	}
+}
+
+func (t *tui) rune_key(r rune) {
+	switch r {
+	case 'q':
+		t.quit = true
+	case '?':
+		t.help = !t.help
+	case '1', '2', '3':
+		t.pane = int(r - '1')
+	case 'j':
+		t.move(1)
+	case 'k':
+		t.move(-1)
+	case ' ':
+		if t.status.Playing {
+			t.player("toggle", "MusicManager.Toggle", "")
+		} else {
+			t.player("play", "MusicManager.Play", "")
+		}
+	case 's':
+		t.player("stop", "MusicManager.Stop", "")
+	case 'n':
+		t.player("next", "MusicManager.Next", "")
+	case 'b', 'p':
+		t.player("prev", "MusicManager.Previous", "")
+	case '+', '=':
+		t.player("vol", "MusicManager.Volume", 0.5)
+	case '-':
+		t.player("vol", "MusicManager.Volume", -0.5)
+	case 'a':
+		t.add()
+	case 'd':
+		t.remove()
+	case '/':
+		t.pane = pane_library
+		t.ask("Search: ", t.query, func(query string) {
+			t.search(query)
+			t.cursor[pane_library] = 0
+		})
+	case 'c':
+		t.ask("New playlist: ", "", func(name string) {
+			name = strings.TrimSpace(name)
+			var reply PlaylistChange
+			if name != "" && t.call("MusicManager.Create", name, &reply) {
+				t.inform(format_reply("create", reply))
+				t.load_playlists()
+			}
+		})
+	case 'S':
+		t.ask("Sync directory, empty for music_dir: ", "", func(dir string) {
+			var reply SyncReply
+			if t.call("MusicManager.Sync", strings.TrimSpace(dir), &reply) {
+				t.inform(strings.ReplaceAll(format_reply("sync", reply), "\n", ", "))
+				t.load_library()
+			}
+		})
+	case 'C':
+		var reply CleanReply
+		if t.call("MusicManager.Clean", "", &reply) {
+			t.inform(format_reply("clean", reply))
+			t.load_library()
+			t.load_playlist()
+		}
+	case 'r':
+		t.reload()
+		t.inform("Reloaded")
+	case 'K':
+		t.ask_yes("Kill the daemon?", func() {
+			var reply string
+			t.client.Call("Daemon.Kill", "", &reply)
+			t.quit = true
+		})
+	}
+}
+
+// plays the selected song or playlist, adds the selected library song.
+func (t *tui) activate() {
+	switch t.pane {
+	case pane_playlist:
+		if len(t.playlist.Songs) > 0 {
+			t.player("play", "MusicManager.Jump", t.cursor[pane_playlist])
+		}
+	case pane_library:
+		t.add()
+	case pane_playlists:
+		if len(t.playlists) > 0 {
+			t.player("play", "MusicManager.Play", t.playlists[t.cursor[pane_playlists]].Name)
+		}
+	}
+}
+
+func (t *tui) add() {
+	if t.pane != pane_library || len(t.library) == 0 {
+		return
+	}
+	var reply SongsChange
+	song := t.library[t.cursor[pane_library]]
+	if t.call("MusicManager.Add", []int{ song.Id }, &reply) {
+		t.inform(format_reply("add", reply))
+		t.load_playlist()
+		t.load_playlists()
+	}
+}
+
+func (t *tui) remove() {
+	switch t.pane {
+	case pane_playlist:
+		if len(t.playlist.Songs) == 0 {
+			return
+		}
+		var reply SongsChange
+		song := t.playlist.Songs[t.cursor[pane_playlist]]
+		if t.call("MusicManager.Remove", []int{ song.Id }, &reply) {
+			t.inform(format_reply("remove", reply))
+			t.load_playlist()
+			t.load_playlists()
+		}
+	case pane_playlists:
+		if len(t.playlists) == 0 {
+			return
+		}
+		name := t.playlists[t.cursor[pane_playlists]].Name
+		t.ask_yes(fmt.Sprintf("Delete the playlist '%s'?", name), func() {
+			var reply PlaylistChange
+			if t.call("MusicManager.Delete", name, &reply) {
+				t.inform(format_reply("delete", reply))
+				t.load_playlists()
+			}
+		})
+	}
+}
+
+// draws text clipped to width and pads it with spaces in the same style.
+func (t *tui) draw(x int, y int, width int, text string, style tcell.Style) {
+	for text != "" && width > 0 {
+		rest, w := t.screen.Put(x, y, text, style)
+		w = max(w, 1)
+		x, width, text = x + w, width - w, rest
+	}
+	for ; width > 0; width-- {
+		t.screen.SetContent(x, y, ' ', nil, style)
+		x++
+	}
+}
+
+func format_duration(seconds float64) string {
+	total := max(int(seconds), 0)
+	return fmt.Sprintf("%d:%02d", total / 60, total % 60)
+}
+
+func (t *tui) position() float64 {
+	position := t.status.Position
+	if t.status.Playing && !t.status.Paused {
+		position += time.Since(t.status_time).Seconds()
+	}
+	return min(position, t.status.Duration)
+}
+
+func (t *tui) render() {
+	t.screen.Clear()
+	width, height := t.screen.Size()
+	status := t.status
+
+	state := "■ Stopped"
+	if status.Playing && status.Paused {
+		state = "‖ Paused"
+	} else if status.Playing {
+		state = "▶ Playing"
+	}
+	loop := "off"
+	if status.Loop {
+		loop = "on"
+	}
+	t.draw(0, 0, width, "Apollo", style_accent.Bold(true))
+	t.draw(7, 0, width - 7, fmt.Sprintf("%s · volume %+.1f · loop %s · '%s' %d/%d",
+		state, status.Volume, loop, status.Playlist, min(status.Index + 1, status.Length), status.Length), style_muted)
+	title := "Nothing playing"
+	if status.Song != nil {
+		title = status.Song.Title
+	}
+	t.draw(0, 1, width, title, style_title)
+	position := t.position()
+	times := fmt.Sprintf(" %s / %s", format_duration(position), format_duration(status.Duration))
+	bar := max(width - len(times), 0)
+	filled := 0
+	if status.Duration > 0 {
+		filled = int(float64(bar) * position / status.Duration)
+	}
+	t.draw(0, 2, bar, strings.Repeat("━", filled), style_accent)
+	t.draw(filled, 2, bar - filled, strings.Repeat("─", bar - filled), style_muted)
+	t.draw(bar, 2, width - bar, times, tcell.StyleDefault)
+
+	top, bottom := 4, height - 1
+	if t.help {
+		for i, line := range tui_help {
+			t.draw(1, top + i, width - 1, line, tcell.StyleDefault)
+		}
+	} else if width < 60 {
+		t.render_pane(t.pane, 0, top, width, bottom - top)
+	} else {
+		column := width / pane_count
+		for pane := range pane_count {
+			t.render_pane(pane, pane * column, top, column - 1, bottom - top)
+		}
+	}
+
+	switch {
+	case t.prompt != "":
+		t.draw(0, bottom, width, t.prompt + t.input, tcell.StyleDefault)
+		t.screen.ShowCursor(len([]rune(t.prompt + t.input)), bottom)
+	case t.message != "":
+		style := style_muted
+		if t.failed {
+			style = style_error
+		}
+		t.draw(0, bottom, width, t.message, style)
+		t.screen.HideCursor()
+	default:
+		t.draw(0, bottom, width, "? help · q quit", style_muted)
+		t.screen.HideCursor()
+	}
+	t.screen.Show()
+}
+
+func (t *tui) render_pane(pane int, x int, y int, width int, height int) {
+	title := pane_titles[pane]
+	switch pane {
+	case pane_playlist:
+		title += ": " + t.playlist.Name
+	case pane_library:
+		if t.query != "" {
+			title += fmt.Sprintf(" /%s", t.query)
+		}
+	}
+	style := style_muted
+	if pane == t.pane {
+		style = style_accent.Bold(true)
+	}
+	t.draw(x, y, width, title, style)
+	rows := height - 1
+	if rows <= 0 {
+		return
+	}
+	cursor := t.cursor[pane]
+	offset := min(t.offset[pane], cursor)
+	if cursor >= offset + rows {
+		offset = cursor - rows + 1
+	}
+	t.offset[pane] = offset
+	for row := 0; row < rows && offset + row < t.pane_length(pane); row++ {
+		i := offset + row
+		text, style := "", tcell.StyleDefault
+		switch pane {
+		case pane_playlist:
+			text = fmt.Sprintf("%d. %s", i + 1, t.playlist.Songs[i].Title)
+			if i == t.status.Index && t.playlist.Id == t.status.PlaylistId {
+				style = style_accent
+			}
+		case pane_library:
+			text = fmt.Sprintf("%d: %s", t.library[i].Id, t.library[i].Title)
+		case pane_playlists:
+			text = fmt.Sprintf("%s (%d)", t.playlists[i].Name, t.playlists[i].Count)
+		}
+		if i == cursor && pane == t.pane {
+			style = style_cursor
+		}
+		t.draw(x, y + 1 + row, width, text, style)
+	}
+}
@@ -0,0 +1,201 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gdamore/tcell/v2"
+)
+
+type test_tui struct {
+	t *testing.T
+	screen *snapshot_screen
+	done chan struct{}
+}
+
+// keeps the text of the screen at every Show, reading the simulated screen
+// while the tui draws on it is a race.
+type snapshot_screen struct {
+	tcell.SimulationScreen
+	mu sync.Mutex
+	text string
+}
+
+func (s *snapshot_screen) Show() {
+	s.SimulationScreen.Show()
+	cells, width, _ := s.GetContents()
+	var text strings.Builder
+	for i, cell := range cells {
+		text.WriteString(string(cell.Runes))
+		if (i + 1) % width == 0 {
+			text.WriteByte('\n')
+		}
+	}
+	s.mu.Lock()
+	s.text = text.String()
+	s.mu.Unlock()
+}
+
+func start_test_tui(t *testing.T, config *Config) *test_tui {
+	t.Helper()
+	client, err := dial_rpc(config)
+	if err != nil {
+		t.Fatalf("dial_rpc: %v", err)
+	}
+	t.Cleanup(func() { client.Close() })
+	screen := &snapshot_screen{ SimulationScreen: tcell.NewSimulationScreen("") }
+	if err := screen.Init(); err != nil {
+		t.Fatal(err)
+	}
+	screen.SetSize(120, 30)
+	tt := &test_tui{ t: t, screen: screen, done: make(chan struct{}) }
+	go func() {
+		defer close(tt.done)
+		new_tui(screen, client).run()
+	}()
+	// quits before the screen goes away, Fini while the tui draws is a race.
+	// The first ctrl-c closes a prompt left open.
+	t.Cleanup(func() {
+		tt.keys(tcell.KeyCtrlC, tcell.KeyCtrlC)
+		<-tt.done
+		screen.Fini()
+	})
+	return tt
+}
+
+func (tt *test_tui) text() string {
+	tt.screen.mu.Lock()
+	defer tt.screen.mu.Unlock()
+	return tt.screen.text
+}
+
+// waits for the screen to show what and the daemon to agree with done.
+func (tt *test_tui) wait(what string, done func() bool) {
+	tt.t.Helper()
+	deadline := time.Now().Add(2 * time.Second)
+	for time.Now().Before(deadline) {
+		if strings.Contains(tt.text(), what) && (done == nil || done()) {
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	tt.t.Fatalf("screen does not show %q:\n%s", what, tt.text())
+}
+
+func (tt *test_tui) keys(keys ...tcell.Key) {
+	for _, key := range keys {
+		tt.screen.InjectKey(key, 0, tcell.ModNone)
+	}
+}
+
+func (tt *test_tui) type_text(text string) {
+	for _, r := range text {
+		tt.screen.InjectKey(tcell.KeyRune, r, tcell.ModNone)
+	}
+}
+
+func TestTui(t *testing.T) {
+	_, config := setup_test_env(t)
+	config.Loop = true
+	run_cmd(config, "sync")
+	run_cmd(config, "create", "mix")
+	td := start_test_daemon(t, config)
+	tt := start_test_tui(t, config)
+
+	tt.wait("mix (0)", nil)
+	tt.wait("3: three", nil)
+
+	// plays the empty playlist to switch to it, then adds the first song
+	tt.type_text("3")
+	tt.keys(tcell.KeyEnter)
+	tt.wait("Can't play 'mix', has 0 songs", func() bool {
+		name, _, _, _, _ := td.state()
+		return name == "mix"
+	})
+	tt.type_text("2a")
+	tt.wait("1. one", func() bool {
+		_, length, _, _, _ := td.state()
+		return length == 1
+	})
+	tt.wait("mix (1)", nil)
+
+	tt.type_text(" ")
+	tt.wait("▶ Playing", func() bool {
+		_, _, _, playing, _ := td.state()
+		return playing
+	})
+	tt.type_text(" +")
+	tt.wait("volume +0.5", func() bool {
+		_, _, _, _, paused := td.state()
+		return paused
+	})
+
+	tt.type_text("/thr")
+	tt.keys(tcell.KeyEnter)
+	tt.wait("Library /thr", nil)
+	if text := tt.text(); strings.Contains(text, "2: two") {
+		t.Errorf("search thr still shows two:\n%s", text)
+	}
+
+	tt.type_text("cjazz")
+	tt.keys(tcell.KeyEnter)
+	tt.wait("jazz (0)", nil)
+	tt.type_text("3")
+	tt.keys(tcell.KeyDown)
+	tt.type_text("d")
+	tt.wait("Delete the playlist 'jazz'? (y/n)", nil)
+	tt.keys(tcell.KeyEscape)
+	tt.type_text("dy")
+	tt.wait("Successfully deleted playlist 'jazz'!", nil)
+
+	// changes made by other clients show up
+	td.manager.Stop("", &PlayerReply{})
+	tt.wait("■ Stopped", nil)
+
+	tt.type_text("?")
+	tt.wait("this help", nil)
+	tt.type_text("q")
+	select {
+	case <-tt.done:
+	case <-time.After(2 * time.Second):
+		t.Fatalf("q did not quit")
+	}
+}
+
+func TestTuiShrinkingLists(t *testing.T) {
+	music_dir, config := setup_test_env(t)
+	run_cmd(config, "sync")
+	run_cmd(config, "create", "mix")
+	run_cmd(config, "create", "short")
+	td := start_test_daemon(t, config)
+	td.manager.Play("short", &PlayerReply{})
+	td.manager.Add([]int{ 1 }, &SongsChange{})
+	td.manager.Play("mix", &PlayerReply{})
+	td.manager.Stop("", &PlayerReply{})
+	td.manager.Add([]int{ 1, 2, 3 }, &SongsChange{})
+	tt := start_test_tui(t, config)
+	tt.type_text("r")
+	tt.wait("3. three", nil)
+
+	// the cursors on the last songs of the playlist and the library
+	tt.type_text("1jj2jj")
+	os.Remove(filepath.Join(music_dir, "a", "two.wav"))
+	os.Remove(filepath.Join(music_dir, "b", "three.wav"))
+	tt.type_text("C")
+	tt.wait("Cleaned 2 item(s) in the database", nil)
+	tt.type_text("a")
+	tt.wait("Songs provided are already in the playlist", nil)
+
+	// another client switches to a shorter playlist
+	td.manager.Play("short", &PlayerReply{})
+	tt.wait("Playlist: short", nil)
+	tt.type_text("1d")
+	tt.wait("Deleted 1 song(s) from 'short' playlist", func() bool {
+		name, length, _, _, _ := td.state()
+		return name == "short" && length == 0
+	})
+}
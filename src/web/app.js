@@ -0,0 +1,285 @@
+// web ui of the apollo daemon, talks to the http api of the daemon serving it
+"use strict";
+
+const $ = (id) => document.getElementById(id);
+
+let token = localStorage.getItem("apollo_token") || "";
+let status = null;
+// when status was received, the position is advanced from it while playing
+let status_time = 0;
+let events = null;
+
+// the token can be given once in the url, it is kept in the browser
+const params = new URLSearchParams(location.search);
+if (params.has("token")) {
+  token = params.get("token");
+  localStorage.setItem("apollo_token", token);
+  history.replaceState(null, "", location.pathname);
+}
+
+async function api(method, path, body) {
+  const options = { method, headers: {} };
+  if (token) {
+    options.headers["Authorization"] = "Bearer " + token;
+  }
+  if (body !== undefined) {
+    options.headers["Content-Type"] = "application/json";
+    options.body = JSON.stringify(body);
+  }
+  const resp = await fetch(path, options);
+  if (resp.status === 401) {
+    show_login();
+    throw new Error("unauthorized");
+  }
+  const reply = await resp.json();
+  if (reply.error) {
+    show_error(reply.error.message);
+    throw new Error(reply.error.message);
+  }
+  show_error("");
+  return reply;
+}
+
+function show_error(message) {
+  $("error").textContent = message;
+  $("error").hidden = message === "";
+}
+
+function show_login() {
+  if (events) {
+    events.close();
+    events = null;
+  }
+  $("app").hidden = true;
+  $("login").hidden = false;
+  $("connection").textContent = "not connected";
+}
+
+function format_time(seconds) {
+  seconds = Math.max(0, Math.floor(seconds));
+  const s = String(seconds % 60).padStart(2, "0");
+  return `${Math.floor(seconds / 60)}:${s}`;
+}
+
+function element(tag, text, class_name) {
+  const el = document.createElement(tag);
+  if (text !== undefined) {
+    el.textContent = text;
+  }
+  if (class_name) {
+    el.className = class_name;
+  }
+  return el;
+}
+
+function set_status(s) {
+  const switched = !status || status.playlist_id !== s.playlist_id || status.length !== s.length;
+  status = s;
+  status_time = performance.now();
+  $("np-playlist").textContent = s.playlist;
+  $("np-title").textContent = s.song ? s.song.title : "Nothing playing";
+  $("play").innerHTML = s.playing && !s.paused ? "&#9208;" : "&#9654;";
+  if (document.activeElement !== $("volume")) {
+    $("volume").value = s.volume;
+  }
+  $("volume-value").textContent = s.volume;
+  render_progress();
+  if (switched) {
+    load_playlist();
+  } else {
+    mark_current();
+  }
+}
+
+function render_progress() {
+  if (!status) {
+    return;
+  }
+  let position = status.position;
+  if (status.playing && !status.paused) {
+    position += (performance.now() - status_time) / 1000;
+  }
+  position = Math.min(position, status.duration);
+  $("np-position").textContent = format_time(position);
+  $("np-duration").textContent = format_time(status.duration);
+  const percent = status.duration > 0 ? position / status.duration * 100 : 0;
+  $("np-bar").style.width = percent + "%";
+}
+
+function mark_current() {
+  const items = $("playlist").children;
+  for (let i = 0; i < items.length; i++) {
+    items[i].classList.toggle("current", status && i === status.index);
+  }
+}
+
+async function load_playlist() {
+  const playlist = await api("GET", "/playlist");
+  $("playlist-name").textContent = playlist.name;
+  const list = $("playlist");
+  list.replaceChildren();
+  playlist.songs.forEach((song, i) => {
+    const item = element("li");
+    const title = element("span", `${i + 1}. ${song.title}`, "grow");
+    title.title = "Play";
+    title.onclick = () => player("jump", { index: i });
+    item.append(title);
+    // songs can only be removed from playlists of the database
+    if (playlist.id > 0) {
+      const remove = element("button", "✕");
+      remove.title = "Remove from the playlist";
+      remove.onclick = async () => {
+        await api("DELETE", `/playlists/${encodeURIComponent(playlist.name)}/songs`, { ids: [song.id] });
+        load_playlist();
+        load_playlists();
+      };
+      item.append(remove);
+    }
+    list.append(item);
+  });
+  mark_current();
+}
+
+async function load_playlists() {
+  const reply = await api("GET", "/playlists");
+  const list = $("playlists");
+  const target = $("add-target");
+  const selected = target.value;
+  list.replaceChildren();
+  target.replaceChildren();
+  for (const playlist of reply.playlists || []) {
+    const item = element("li");
+    const name = element("span", `${playlist.name} (${playlist.count})`, "grow");
+    name.title = "Play";
+    name.onclick = () => player("play", { playlist: playlist.name });
+    const remove = element("button", "Delete");
+    remove.onclick = async () => {
+      if (!confirm(`Delete the playlist '${playlist.name}'?`)) {
+        return;
+      }
+      await api("DELETE", `/playlists/${encodeURIComponent(playlist.name)}`);
+      load_playlists();
+    };
+    item.append(name, remove);
+    list.append(item);
+    target.append(new Option(playlist.name, playlist.name, false, playlist.name === selected));
+  }
+}
+
+async function load_library() {
+  const query = encodeURIComponent($("search").value);
+  const reply = await api("GET", `/library?q=${query}`);
+  const list = $("library");
+  list.replaceChildren();
+  for (const song of reply.songs) {
+    const item = element("li");
+    const title = element("span", song.title, "grow");
+    const add = element("button", "Add");
+    add.title = "Add to the selected playlist";
+    add.onclick = async () => {
+      const name = $("add-target").value;
+      if (!name) {
+        show_error("create a playlist to add songs to");
+        return;
+      }
+      await api("POST", `/playlists/${encodeURIComponent(name)}/songs`, { ids: [song.id] });
+      load_playlists();
+      if (status && status.playlist === name) {
+        load_playlist();
+      }
+    };
+    item.append(title, add);
+    list.append(item);
+  }
+}
+
+async function player(action, body) {
+  const reply = await api("POST", `/player/${action}`, body);
+  set_status(reply.status);
+}
+
+function listen_events() {
+  const url = token ? `/events?token=${encodeURIComponent(token)}` : "/events";
+  events = new EventSource(url);
+  events.onopen = () => {
+    $("connection").textContent = "connected";
+  };
+  events.onerror = () => {
+    $("connection").textContent = "reconnecting...";
+  };
+  const update = (e) => {
+    const event = JSON.parse(e.data);
+    set_status(event.status);
+    if (event.type === "library_synced") {
+      load_library();
+    }
+  };
+  for (const type of ["status", "track_started", "track_ended", "paused", "resumed",
+    "stopped", "volume_changed", "playlist_switched", "library_synced"]) {
+    events.addEventListener(type, update);
+  }
+}
+
+async function start() {
+  try {
+    set_status(await api("GET", "/status"));
+  } catch (e) {
+    return;
+  }
+  $("login").hidden = true;
+  $("app").hidden = false;
+  load_playlists();
+  load_library();
+  listen_events();
+}
+
+for (const button of document.querySelectorAll("[data-action]")) {
+  button.onclick = () => player(button.dataset.action);
+}
+
+$("play").onclick = () => {
+  if (status && status.playing) {
+    player("toggle");
+  } else {
+    player("play");
+  }
+};
+
+$("volume").oninput = () => {
+  $("volume-value").textContent = $("volume").value;
+};
+
+$("volume").onchange = () => {
+  // the api changes the volume by a delta
+  const delta = Number($("volume").value) - status.volume;
+  if (delta !== 0) {
+    player("volume", { delta });
+  }
+};
+
+let search_timer = 0;
+$("search").oninput = () => {
+  clearTimeout(search_timer);
+  search_timer = setTimeout(load_library, 200);
+};
+
+$("create-playlist").onsubmit = async (e) => {
+  e.preventDefault();
+  const name = $("playlist-new").value.trim();
+  const reply = await api("POST", "/playlists", { name });
+  if (!reply.changed) {
+    show_error(`playlist '${name}' already exists`);
+  }
+  $("playlist-new").value = "";
+  load_playlists();
+};
+
+$("login").onsubmit = (e) => {
+  e.preventDefault();
+  token = $("token").value.trim();
+  localStorage.setItem("apollo_token", token);
+  start();
+};
+
+setInterval(render_progress, 500);
+start();